@@ -0,0 +1,521 @@
+package simulation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/spegel-org/spegel/internal/option"
+	"github.com/spegel-org/spegel/pkg/httpx"
+	"github.com/spegel-org/spegel/pkg/oci"
+	"github.com/spegel-org/spegel/pkg/registry"
+	"github.com/spegel-org/spegel/pkg/routing"
+	"github.com/spegel-org/spegel/pkg/state"
+)
+
+const (
+	// Registry and repository used when fetching blobs from nodes.
+	blobRegistry   = "example.com"
+	blobRepository = "simulation"
+	// readyTimeout is the max duration to wait for routers to bootstrap.
+	readyTimeout = 30 * time.Second
+)
+
+type ClusterConfig struct {
+	P2PRouterOpts []routing.P2PRouterOption
+	RegistryOpts  []registry.RegistryOption
+}
+
+type ClusterOption = option.Option[ClusterConfig]
+
+// WithP2PRouterOptions sets options used when creating the router of each node.
+// Membership and libp2p options are not supported as they are used by the cluster.
+func WithP2PRouterOptions(opts ...routing.P2PRouterOption) ClusterOption {
+	return func(cfg *ClusterConfig) error {
+		cfg.P2PRouterOpts = opts
+		return nil
+	}
+}
+
+// WithRegistryOptions sets options used when creating the registry of each node.
+func WithRegistryOptions(opts ...registry.RegistryOption) ClusterOption {
+	return func(cfg *ClusterConfig) error {
+		cfg.RegistryOpts = opts
+		return nil
+	}
+}
+
+// Cluster is a set of in-process nodes that communicate over loopback.
+// Each node is given its own loopback IP so that all registries can share the same port,
+// which also allows the cluster to identify the source of connections when partitioned.
+type Cluster struct {
+	ctx          context.Context
+	groups       map[int]int
+	nodes        []*Node
+	cfg          ClusterConfig
+	mx           sync.RWMutex
+	registryPort uint16
+}
+
+// NewCluster starts a cluster of the given size and waits for all nodes to be ready.
+// The cluster is stopped when the test completes.
+func NewCluster(t *testing.T, size int, opts ...ClusterOption) *Cluster {
+	t.Helper()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("simulation requires the full loopback range which is only available on Linux")
+	}
+	require.GreaterOrEqual(t, size, 2, "cluster requires at least two nodes to bootstrap")
+	require.Less(t, size, 250, "cluster size is limited by the loopback range")
+
+	cfg := ClusterConfig{}
+	err := option.Apply(&cfg, opts...)
+	require.NoError(t, err)
+
+	c := &Cluster{
+		ctx: t.Context(),
+		cfg: cfg,
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(nodeIP(0).String(), "0"))
+	require.NoError(t, err)
+	c.registryPort = netip.MustParseAddrPort(ln.Addr().String()).Port()
+	err = ln.Close()
+	require.NoError(t, err)
+
+	for i := range size {
+		ociClient, err := oci.NewClient(oci.WithLocalAddr(nodeIP(i)))
+		require.NoError(t, err)
+		c.nodes = append(c.nodes, &Node{
+			cluster:   c,
+			index:     i,
+			ip:        nodeIP(i),
+			store:     oci.NewMemory(),
+			ociClient: ociClient,
+		})
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			err := n.Stop()
+			require.NoError(t, err)
+		}
+	})
+	for _, n := range c.nodes {
+		err := n.Start()
+		require.NoError(t, err)
+	}
+	c.WaitReady(t)
+	return c
+}
+
+// nodeIP returns the loopback IP of the node. The first address is skipped as it is used by clients outside of the cluster.
+func nodeIP(index int) netip.Addr {
+	return netip.AddrFrom4([4]byte{127, 0, 0, byte(index + 2)})
+}
+
+// Nodes returns all nodes in the cluster, including stopped nodes.
+func (c *Cluster) Nodes() []*Node {
+	return slices.Clone(c.nodes)
+}
+
+// Node returns the node with the given index.
+func (c *Cluster) Node(index int) *Node {
+	return c.nodes[index]
+}
+
+// WaitReady waits for all running nodes to have completed bootstrapping.
+func (c *Cluster) WaitReady(t *testing.T) {
+	t.Helper()
+
+	require.EventuallyWithT(t, func(ct *assert.CollectT) {
+		for _, n := range c.nodes {
+			router := n.Router()
+			if router == nil {
+				continue
+			}
+			ready, err := router.Ready(c.ctx)
+			require.NoError(ct, err)
+			require.True(ct, ready, "node %d is not ready", n.index)
+		}
+	}, readyTimeout, 100*time.Millisecond)
+}
+
+// Partition splits the cluster into groups of node indexes which are unable to reach each other.
+// Nodes that are not part of any group are placed together in a separate group.
+// Existing connections between nodes in different groups are closed.
+func (c *Cluster) Partition(groups ...[]int) {
+	c.mx.Lock()
+	c.groups = map[int]int{}
+	for i, group := range groups {
+		for _, index := range group {
+			c.groups[index] = i + 1
+		}
+	}
+	c.mx.Unlock()
+
+	for _, n := range c.nodes {
+		router := n.Router()
+		if router == nil {
+			continue
+		}
+		for _, conn := range router.Host().Network().Conns() {
+			if c.reachablePeer(n, conn.RemotePeer()) {
+				continue
+			}
+			//nolint: errcheck // Ignore error as the connection is being dropped.
+			conn.Close()
+		}
+	}
+}
+
+// Heal removes any partition so that all nodes are able to reach each other.
+func (c *Cluster) Heal() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.groups = nil
+}
+
+func (c *Cluster) reachable(from, to *Node) bool {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+
+	if c.groups == nil {
+		return true
+	}
+	return c.groups[from.index] == c.groups[to.index]
+}
+
+func (c *Cluster) reachablePeer(from *Node, id peer.ID) bool {
+	for _, n := range c.nodes {
+		router := n.Router()
+		if router == nil || router.Host().ID() != id {
+			continue
+		}
+		return c.reachable(from, n)
+	}
+	return true
+}
+
+func (c *Cluster) reachableAddr(to *Node, addr netip.Addr) bool {
+	for _, n := range c.nodes {
+		if n.ip != addr {
+			continue
+		}
+		return c.reachable(n, to)
+	}
+	return true
+}
+
+// Node is a single Spegel instance with a router, registry, and in memory store.
+// The store is kept when the node is restarted while the router is given a new identity.
+type Node struct {
+	cluster   *Cluster
+	store     *oci.Memory
+	ociClient *oci.Client
+	router    *routing.P2PRouter
+	cancel    context.CancelFunc
+	done      chan error
+	ip        netip.Addr
+	index     int
+	latency   atomic.Int64
+	failing   atomic.Bool
+	// lifecycleMx serializes starting and stopping while mx guards the running state.
+	lifecycleMx sync.Mutex
+	mx          sync.RWMutex
+}
+
+// Start creates a new router and registry for the node and runs them in the background.
+func (n *Node) Start() error {
+	n.lifecycleMx.Lock()
+	defer n.lifecycleMx.Unlock()
+
+	if n.Router() != nil {
+		return errors.New("node is already running")
+	}
+
+	ctx, cancel := context.WithCancel(logr.NewContext(context.WithoutCancel(n.cluster.ctx), logr.Discard()))
+	routerOpts := append(slices.Clone(n.cluster.cfg.P2PRouterOpts),
+		routing.WithAllowLoopback(true),
+		routing.WithLibP2POptions(libp2p.ConnectionGater(&connectionGater{node: n})),
+	)
+	router, err := routing.NewP2PRouter(ctx, netip.AddrPortFrom(n.ip, 0).String(), &bootstrapper{cluster: n.cluster}, strconv.FormatUint(uint64(n.cluster.registryPort), 10), routerOpts...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	registryOpts := append(slices.Clone(n.cluster.cfg.RegistryOpts), registry.WithOCIClient(n.ociClient), registry.WithPeerDialer(router.DialPeer))
+	reg, err := registry.NewRegistry(n.store, router, registryOpts...)
+	if err != nil {
+		cancel()
+		return errors.Join(err, router.Host().Close())
+	}
+	ln, err := net.Listen("tcp", n.Addr().String())
+	if err != nil {
+		cancel()
+		return errors.Join(err, router.Host().Close())
+	}
+	streamLn, err := router.Listen()
+	if err != nil {
+		cancel()
+		return errors.Join(err, ln.Close(), router.Host().Close())
+	}
+	srv := &http.Server{
+		Handler: n.faultHandler(reg.Handler(logr.Discard())),
+	}
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return router.Run(gCtx)
+	})
+	g.Go(func() error {
+		err := state.Track(gCtx, n.store, router)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		return err
+	})
+	for _, l := range []net.Listener{ln, streamLn} {
+		g.Go(func() error {
+			err := srv.Serve(l)
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		})
+	}
+	g.Go(func() error {
+		<-gCtx.Done()
+		return srv.Close()
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Wait()
+	}()
+
+	n.mx.Lock()
+	n.router = router
+	n.cancel = cancel
+	n.done = done
+	n.mx.Unlock()
+	return nil
+}
+
+// Stop stops the node without withdrawing its advertisements, similar to a node crashing.
+func (n *Node) Stop() error {
+	n.lifecycleMx.Lock()
+	defer n.lifecycleMx.Unlock()
+
+	n.mx.Lock()
+	cancel, done := n.cancel, n.done
+	n.router = nil
+	n.cancel = nil
+	n.done = nil
+	n.mx.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	return <-done
+}
+
+// Router returns the router of the node, or nil if the node is stopped.
+func (n *Node) Router() *routing.P2PRouter {
+	n.mx.RLock()
+	defer n.mx.RUnlock()
+
+	return n.router
+}
+
+// Addr returns the address of the node registry.
+func (n *Node) Addr() netip.AddrPort {
+	return netip.AddrPortFrom(n.ip, n.cluster.registryPort)
+}
+
+// SetLatency delays all requests served by the node registry.
+func (n *Node) SetLatency(latency time.Duration) {
+	n.latency.Store(int64(latency))
+}
+
+// SetFailing makes the node registry respond with an error to all requests.
+func (n *Node) SetFailing(failing bool) {
+	n.failing.Store(failing)
+}
+
+// AddBlob writes the blob to the node store and advertises it if the node is running.
+func (n *Node) AddBlob(ctx context.Context, b []byte) (digest.Digest, error) {
+	desc := ocispec.Descriptor{
+		MediaType: httpx.ContentTypeBinary,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	err := n.store.Write(desc, b)
+	if err != nil {
+		return "", err
+	}
+	router := n.Router()
+	if router == nil {
+		return desc.Digest, nil
+	}
+	metadata := routing.Metadata{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}
+	err = router.AdvertiseMetadata(ctx, map[string]routing.Metadata{desc.Digest.String(): metadata})
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+// Fetch requests the blob from the node registry, mirroring it from other nodes if not present locally.
+func (n *Node) Fetch(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	rc, _, err := n.ociClient.Get(ctx, blobDistributionPath(dgst), oci.WithFetchMirror(n.mirror()))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Head requests the blob descriptor from the node registry.
+func (n *Node) Head(ctx context.Context, dgst digest.Digest) (ocispec.Descriptor, error) {
+	return n.ociClient.Head(ctx, blobDistributionPath(dgst), oci.WithFetchMirror(n.mirror()))
+}
+
+func (n *Node) mirror() *url.URL {
+	return &url.URL{
+		Scheme: "http",
+		Host:   n.Addr().String(),
+	}
+}
+
+func blobDistributionPath(dgst digest.Digest) oci.DistributionPath {
+	return oci.DistributionPath{
+		Reference: oci.Reference{
+			Registry:   blobRegistry,
+			Repository: blobRepository,
+			Digest:     dgst,
+		},
+		Kind: oci.DistributionKindBlob,
+	}
+}
+
+// faultHandler injects partitions, latency, and failures before serving requests.
+func (n *Node) faultHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		remoteAddr, err := netip.ParseAddrPort(req.RemoteAddr)
+		if err == nil && !n.cluster.reachableAddr(n, remoteAddr.Addr()) {
+			// Drop the connection to simulate the node being unreachable.
+			hijacker, ok := rw.(http.Hijacker)
+			if !ok {
+				http.Error(rw, "node is partitioned", http.StatusServiceUnavailable)
+				return
+			}
+			conn, _, err := hijacker.Hijack()
+			if err != nil {
+				return
+			}
+			//nolint: errcheck // Ignore error as the connection is being dropped.
+			conn.Close()
+			return
+		}
+		latency := time.Duration(n.latency.Load())
+		if latency > 0 {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(latency):
+			}
+		}
+		if n.failing.Load() {
+			http.Error(rw, fmt.Sprintf("node %d is failing", n.index), http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+var _ routing.Bootstrapper = &bootstrapper{}
+
+// bootstrapper returns all running nodes in the cluster as bootstrap peers.
+type bootstrapper struct {
+	cluster *Cluster
+}
+
+func (b *bootstrapper) Run(ctx context.Context, addrInfo peer.AddrInfo) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (b *bootstrapper) Get(ctx context.Context) ([]peer.AddrInfo, error) {
+	addrInfos := []peer.AddrInfo{}
+	for _, n := range b.cluster.nodes {
+		router := n.Router()
+		if router == nil {
+			continue
+		}
+		addrInfos = append(addrInfos, *host.InfoFromHost(router.Host()))
+	}
+	return addrInfos, nil
+}
+
+// connectionGater blocks libp2p connections between nodes that are partitioned.
+type connectionGater struct {
+	node *Node
+}
+
+func (g *connectionGater) InterceptPeerDial(p peer.ID) bool {
+	return g.node.cluster.reachablePeer(g.node, p)
+}
+
+func (g *connectionGater) InterceptAddrDial(p peer.ID, _ ma.Multiaddr) bool {
+	return g.node.cluster.reachablePeer(g.node, p)
+}
+
+func (g *connectionGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	ip, err := manet.ToIP(addrs.RemoteMultiaddr())
+	if err != nil {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return true
+	}
+	return g.node.cluster.reachableAddr(g.node, addr.Unmap())
+}
+
+func (g *connectionGater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return g.node.cluster.reachablePeer(g.node, p)
+}
+
+func (g *connectionGater) InterceptUpgraded(_ network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,171 @@
+package simulation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/pkg/routing"
+)
+
+func TestClusterPropagation(t *testing.T) {
+	t.Parallel()
+
+	c := NewCluster(t, 5)
+
+	dgst, err := c.Node(0).AddBlob(t.Context(), []byte("propagation"))
+	require.NoError(t, err)
+	for _, n := range c.Nodes()[1:] {
+		require.EventuallyWithT(t, func(ct *assert.CollectT) {
+			b, err := n.Fetch(t.Context(), dgst)
+			require.NoError(ct, err)
+			require.Equal(ct, []byte("propagation"), b)
+		}, 10*time.Second, 100*time.Millisecond)
+	}
+}
+
+func TestClusterStreamTransport(t *testing.T) {
+	t.Parallel()
+
+	c := NewCluster(t, 3, WithP2PRouterOptions(routing.WithStreamTransport(true)))
+
+	dgst, err := c.Node(0).AddBlob(t.Context(), []byte("stream"))
+	require.NoError(t, err)
+	for _, n := range c.Nodes()[1:] {
+		require.EventuallyWithT(t, func(ct *assert.CollectT) {
+			b, err := n.Fetch(t.Context(), dgst)
+			require.NoError(ct, err)
+			require.Equal(ct, []byte("stream"), b)
+		}, 10*time.Second, 100*time.Millisecond)
+	}
+}
+
+func TestClusterMetadata(t *testing.T) {
+	t.Parallel()
+
+	c := NewCluster(t, 2)
+
+	content := []byte("metadata")
+	dgst, err := c.Node(0).AddBlob(t.Context(), content)
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(ct *assert.CollectT) {
+		b, err := c.Node(1).Fetch(t.Context(), dgst)
+		require.NoError(ct, err)
+		require.Equal(ct, content, b)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Head requests should be answered with the advertised metadata even when the peer fails requests.
+	c.Node(0).SetFailing(true)
+	desc, err := c.Node(1).Head(t.Context(), dgst)
+	require.NoError(t, err)
+	require.Equal(t, dgst, desc.Digest)
+	require.Equal(t, int64(len(content)), desc.Size)
+	_, err = c.Node(1).Fetch(t.Context(), dgst)
+	require.Error(t, err)
+}
+
+func TestClusterChurn(t *testing.T) {
+	t.Parallel()
+
+	c := NewCluster(t, 4, WithP2PRouterOptions(routing.WithNegativeCacheTTL(0)))
+
+	content := []byte("churn")
+	dgst, err := c.Node(0).AddBlob(t.Context(), content)
+	require.NoError(t, err)
+	_, err = c.Node(1).AddBlob(t.Context(), content)
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(ct *assert.CollectT) {
+		b, err := c.Node(3).Fetch(t.Context(), dgst)
+		require.NoError(ct, err)
+		require.Equal(ct, content, b)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Stale advertisements from a stopped node should be retried with the next peer.
+	err = c.Node(0).Stop()
+	require.NoError(t, err)
+	for range 5 {
+		b, err := c.Node(3).Fetch(t.Context(), dgst)
+		require.NoError(t, err)
+		require.Equal(t, content, b)
+	}
+
+	// Restarted node should rejoin with its store intact.
+	err = c.Node(1).Stop()
+	require.NoError(t, err)
+	err = c.Node(0).Start()
+	require.NoError(t, err)
+	c.WaitReady(t)
+	require.EventuallyWithT(t, func(ct *assert.CollectT) {
+		b, err := c.Node(2).Fetch(t.Context(), dgst)
+		require.NoError(ct, err)
+		require.Equal(ct, content, b)
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestClusterPartition(t *testing.T) {
+	t.Parallel()
+
+	c := NewCluster(t, 4, WithP2PRouterOptions(routing.WithNegativeCacheTTL(0)))
+
+	content := []byte("partition")
+	dgst, err := c.Node(0).AddBlob(t.Context(), content)
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(ct *assert.CollectT) {
+		b, err := c.Node(3).Fetch(t.Context(), dgst)
+		require.NoError(ct, err)
+		require.Equal(ct, content, b)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Nodes on the other side of the partition should not be able to fetch the content.
+	c.Partition([]int{0, 1}, []int{2, 3})
+	b, err := c.Node(1).Fetch(t.Context(), dgst)
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	_, err = c.Node(3).Fetch(t.Context(), dgst)
+	require.Error(t, err)
+
+	c.Heal()
+	require.EventuallyWithT(t, func(ct *assert.CollectT) {
+		b, err := c.Node(3).Fetch(t.Context(), dgst)
+		require.NoError(ct, err)
+		require.Equal(ct, content, b)
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestClusterFaults(t *testing.T) {
+	t.Parallel()
+
+	c := NewCluster(t, 3)
+
+	content := []byte("faults")
+	dgst, err := c.Node(0).AddBlob(t.Context(), content)
+	require.NoError(t, err)
+	_, err = c.Node(1).AddBlob(t.Context(), content)
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(ct *assert.CollectT) {
+		b, err := c.Node(2).Fetch(t.Context(), dgst)
+		require.NoError(ct, err)
+		require.Equal(ct, content, b)
+	}, 10*time.Second, 100*time.Millisecond)
+
+	// Requests to a failing node should be retried with the next peer.
+	c.Node(0).SetFailing(true)
+	for range 5 {
+		b, err := c.Node(2).Fetch(t.Context(), dgst)
+		require.NoError(t, err)
+		require.Equal(t, content, b)
+	}
+	_, err = c.Node(0).Fetch(t.Context(), dgst)
+	require.Error(t, err)
+	c.Node(0).SetFailing(false)
+
+	// Latency should be applied to requests served by the node.
+	c.Node(0).SetLatency(200 * time.Millisecond)
+	start := time.Now()
+	b, err := c.Node(0).Fetch(t.Context(), dgst)
+	require.NoError(t, err)
+	require.Equal(t, content, b)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
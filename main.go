@@ -4,20 +4,29 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/containerd/platforms"
 	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/sync/errgroup"
 
@@ -51,15 +60,34 @@ type RegistryCmd struct {
 	MetricsAddr           string           `arg:"--metrics-addr,env:METRICS_ADDR" default:":9090" help:"address to serve metrics."`
 	ContainerdSock        string           `arg:"--containerd-sock,env:CONTAINERD_SOCK" default:"/run/containerd/containerd.sock" help:"Endpoint of containerd service."`
 	ContainerdNamespace   string           `arg:"--containerd-namespace,env:CONTAINERD_NAMESPACE" default:"k8s.io" help:"Containerd namespace to fetch images from."`
+	ContainerdNamespaces  []string         `arg:"--containerd-additional-namespaces,env:CONTAINERD_ADDITIONAL_NAMESPACES" help:"Containerd namespaces to fetch images from in addition to the containerd namespace, use * to fetch images from all namespaces."`
 	ContainerdContentPath string           `arg:"--containerd-content-path,env:CONTAINERD_CONTENT_PATH" default:"/var/lib/containerd/io.containerd.content.v1.content" help:"Path to Containerd content store"`
+	StoreKind             string           `arg:"--store-kind,env:STORE_KIND" default:"containerd" help:"Kind of store to serve images from, either containerd or oci-layout."`
+	AdditionalStoreKinds  []string         `arg:"--additional-store-kinds,env:ADDITIONAL_STORE_KINDS" help:"Kinds of stores to serve images from in addition to the store kind, queried in the given order after it."`
+	OCILayoutPath         string           `arg:"--oci-layout-path,env:OCI_LAYOUT_PATH" help:"Path to the OCI image layout directory used when store kind is oci-layout."`
+	OCILayoutRepository   string           `arg:"--oci-layout-repository,env:OCI_LAYOUT_REPOSITORY" help:"Registry and repository of images in the OCI image layout whose ref name is only a tag, for example docker.io/library/alpine."`
 	DataDir               string           `arg:"--data-dir,env:DATA_DIR" default:"/var/lib/spegel" help:"Directory where Spegel persists data."`
 	RouterAddr            string           `arg:"--router-addr,env:ROUTER_ADDR" default:":5001" help:"address to serve router."`
+	RouterNamespace       string           `arg:"--router-namespace,env:ROUTER_NAMESPACE" help:"Namespace used to isolate the router from other Spegel instances sharing the same network. Not supported by the tracker router."`
+	RouterAddressFamily   string           `arg:"--router-address-family,env:ROUTER_ADDRESS_FAMILY" help:"Address family preferred for peer addresses, either ipv4 or ipv6. When empty both are used with IPv6 preferred."`
+	RouterPreferredCIDRs  []netip.Prefix   `arg:"--router-preferred-cidrs,env:ROUTER_PREFERRED_CIDRS" help:"Networks preferred for peer addresses, useful on nodes with multiple networks."`
+	RouterPreferredIfaces []string         `arg:"--router-preferred-interfaces,env:ROUTER_PREFERRED_INTERFACES" help:"Interfaces whose networks are preferred for peer addresses, useful on nodes with multiple networks."`
+	RouterKind            string           `arg:"--router-kind,env:ROUTER_KIND" default:"p2p" help:"Kind of router to use, either p2p, gossip, or tracker. Gossip is meant for small clusters."`
+	TrackerURL            string           `arg:"--tracker-url,env:TRACKER_URL" help:"URL of the tracker used when router kind is tracker."`
+	NodeName              string           `arg:"--node-name,env:NODE_NAME" help:"Name of the node, used as a stable ID with the tracker. A random ID is used when empty."`
 	RegistryAddr          string           `arg:"--registry-addr,env:REGISTRY_ADDR" default:":5000" help:"address to server image registry."`
 	MirroredRegistries    []string         `arg:"--mirrored-registries,env:MIRRORED_REGISTRIES" help:"Registries that are configured to be mirrored, if slice is empty all registries are mirrored."`
 	RegistryFilters       []*regexp.Regexp `arg:"--registry-filters,env:REGISTRY_FILTERS" help:"Regular expressions to filter out tags/registries, if slice is empty all registries/tags are resolved."`
 	MirrorResolveTimeout  time.Duration    `arg:"--mirror-resolve-timeout,env:MIRROR_RESOLVE_TIMEOUT" default:"20ms" help:"Max duration spent finding a mirror."`
 	MirrorResolveRetries  int              `arg:"--mirror-resolve-retries,env:MIRROR_RESOLVE_RETRIES" default:"3" help:"Max amount of mirrors to attempt."`
+	DrainDuration         time.Duration    `arg:"--drain-duration,env:DRAIN_DURATION" default:"5s" help:"Duration to keep serving requests after withdrawing advertisements on shutdown."`
+	ReconcileInterval     time.Duration    `arg:"--reconcile-interval,env:RECONCILE_INTERVAL" default:"5m" help:"Interval at which advertised content is reconciled with the store, zero disables reconciliation."`
+	LoadThresholdUploads  int64            `arg:"--load-threshold-uploads,env:LOAD_THRESHOLD_UPLOADS" default:"20" help:"Amount of active uploads at which peers are deprioritized, zero disables the threshold."`
+	LoadThresholdBytes    int64            `arg:"--load-threshold-bytes,env:LOAD_THRESHOLD_BYTES" help:"Upload bytes per second at which peers are deprioritized, zero disables the threshold."`
 	DebugWebEnabled       bool             `arg:"--debug-web-enabled,env:DEBUG_WEB_ENABLED" default:"true" help:"When true enables debug web page."`
+	Relay                 bool             `arg:"--relay,env:RELAY" default:"false" help:"When true enables circuit relay and hole punching so that peers behind NAT are reachable. Only supported by the p2p router."`
+	StreamTransport       bool             `arg:"--stream-transport,env:STREAM_TRANSPORT" default:"false" help:"When true peers are mirrored over router streams instead of the registry port. Only supported by the p2p router."`
+	PlatformAware         bool             `arg:"--platform-aware,env:PLATFORM_AWARE" default:"false" help:"When true only content for the platform of the node is advertised and peers with the same architecture are preferred. Peers are only preferred by the p2p router."`
 }
 
 type CleanupCmd struct {
@@ -73,11 +101,18 @@ type CleanupWaitCmd struct {
 	Period        time.Duration `arg:"--period,env:PERIOD" default:"2s" help:"address to run readiness probe on."`
 }
 
+type TrackerCmd struct {
+	Addr          string        `arg:"--addr,env:ADDR" default:":5002" help:"address to serve tracker."`
+	MetricsAddr   string        `arg:"--metrics-addr,env:METRICS_ADDR" default:":9090" help:"address to serve metrics."`
+	LeaseDuration time.Duration `arg:"--lease-duration,env:LEASE_DURATION" default:"30s" help:"Duration a node is kept without a heartbeat."`
+}
+
 type Arguments struct {
 	Configuration *ConfigurationCmd `arg:"subcommand:configuration"`
 	Registry      *RegistryCmd      `arg:"subcommand:registry"`
 	Cleanup       *CleanupCmd       `arg:"subcommand:cleanup"`
 	CleanupWait   *CleanupWaitCmd   `arg:"subcommand:cleanup-wait"`
+	Tracker       *TrackerCmd       `arg:"subcommand:tracker"`
 	LogLevel      slog.Level        `arg:"--log-level,env:LOG_LEVEL" default:"INFO" help:"Minimum log level to output. Value should be DEBUG, INFO, WARN, or ERROR."`
 }
 
@@ -113,6 +148,8 @@ func run(ctx context.Context, args *Arguments) error {
 		return cleanupCommand(ctx, args.Cleanup)
 	case args.CleanupWait != nil:
 		return cleanupWaitCommand(ctx, args.CleanupWait)
+	case args.Tracker != nil:
+		return trackerCommand(ctx, args.Tracker)
 	default:
 		return errors.New("unknown subcommand")
 	}
@@ -132,6 +169,10 @@ func configurationCommand(ctx context.Context, args *ConfigurationCmd) error {
 
 func registryCommand(ctx context.Context, args *RegistryCmd) error {
 	log := logr.FromContextOrDiscard(ctx)
+	// Shutdown is delayed until advertisements have been withdrawn and the node has been drained.
+	signalCtx := ctx
+	ctx, shutdown := context.WithCancel(context.WithoutCancel(ctx))
+	defer shutdown()
 	g, ctx := errgroup.WithContext(ctx)
 
 	username, password, err := loadBasicAuth()
@@ -156,25 +197,56 @@ func registryCommand(ctx context.Context, args *RegistryCmd) error {
 	}
 
 	// OCI Store
-	ociStore, err := oci.NewContainerd(ctx, args.ContainerdSock, args.ContainerdNamespace, oci.WithContentPath(args.ContainerdContentPath))
+	ociStore, err := getStore(ctx, args)
 	if err != nil {
 		return err
 	}
-	defer ociStore.Close()
+	if closer, ok := ociStore.(io.Closer); ok {
+		defer closer.Close()
+	}
 
 	// Router
 	_, registryPort, err := net.SplitHostPort(args.RegistryAddr)
 	if err != nil {
 		return err
 	}
-	bootstrapper, err := getBootstrapper(args.BootstrapConfig)
+	libp2pOpts := []libp2p.Option{}
+	psk, err := loadPrivateNetworkKey()
 	if err != nil {
 		return err
 	}
+	if psk != nil {
+		log.Info("running in private network mode")
+		libp2pOpts = append(libp2pOpts, libp2p.PrivateNetwork(psk))
+	}
+	loadTracker := routing.NewLoadTracker()
 	routerOpts := []routing.P2PRouterOption{
 		routing.WithDataDir(args.DataDir),
+		routing.WithLibP2POptions(libp2pOpts...),
+		routing.WithNamespace(args.RouterNamespace),
+		routing.WithLoadTracker(loadTracker),
+		routing.WithLoadThreshold(routing.Load{ActiveUploads: args.LoadThresholdUploads, BytesPerSecond: args.LoadThresholdBytes}),
+		routing.WithAddressFamily(args.RouterAddressFamily),
+		routing.WithPreferredCIDRs(args.RouterPreferredCIDRs...),
+		routing.WithPreferredInterfaces(args.RouterPreferredIfaces...),
+		routing.WithRelay(args.Relay),
+		routing.WithStreamTransport(args.StreamTransport),
 	}
-	router, err := routing.NewP2PRouter(ctx, args.RouterAddr, bootstrapper, registryPort, routerOpts...)
+	if args.PlatformAware {
+		routerOpts = append(routerOpts, routing.WithArchitecture(platforms.DefaultSpec().Architecture))
+	}
+	membership, err := loadMembership()
+	if err != nil {
+		return err
+	}
+	if membership != nil {
+		if args.RouterKind == "tracker" {
+			return errors.New("membership is not supported by the tracker router")
+		}
+		log.Info("restricting router to cluster members")
+		routerOpts = append(routerOpts, routing.WithMembership(membership))
+	}
+	router, err := getRouter(ctx, args, registryPort, routerOpts)
 	if err != nil {
 		return err
 	}
@@ -187,20 +259,63 @@ func registryCommand(ctx context.Context, args *RegistryCmd) error {
 	})
 
 	// State tracking
+	trackCtx, trackCancel := context.WithCancel(ctx)
+	defer trackCancel()
+	trackDone := make(chan any)
+	trackOpts := []state.TrackerOption{
+		state.WithRegistryFilters(filters),
+		state.WithReconcileInterval(args.ReconcileInterval),
+	}
+	if args.PlatformAware {
+		trackOpts = append(trackOpts, state.WithPlatforms(platforms.DefaultSpec()))
+	}
 	g.Go(func() error {
-		err := state.Track(ctx, ociStore, router, state.WithRegistryFilters(filters))
+		defer close(trackDone)
+		err := state.Track(trackCtx, ociStore, router, trackOpts...)
 		if err != nil && !errors.Is(err, context.Canceled) {
 			return err
 		}
 		return nil
 	})
 
+	// Drain
+	g.Go(func() error {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-signalCtx.Done():
+		}
+		log.Info("draining Spegel", "duration", args.DrainDuration)
+		trackCancel()
+		<-trackDone
+		withdrawCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		err := router.WithdrawAll(withdrawCtx)
+		if err != nil {
+			log.Error(err, "could not withdraw advertisements")
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(args.DrainDuration):
+		}
+		shutdown()
+		return nil
+	})
+
 	// Registry
 	registryOpts := []registry.RegistryOption{
 		registry.WithRegistryFilters(filters),
 		registry.WithResolveTimeout(args.MirrorResolveTimeout),
 		registry.WithBasicAuth(username, password),
 		registry.WithOCIClient(ociClient),
+		registry.WithLoadTracker(loadTracker),
+	}
+	p2pRouter, isP2PRouter := router.(*routing.P2PRouter)
+	if isP2PRouter {
+		registryOpts = append(registryOpts, registry.WithPeerDialer(p2pRouter.DialPeer))
+	}
+	if args.PlatformAware {
+		registryOpts = append(registryOpts, registry.WithPreferredArchitecture(platforms.DefaultSpec().Architecture))
 	}
 	reg, err := registry.NewRegistry(ociStore, router, registryOpts...)
 	if err != nil {
@@ -216,6 +331,19 @@ func registryCommand(ctx context.Context, args *RegistryCmd) error {
 		}
 		return nil
 	})
+	if isP2PRouter && (args.Relay || args.StreamTransport) {
+		// Serve the registry over router streams for peers that can not connect directly or use stream transport.
+		streamLn, err := p2pRouter.Listen()
+		if err != nil {
+			return err
+		}
+		g.Go(func() error {
+			if err := regSrv.Serve(streamLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
 	g.Go(func() error {
 		<-ctx.Done()
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -293,6 +421,71 @@ func cleanupWaitCommand(ctx context.Context, args *CleanupWaitCmd) error {
 	return nil
 }
 
+func trackerCommand(ctx context.Context, args *TrackerCmd) error {
+	log := logr.FromContextOrDiscard(ctx)
+	g, ctx := errgroup.WithContext(ctx)
+
+	token, err := loadTrackerToken()
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		log.Info("running tracker without authentication")
+	}
+	tracker, err := routing.NewTracker(routing.WithLeaseDuration(args.LeaseDuration), routing.WithAuthToken(token))
+	if err != nil {
+		return err
+	}
+	g.Go(func() error {
+		return tracker.Run(ctx)
+	})
+
+	trackerSrv := &http.Server{
+		Addr:    args.Addr,
+		Handler: tracker.Handler(log),
+	}
+	g.Go(func() error {
+		if err := trackerSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	g.Go(func() error {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return trackerSrv.Shutdown(shutdownCtx)
+	})
+
+	// Metrics
+	metrics.Register()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.DefaultGatherer, promhttp.HandlerOpts{}))
+	metricsSrv := &http.Server{
+		Addr:    args.MetricsAddr,
+		Handler: mux,
+	}
+	g.Go(func() error {
+		if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+	g.Go(func() error {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return metricsSrv.Shutdown(shutdownCtx)
+	})
+
+	log.Info("running tracker", "addr", args.Addr)
+	err = g.Wait()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func getBootstrapper(cfg BootstrapConfig) (routing.Bootstrapper, error) { //nolint: ireturn // Return type can be different structs.
 	switch cfg.BootstrapKind {
 	case "dns":
@@ -306,6 +499,84 @@ func getBootstrapper(cfg BootstrapConfig) (routing.Bootstrapper, error) { //noli
 	}
 }
 
+func getStore(ctx context.Context, args *RegistryCmd) (oci.Store, error) { //nolint: ireturn // Return type can be different structs.
+	if len(args.AdditionalStoreKinds) == 0 {
+		return getStoreKind(ctx, args, args.StoreKind)
+	}
+
+	// Additional stores are combined with the primary store, which is queried first.
+	kinds := append([]string{args.StoreKind}, args.AdditionalStoreKinds...)
+	for i, kind := range kinds {
+		if slices.Contains(kinds[:i], kind) {
+			return nil, fmt.Errorf("store kind %s is configured more than once", kind)
+		}
+	}
+	stores := []oci.Store{}
+	for _, kind := range kinds {
+		store, err := getStoreKind(ctx, args, kind)
+		if err != nil {
+			// Stores that were already created have to be closed as the union will not be returned.
+			for _, store := range stores {
+				if closer, ok := store.(io.Closer); ok {
+					//nolint: errcheck // Ignore error as creating the stores already failed.
+					closer.Close()
+				}
+			}
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	return oci.NewUnion(stores...)
+}
+
+func getStoreKind(ctx context.Context, args *RegistryCmd, kind string) (oci.Store, error) { //nolint: ireturn // Return type can be different structs.
+	switch kind {
+	case "containerd":
+		return oci.NewContainerd(ctx, args.ContainerdSock, args.ContainerdNamespace, oci.WithContentPath(args.ContainerdContentPath), oci.WithNamespaces(args.ContainerdNamespaces...))
+	case "oci-layout":
+		return oci.NewLayout(args.OCILayoutPath, oci.WithLayoutRepository(args.OCILayoutRepository))
+	default:
+		return nil, fmt.Errorf("unknown store kind %s", kind)
+	}
+}
+
+type runnableRouter interface {
+	web.Router
+	Run(ctx context.Context) error
+	WithdrawAll(ctx context.Context) error
+}
+
+func getRouter(ctx context.Context, args *RegistryCmd, registryPort string, opts []routing.P2PRouterOption) (runnableRouter, error) { //nolint: ireturn // Return type can be different structs.
+	if args.RouterKind == "tracker" {
+		if args.RouterNamespace != "" {
+			return nil, errors.New("router namespace is not supported by the tracker router")
+		}
+		token, err := loadTrackerToken()
+		if err != nil {
+			return nil, err
+		}
+		trackerOpts := []routing.TrackerRouterOption{
+			routing.WithTrackerAuthToken(token),
+		}
+		if args.NodeName != "" {
+			trackerOpts = append(trackerOpts, routing.WithNodeID(args.NodeName))
+		}
+		return routing.NewTrackerRouter(args.TrackerURL, registryPort, trackerOpts...)
+	}
+	bootstrapper, err := getBootstrapper(args.BootstrapConfig)
+	if err != nil {
+		return nil, err
+	}
+	switch args.RouterKind {
+	case "p2p":
+		return routing.NewP2PRouter(ctx, args.RouterAddr, bootstrapper, registryPort, opts...)
+	case "gossip":
+		return routing.NewGossipRouter(ctx, args.RouterAddr, bootstrapper, registryPort, routing.WithHostOptions(opts...))
+	default:
+		return nil, fmt.Errorf("unknown router kind %s", args.RouterKind)
+	}
+}
+
 func loadBasicAuth() (string, string, error) {
 	dirPath := "/etc/secrets/basic-auth"
 	username, err := os.ReadFile(filepath.Join(dirPath, "username"))
@@ -318,3 +589,66 @@ func loadBasicAuth() (string, string, error) {
 	}
 	return string(username), string(password), nil
 }
+
+func loadPrivateNetworkKey() (pnet.PSK, error) {
+	keyPath := "/etc/secrets/private-network/swarm.key"
+	f, err := os.Open(keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	psk, err := pnet.DecodeV1PSK(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode private network key: %w", err)
+	}
+	return psk, nil
+}
+
+func loadTrackerToken() (string, error) {
+	tokenPath := "/etc/secrets/tracker/token"
+	b, err := os.ReadFile(tokenPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func loadMembership() (*routing.Membership, error) {
+	peersPath := "/etc/secrets/membership/peers"
+	clusterKeyPath := "/etc/secrets/membership/cluster.key"
+
+	peers := []peer.ID{}
+	f, err := os.Open(peersPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	peersFound := err == nil
+	if peersFound {
+		defer f.Close()
+		peers, err = routing.ParsePeerIDs(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse membership peers: %w", err)
+		}
+	}
+	var clusterKey crypto.PrivKey
+	b, err := os.ReadFile(clusterKeyPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		clusterKey, err = routing.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse membership cluster key: %w", err)
+		}
+	}
+	if !peersFound && clusterKey == nil {
+		return nil, nil
+	}
+	return routing.NewMembership(peers, clusterKey), nil
+}
@@ -41,6 +41,22 @@ var (
 		Name: "spegel_advertised_content_digests",
 		Help: "Number of content digests advertised to be available.",
 	}, []string{"registry"})
+	RouterRejectedPeersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spegel_router_rejected_peers_total",
+		Help: "Total number of peers rejected for not being members.",
+	}, []string{"reason"})
+	RouterNegativeCacheTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spegel_router_negative_cache_total",
+		Help: "Total number of lookups checked against the negative cache.",
+	}, []string{"result"})
+	StoreRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spegel_store_requests_total",
+		Help: "Total number of requests served by each store backend.",
+	}, []string{"store", "operation"})
+	ReconcileDriftTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "spegel_reconcile_drift_total",
+		Help: "Total number of advertised keys corrected by reconciliation, either missing or stale.",
+	}, []string{"drift"})
 )
 
 func Register() {
@@ -50,5 +66,9 @@ func Register() {
 	DefaultRegisterer.MustRegister(AdvertisedImageTags)
 	DefaultRegisterer.MustRegister(AdvertisedImageDigests)
 	DefaultRegisterer.MustRegister(AdvertisedContentDigests)
+	DefaultRegisterer.MustRegister(RouterRejectedPeersTotal)
+	DefaultRegisterer.MustRegister(RouterNegativeCacheTotal)
+	DefaultRegisterer.MustRegister(StoreRequestsTotal)
+	DefaultRegisterer.MustRegister(ReconcileDriftTotal)
 	httpx.RegisterMetrics(DefaultRegisterer)
 }
@@ -8,7 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"path"
 	"strconv"
@@ -32,6 +34,8 @@ const (
 
 type ClientConfig struct {
 	TLSClientConfig *tls.Config
+	DialContext     func(ctx context.Context, network, addr string) (net.Conn, error)
+	LocalAddr       netip.Addr
 }
 
 type ClientOption = option.Option[ClientConfig]
@@ -46,6 +50,22 @@ func WithTLS(rootCAs *x509.CertPool, certificates []tls.Certificate) ClientOptio
 	}
 }
 
+// WithLocalAddr sets the local address that requests are sent from.
+func WithLocalAddr(addr netip.Addr) ClientOption {
+	return func(cfg *ClientConfig) error {
+		cfg.LocalAddr = addr
+		return nil
+	}
+}
+
+// WithDialContext sets the function used to dial connections, overriding the local address.
+func WithDialContext(dialContext func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(cfg *ClientConfig) error {
+		cfg.DialContext = dialContext
+		return nil
+	}
+}
+
 type Client struct {
 	httpClient *http.Client
 	tokenCache sync.Map
@@ -63,6 +83,16 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 	}
 	transport := httpx.BaseTransport()
 	transport.TLSClientConfig = cfg.TLSClientConfig
+	if cfg.LocalAddr.IsValid() {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			LocalAddr: net.TCPAddrFromAddrPort(netip.AddrPortFrom(cfg.LocalAddr, 0)),
+		}).DialContext
+	}
+	if cfg.DialContext != nil {
+		transport.DialContext = cfg.DialContext
+	}
 	transport.MaxIdleConns = 100
 	transport.MaxConnsPerHost = 100
 	transport.MaxIdleConnsPerHost = 100
@@ -5,6 +5,7 @@ import (
 	"crypto/x509"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -31,12 +32,15 @@ func TestClient(t *testing.T) {
 
 		opts := []ClientOption{
 			WithTLS(certPool, certificates),
+			WithLocalAddr(netip.MustParseAddr("127.0.0.2")),
 		}
 		cfg := ClientConfig{}
 		err := option.Apply(&cfg, opts...)
 		require.NoError(t, err)
 		require.Equal(t, certPool, cfg.TLSClientConfig.RootCAs)
 		require.Equal(t, certificates, cfg.TLSClientConfig.Certificates)
+		require.Equal(t, netip.MustParseAddr("127.0.0.2"), cfg.LocalAddr)
+		require.Nil(t, cfg.DialContext)
 	})
 
 	img, err := ParseImage("docker.io/test/image:latest", AllowTagOnly())
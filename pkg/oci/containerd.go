@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"maps"
 	"net/url"
 	"os"
 	"path"
@@ -23,7 +24,9 @@ import (
 	"github.com/containerd/containerd/v2/core/content"
 	"github.com/containerd/containerd/v2/core/events"
 	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/containerd/v2/pkg/identifiers"
 	"github.com/containerd/containerd/v2/pkg/labels"
+	"github.com/containerd/containerd/v2/pkg/namespaces"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/typeurl/v2"
 	"github.com/go-logr/logr"
@@ -40,10 +43,13 @@ import (
 const (
 	backupDir       = "_backup"
 	listImageFilter = `name~="^.+/"`
+	// AllNamespaces reads images from all containerd namespaces when given as a namespace.
+	AllNamespaces = "*"
 )
 
 type ContainerdConfig struct {
 	ContentPath string
+	Namespaces  []string
 }
 
 type ContainerdOption = option.Option[ContainerdConfig]
@@ -55,12 +61,22 @@ func WithContentPath(path string) ContainerdOption {
 	}
 }
 
+// WithNamespaces sets namespaces to read images from in addition to the default namespace.
+// Namespaces are queried in order after the default namespace when resolving tags.
+func WithNamespaces(namespaces ...string) ContainerdOption {
+	return func(c *ContainerdConfig) error {
+		c.Namespaces = append(c.Namespaces, namespaces...)
+		return nil
+	}
+}
+
 var _ Store = &Containerd{}
 
 type Containerd struct {
 	client       *client.Client
 	mediaTypeIdx *lru.Cache[digest.Digest, string]
 	contentPath  string
+	namespaces   []string
 }
 
 func NewContainerd(ctx context.Context, sock, namespace string, opts ...ContainerdOption) (*Containerd, error) {
@@ -70,7 +86,26 @@ func NewContainerd(ctx context.Context, sock, namespace string, opts ...Containe
 		return nil, err
 	}
 
-	client, err := client.New(sock, client.WithDefaultNamespace(namespace))
+	nss := []string{}
+	for _, ns := range append([]string{namespace}, cfg.Namespaces...) {
+		if slices.Contains(nss, ns) {
+			continue
+		}
+		if ns != AllNamespaces {
+			err := identifiers.Validate(ns)
+			if err != nil {
+				return nil, err
+			}
+		}
+		nss = append(nss, ns)
+	}
+	// The default namespace is used for requests that are not specific to a namespace.
+	defaultNamespace := namespace
+	if defaultNamespace == AllNamespaces {
+		defaultNamespace = namespaces.Default
+	}
+
+	client, err := client.New(sock, client.WithDefaultNamespace(defaultNamespace))
 	if err != nil {
 		return nil, err
 	}
@@ -82,6 +117,7 @@ func NewContainerd(ctx context.Context, sock, namespace string, opts ...Containe
 		client:       client,
 		mediaTypeIdx: mediaTypeIdx,
 		contentPath:  cfg.ContentPath,
+		namespaces:   nss,
 	}
 	return c, nil
 }
@@ -99,21 +135,31 @@ func (c *Containerd) Name() string {
 }
 
 func (c *Containerd) ListImages(ctx context.Context) ([]Image, error) {
-	cImgs, err := c.client.ImageService().List(ctx, listImageFilter)
+	nss, err := c.listNamespaces(ctx)
 	if err != nil {
 		return nil, err
 	}
 	tagDgsts := map[digest.Digest]string{}
 	imgs := []Image{}
-	for _, cImg := range cImgs {
-		img, err := ParseImage(cImg.Name, WithDigest(cImg.Target.Digest))
+	for _, ns := range nss {
+		cImgs, err := c.client.ImageService().List(namespaces.WithNamespace(ctx, ns), listImageFilter)
 		if err != nil {
 			return nil, err
 		}
-		if img.Tag != "" {
-			tagDgsts[img.Digest] = img.Tag
+		for _, cImg := range cImgs {
+			img, err := ParseImage(cImg.Name, WithDigest(cImg.Target.Digest))
+			if err != nil {
+				return nil, err
+			}
+			// Images pulled into multiple namespaces are only listed once.
+			if slices.Contains(imgs, img) {
+				continue
+			}
+			if img.Tag != "" {
+				tagDgsts[img.Digest] = img.Tag
+			}
+			imgs = append(imgs, img)
 		}
-		imgs = append(imgs, img)
 	}
 	// Remove duplicate digest images that already have tags.
 	imgs = slices.DeleteFunc(imgs, func(img Image) bool {
@@ -129,32 +175,62 @@ func (c *Containerd) ListImages(ctx context.Context) ([]Image, error) {
 }
 
 func (c *Containerd) ListContent(ctx context.Context) ([][]Reference, error) {
-	contents := [][]Reference{}
-	err := c.client.ContentStore().Walk(ctx, func(i content.Info) error {
-		refs, err := contentLabelsToReferences(i.Labels, i.Digest)
+	nss, err := c.listNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Content shared between namespaces is merged so that it is only listed once.
+	nsContents := [][][]Reference{}
+	for _, ns := range nss {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		idx, err := c.index(nsCtx)
 		if err != nil {
-			logr.FromContextOrDiscard(ctx).Error(err, "skipping content that cant be converted to reference")
+			return nil, err
+		}
+		contents := [][]Reference{}
+		err = c.client.ContentStore().Walk(nsCtx, func(i content.Info) error {
+			// Content referenced by images is referenced by the images so that filters can match the image tags.
+			refs := idx.references(i.Digest)
+			if len(refs) > 0 {
+				contents = append(contents, refs)
+				return nil
+			}
+			refs, err := contentLabelsToReferences(i.Labels, i.Digest)
+			if err != nil {
+				logr.FromContextOrDiscard(ctx).Error(err, "skipping content that cant be converted to reference")
+				return nil
+			}
+			contents = append(contents, refs)
 			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
-		contents = append(contents, refs)
-		return nil
-	})
-	if err != nil {
-		return nil, err
+		nsContents = append(nsContents, contents)
 	}
-	return contents, nil
+	return mergeContents(nsContents...), nil
 }
 
 func (c *Containerd) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
-	cImg, err := c.client.ImageService().Get(ctx, ref)
+	nss, err := c.listNamespaces(ctx)
 	if err != nil {
 		return "", err
 	}
-	return cImg.Target.Digest, nil
+	for _, ns := range nss {
+		cImg, err := c.client.ImageService().Get(namespaces.WithNamespace(ctx, ns), ref)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return cImg.Target.Digest, nil
+	}
+	return "", errors.Join(ErrNotFound, fmt.Errorf("could not resolve tag %s to a digest", ref))
 }
 
 func (c *Containerd) Descriptor(ctx context.Context, dgst digest.Digest) (ocispec.Descriptor, error) {
-	info, err := c.client.ContentStore().Info(ctx, dgst)
+	info, _, err := c.info(ctx, dgst)
 	if errors.Is(err, errdefs.ErrNotFound) {
 		return ocispec.Descriptor{}, errors.Join(ErrNotFound, err)
 	}
@@ -205,7 +281,14 @@ func (c *Containerd) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekC
 		}
 		return file, nil
 	}
-	ra, err := c.client.ContentStore().ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+	_, ns, err := c.info(ctx, dgst)
+	if errors.Is(err, errdefs.ErrNotFound) {
+		return nil, errors.Join(ErrNotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ra, err := c.client.ContentStore().ReaderAt(namespaces.WithNamespace(ctx, ns), ocispec.Descriptor{Digest: dgst})
 	if errors.Is(err, errdefs.ErrNotFound) {
 		return nil, errors.Join(ErrNotFound, err)
 	}
@@ -221,84 +304,215 @@ func (c *Containerd) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekC
 	}, nil
 }
 
-func (c *Containerd) Subscribe(ctx context.Context) (<-chan OCIEvent, error) {
-	log := logr.FromContextOrDiscard(ctx)
+// containerdSubscription is a subscription to containerd events together with the content index of each namespace.
+type containerdSubscription struct {
+	envelopeCh <-chan *events.Envelope
+	errCh      <-chan error
+	indexes    map[string]*containerdIndex
+	cancel     context.CancelFunc
+}
 
-	eventCh := make(chan OCIEvent)
-	subCtx, subCancel := context.WithCancel(ctx)
-	eventFilters := []string{`topic~="/images/create|/images/delete",event.name~="^.+/"`, `topic~="/content/create"`}
-	envelopeCh, cErrCh := c.client.EventService().Subscribe(subCtx, eventFilters...)
+// containerdIndex relates the content in a namespace to the images referencing the content.
+type containerdIndex struct {
+	// contents are the digests of the content referenced by each image target.
+	contents map[digest.Digest][]digest.Digest
+	// images are the images referencing each image target.
+	images map[digest.Digest][]Image
+}
 
-	// Populate the content index.
-	contentIdx := map[digest.Digest][]Reference{}
-	cImgs, err := c.client.ImageService().List(ctx, listImageFilter)
-	if err != nil {
-		subCancel()
-		return nil, err
+func newContainerdIndex() *containerdIndex {
+	return &containerdIndex{
+		contents: map[digest.Digest][]digest.Digest{},
+		images:   map[digest.Digest][]Image{},
 	}
-	for _, cImg := range cImgs {
-		img, err := ParseImage(cImg.Name, WithDigest(cImg.Target.Digest))
-		if err != nil {
-			log.Error(err, "skipping image that cannot be parsed", "image", img.String())
+}
+
+// addImage adds the image together with the digests of the content referenced by the image target.
+func (idx *containerdIndex) addImage(img Image, dgsts []digest.Digest) {
+	idx.contents[img.Digest] = dgsts
+	if slices.Contains(idx.images[img.Digest], img) {
+		return
+	}
+	idx.images[img.Digest] = append(idx.images[img.Digest], img)
+}
+
+// removeImage removes the image, images without a digest are matched by tag. The content digests of the image target
+// are returned when no other image references the target, false is returned when the image is not in the index.
+func (idx *containerdIndex) removeImage(img Image) ([]digest.Digest, bool) {
+	for _, target := range slices.Sorted(maps.Keys(idx.images)) {
+		if img.Digest != "" && img.Digest != target {
 			continue
 		}
-		refs := []Reference{}
-		handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
-			children, err := images.ChildrenHandler(c.client.ContentStore()).Handle(ctx, desc)
-			if errors.Is(err, errdefs.ErrNotFound) {
-				return nil, nil
-			}
-			if err != nil {
-				return nil, err
+		imgs := idx.images[target]
+		i := slices.IndexFunc(imgs, func(existing Image) bool {
+			return existing.Registry == img.Registry && existing.Repository == img.Repository && existing.Tag == img.Tag
+		})
+		if i == -1 {
+			continue
+		}
+		imgs = slices.Delete(imgs, i, i+1)
+		if len(imgs) > 0 {
+			idx.images[target] = imgs
+			return nil, true
+		}
+		dgsts := idx.contents[target]
+		delete(idx.images, target)
+		delete(idx.contents, target)
+		return dgsts, true
+	}
+	return nil, false
+}
+
+// references returns the references of the images referencing the content. Images referenced by digest are
+// ignored when the same target is tagged, as they are created together with the tagged image.
+func (idx *containerdIndex) references(dgst digest.Digest) []Reference {
+	refs := []Reference{}
+	for _, target := range slices.Sorted(maps.Keys(idx.contents)) {
+		if !slices.Contains(idx.contents[target], dgst) {
+			continue
+		}
+		imgs := idx.images[target]
+		tagged := slices.ContainsFunc(imgs, func(img Image) bool {
+			return img.Tag != ""
+		})
+		for _, img := range imgs {
+			if tagged && img.Tag == "" {
+				continue
 			}
 			ref := Reference{
 				Registry:   img.Registry,
 				Repository: img.Repository,
-				Digest:     desc.Digest,
+				Tag:        img.Tag,
+				Digest:     dgst,
+			}
+			if slices.Contains(refs, ref) {
+				continue
 			}
 			refs = append(refs, ref)
-			return children, nil
-		})
-		err = images.Walk(ctx, handler, cImg.Target)
-		if err != nil {
-			log.Error(err, "skipping image that cannot be walked", "image", img.String())
-			continue
 		}
-		contentIdx[cImg.Target.Digest] = refs
 	}
+	return refs
+}
+
+// Subscribe returns events from containerd. The subscription is recreated with backoff when it fails, for example when
+// containerd is restarted, after which a reconcile event is sent as events may have been missed.
+func (c *Containerd) Subscribe(ctx context.Context) (<-chan OCIEvent, error) {
+	log := logr.FromContextOrDiscard(ctx)
 
+	sub, err := c.subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+	eventCh := make(chan OCIEvent)
 	go func() {
 		defer close(eventCh)
 		for {
-			select {
-			case <-subCtx.Done():
+			err := c.handleSubscription(ctx, sub, eventCh)
+			sub.cancel()
+			if ctx.Err() != nil {
 				return
-			case envelope := <-envelopeCh:
-				events, err := c.handleEvent(subCtx, *envelope, contentIdx)
-				if err != nil {
-					log.Error(err, "error when handling containerd event")
-					continue
-				}
-				for _, event := range events {
-					eventCh <- event
-				}
 			}
-		}
-	}()
-	go func() {
-		// Required so that the event channel closes in case containerd is restarted.
-		defer subCancel()
-		for err := range cErrCh {
-			if errors.Is(err, context.Canceled) {
+			log.Error(err, "containerd event subscription failed, resubscribing")
+			retryOpts := []retry.Option{
+				retry.Context(ctx),
+				retry.Attempts(0),
+				retry.Delay(time.Second),
+				retry.MaxDelay(30 * time.Second),
+				retry.DelayType(retry.BackOffDelay),
+				retry.LastErrorOnly(true),
+				retry.OnRetry(func(n uint, err error) {
+					log.Error(err, "could not resubscribe to containerd events", "attempt", n+1)
+				}),
+			}
+			sub, err = retry.DoWithData(func() (*containerdSubscription, error) {
+				return c.subscribe(ctx)
+			}, retryOpts...)
+			if err != nil {
+				return
+			}
+			log.Info("resubscribed to containerd events")
+			select {
+			case <-ctx.Done():
+				sub.cancel()
 				return
+			case eventCh <- OCIEvent{Type: ReconcileEvent}:
 			}
-			log.Error(err, "received containerd event error")
 		}
 	}()
 	return eventCh, nil
 }
 
-func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope, contentIdx map[digest.Digest][]Reference) ([]OCIEvent, error) {
+// subscribe subscribes to containerd events and populates the content index of each namespace.
+func (c *Containerd) subscribe(ctx context.Context) (*containerdSubscription, error) {
+	subCtx, subCancel := context.WithCancel(ctx)
+	eventFilters := []string{`topic~="/images/create|/images/delete",event.name~="^.+/"`, `topic~="/content/create"`}
+	envelopeCh, cErrCh := c.client.EventService().Subscribe(subCtx, eventFilters...)
+
+	// Populate the content index of each namespace.
+	indexes := map[string]*containerdIndex{}
+	nss, err := c.listNamespaces(ctx)
+	if err != nil {
+		subCancel()
+		return nil, err
+	}
+	for _, ns := range nss {
+		idx, err := c.index(namespaces.WithNamespace(ctx, ns))
+		if err != nil {
+			subCancel()
+			return nil, err
+		}
+		indexes[ns] = idx
+	}
+
+	sub := &containerdSubscription{
+		envelopeCh: envelopeCh,
+		errCh:      cErrCh,
+		indexes:    indexes,
+		cancel:     subCancel,
+	}
+	return sub, nil
+}
+
+// handleSubscription sends the events of the subscription until the subscription fails or the context is cancelled.
+func (c *Containerd) handleSubscription(ctx context.Context, sub *containerdSubscription, eventCh chan<- OCIEvent) error {
+	log := logr.FromContextOrDiscard(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err, ok := <-sub.errCh:
+			// The error channel is closed after an error has been received.
+			if !ok {
+				return errors.New("containerd event subscription closed")
+			}
+			return err
+		case envelope := <-sub.envelopeCh:
+			// Events are received for all namespaces.
+			if !c.includesNamespace(envelope.Namespace) {
+				continue
+			}
+			if _, ok := sub.indexes[envelope.Namespace]; !ok {
+				sub.indexes[envelope.Namespace] = newContainerdIndex()
+			}
+			nsCtx := namespaces.WithNamespace(ctx, envelope.Namespace)
+			events, err := c.handleEvent(nsCtx, *envelope, sub.indexes[envelope.Namespace])
+			if err != nil {
+				log.Error(err, "error when handling containerd event", "namespace", envelope.Namespace)
+				continue
+			}
+			for _, event := range events {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case eventCh <- event:
+				}
+			}
+		}
+	}
+}
+
+func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope, idx *containerdIndex) ([]OCIEvent, error) {
 	if envelope.Event == nil {
 		return nil, errors.New("envelope event cannot be nil")
 	}
@@ -328,6 +542,14 @@ func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope,
 		if err != nil {
 			return nil, err
 		}
+		// Content already present in another namespace has already been advertised.
+		ok, err := c.existsInOtherNamespace(ctx, Reference{Digest: dgst})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return nil, nil
+		}
 		events := []OCIEvent{}
 		for _, ref := range refs {
 			events = append(events, OCIEvent{Type: CreateEvent, Reference: ref})
@@ -338,54 +560,65 @@ func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope,
 		if err != nil {
 			return nil, err
 		}
-		// Just advertise the image if it is a tag reference.
-		if img.Digest == "" {
-			return []OCIEvent{{Type: CreateEvent, Reference: img.Reference}}, nil
-		}
 		// Walk the image to index its content.
-		cImg, err := c.client.ImageService().Get(ctx, img.String())
+		cImg, err := c.client.ImageService().Get(ctx, e.GetName())
 		if err != nil {
 			return nil, err
 		}
-		refs := []Reference{}
-		handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
-			children, err := images.ChildrenHandler(c.client.ContentStore()).Handle(ctx, desc)
-			if errors.Is(err, errdefs.ErrNotFound) {
-				return nil, nil
-			}
-			if err != nil {
-				return nil, err
-			}
-			ref := Reference{
-				Registry:   img.Registry,
-				Repository: img.Repository,
-				Digest:     desc.Digest,
-			}
-			refs = append(refs, ref)
-			return children, nil
-		})
-		err = images.Walk(ctx, handler, cImg.Target)
+		dgsts, err := c.walkImage(ctx, cImg.Target)
 		if err != nil {
 			return nil, err
 		}
-		contentIdx[img.Digest] = refs
-		return nil, nil
+		tagRef := img.Reference
+		img.Digest = cImg.Target.Digest
+		idx.addImage(img, dgsts)
+		if tagRef.Digest != "" {
+			return nil, nil
+		}
+		// Tags already present in another namespace have already been advertised.
+		ok, err := c.existsInOtherNamespace(ctx, tagRef)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return nil, nil
+		}
+		// Content created during the pull is re-evaluated by the tracker when the tag is created,
+		// as content events do not know the tags of the images referencing the content.
+		return []OCIEvent{{Type: CreateEvent, Reference: tagRef}}, nil
 	case *eventtypes.ImageDelete:
 		img, err := ParseImage(e.GetName(), AllowTagOnly())
 		if err != nil {
 			return nil, err
 		}
+		dgsts, ok := idx.removeImage(img)
 		// Just advertise the image if it is a tag reference.
 		if img.Digest == "" {
+			ok, err := c.existsInOtherNamespace(ctx, img.Reference)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return nil, nil
+			}
 			return []OCIEvent{{Type: DeleteEvent, Reference: img.Reference}}, nil
 		}
 		// Advertise deletion of images content if it no longer exists.
-		refs, ok := contentIdx[img.Digest]
 		if !ok {
 			logr.FromContextOrDiscard(ctx).Info("delete event with missing content index entry")
+			ok, err := c.existsInOtherNamespace(ctx, img.Reference)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return nil, nil
+			}
 			return []OCIEvent{{Type: DeleteEvent, Reference: img.Reference}}, nil
 		}
-		delete(contentIdx, img.Digest)
+		// Content is kept while another image references the same target.
+		if len(dgsts) == 0 {
+			return nil, nil
+		}
 		// Delete events are sent before garbage collection is run.
 		retryOpts := []retry.Option{
 			retry.Context(ctx),
@@ -407,7 +640,12 @@ func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope,
 		}
 		// Create delete events for contents that has been removed.
 		events := []OCIEvent{}
-		for _, ref := range refs {
+		for _, dgst := range dgsts {
+			ref := Reference{
+				Registry:   img.Registry,
+				Repository: img.Repository,
+				Digest:     dgst,
+			}
 			_, err := c.client.ContentStore().Info(ctx, ref.Digest)
 			if err == nil {
 				continue
@@ -415,6 +653,13 @@ func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope,
 			if !errors.Is(err, errdefs.ErrNotFound) {
 				return nil, err
 			}
+			ok, err := c.existsInOtherNamespace(ctx, ref)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				continue
+			}
 			events = append(events, OCIEvent{Type: DeleteEvent, Reference: ref})
 		}
 		return events, nil
@@ -423,6 +668,123 @@ func (c *Containerd) handleEvent(ctx context.Context, envelope events.Envelope,
 	}
 }
 
+// index walks the images in the namespace of the context to index the content they reference.
+func (c *Containerd) index(ctx context.Context) (*containerdIndex, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	idx := newContainerdIndex()
+	cImgs, err := c.client.ImageService().List(ctx, listImageFilter)
+	if err != nil {
+		return nil, err
+	}
+	for _, cImg := range cImgs {
+		img, err := ParseImage(cImg.Name, WithDigest(cImg.Target.Digest))
+		if err != nil {
+			log.Error(err, "skipping image that cannot be parsed", "image", cImg.Name)
+			continue
+		}
+		dgsts, err := c.walkImage(ctx, cImg.Target)
+		if err != nil {
+			log.Error(err, "skipping image that cannot be walked", "image", img.String())
+			continue
+		}
+		idx.addImage(img, dgsts)
+	}
+	return idx, nil
+}
+
+// walkImage returns the digests of the content referenced by the image target, including the target itself.
+func (c *Containerd) walkImage(ctx context.Context, target ocispec.Descriptor) ([]digest.Digest, error) {
+	dgsts := []digest.Digest{}
+	handler := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		children, err := images.ChildrenHandler(c.client.ContentStore()).Handle(ctx, desc)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		dgsts = append(dgsts, desc.Digest)
+		return children, nil
+	})
+	err := images.Walk(ctx, handler, target)
+	if err != nil {
+		return nil, err
+	}
+	return dgsts, nil
+}
+
+// listNamespaces returns the namespaces images are read from, in the order they are queried.
+func (c *Containerd) listNamespaces(ctx context.Context) ([]string, error) {
+	if !slices.Contains(c.namespaces, AllNamespaces) {
+		return c.namespaces, nil
+	}
+	allNss, err := c.client.NamespaceService().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Explicitly configured namespaces are queried before the remaining namespaces.
+	nss := []string{}
+	for _, ns := range append(slices.Clone(c.namespaces), allNss...) {
+		if ns == AllNamespaces || slices.Contains(nss, ns) {
+			continue
+		}
+		nss = append(nss, ns)
+	}
+	return nss, nil
+}
+
+func (c *Containerd) includesNamespace(ns string) bool {
+	return slices.Contains(c.namespaces, AllNamespaces) || slices.Contains(c.namespaces, ns)
+}
+
+// info returns the content info from the first namespace containing the digest together with the namespace.
+func (c *Containerd) info(ctx context.Context, dgst digest.Digest) (content.Info, string, error) {
+	nss, err := c.listNamespaces(ctx)
+	if err != nil {
+		return content.Info{}, "", err
+	}
+	for _, ns := range nss {
+		info, err := c.client.ContentStore().Info(namespaces.WithNamespace(ctx, ns), dgst)
+		if errors.Is(err, errdefs.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return content.Info{}, "", err
+		}
+		return info, ns, nil
+	}
+	return content.Info{}, "", fmt.Errorf("content digest %s: %w", dgst, errdefs.ErrNotFound)
+}
+
+// existsInOtherNamespace checks if the tag or content is present in a namespace other than the namespace of the context.
+func (c *Containerd) existsInOtherNamespace(ctx context.Context, ref Reference) (bool, error) {
+	current, _ := namespaces.Namespace(ctx)
+	nss, err := c.listNamespaces(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, ns := range nss {
+		if ns == current {
+			continue
+		}
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		if ref.Digest == "" {
+			_, err = c.client.ImageService().Get(nsCtx, ref.Identifier())
+		} else {
+			_, err = c.client.ContentStore().Info(nsCtx, ref.Digest)
+		}
+		if errors.Is(err, errdefs.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
 func contentLabelsToReferences(l map[string]string, dgst digest.Digest) ([]Reference, error) {
 	refs := []Reference{}
 	for k, v := range l {
@@ -560,3 +560,75 @@ func TestCleanupMirrorConfiguration(t *testing.T) {
 		require.Equal(t, "data.txt", files[0].Name())
 	}
 }
+
+func TestContainerdNamespaces(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewContainerd(t.Context(), filepath.Join(t.TempDir(), "containerd.sock"), "k8s.io", WithNamespaces("invalid/namespace"))
+	require.Error(t, err)
+
+	store, err := NewContainerd(t.Context(), filepath.Join(t.TempDir(), "containerd.sock"), "k8s.io", WithNamespaces("default", "k8s.io", "buildkit"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		store.Close()
+	})
+	nss, err := store.listNamespaces(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []string{"k8s.io", "default", "buildkit"}, nss)
+	require.True(t, store.includesNamespace("buildkit"))
+	require.False(t, store.includesNamespace("moby"))
+
+	store, err = NewContainerd(t.Context(), filepath.Join(t.TempDir(), "containerd.sock"), "k8s.io", WithNamespaces(AllNamespaces))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		store.Close()
+	})
+	require.True(t, store.includesNamespace("moby"))
+}
+
+func TestContainerdIndex(t *testing.T) {
+	t.Parallel()
+
+	target := digest.FromString("manifest")
+	layer := digest.FromString("layer")
+	otherTarget := digest.FromString("other")
+	tagImg, err := ParseImage("docker.io/library/alpine:latest", WithDigest(target))
+	require.NoError(t, err)
+	dgstImg, err := ParseImage("docker.io/library/alpine@" + target.String())
+	require.NoError(t, err)
+	otherImg, err := ParseImage("ghcr.io/spegel-org/spegel:v1", WithDigest(otherTarget))
+	require.NoError(t, err)
+
+	idx := newContainerdIndex()
+	require.Empty(t, idx.references(layer))
+
+	// Images referenced by digest are ignored when the target is tagged.
+	idx.addImage(dgstImg, []digest.Digest{target, layer})
+	require.Equal(t, []Reference{{Registry: "docker.io", Repository: "library/alpine", Digest: layer}}, idx.references(layer))
+	idx.addImage(tagImg, []digest.Digest{target, layer})
+	require.Equal(t, []Reference{{Registry: "docker.io", Repository: "library/alpine", Tag: "latest", Digest: layer}}, idx.references(layer))
+
+	// Content shared between images is referenced by all images.
+	idx.addImage(otherImg, []digest.Digest{otherTarget, layer})
+	expected := []Reference{
+		{Registry: "docker.io", Repository: "library/alpine", Tag: "latest", Digest: layer},
+		{Registry: "ghcr.io", Repository: "spegel-org/spegel", Tag: "v1", Digest: layer},
+	}
+	require.ElementsMatch(t, expected, idx.references(layer))
+	require.Equal(t, []Reference{{Registry: "ghcr.io", Repository: "spegel-org/spegel", Tag: "v1", Digest: otherTarget}}, idx.references(otherTarget))
+
+	// Tags are removed without a digest, content is returned once no image references the target.
+	dgsts, ok := idx.removeImage(Image{Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "latest"}})
+	require.True(t, ok)
+	require.Empty(t, dgsts)
+	require.ElementsMatch(t, []Reference{
+		{Registry: "docker.io", Repository: "library/alpine", Digest: layer},
+		{Registry: "ghcr.io", Repository: "spegel-org/spegel", Tag: "v1", Digest: layer},
+	}, idx.references(layer))
+	dgsts, ok = idx.removeImage(dgstImg)
+	require.True(t, ok)
+	require.Equal(t, []digest.Digest{target, layer}, dgsts)
+	require.Empty(t, idx.references(target))
+	_, ok = idx.removeImage(dgstImg)
+	require.False(t, ok)
+}
@@ -0,0 +1,334 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// contentIndex is the state of a store that is read from an index file on disk.
+type contentIndex struct {
+	tags     map[string]Image
+	descs    map[digest.Digest]ocispec.Descriptor
+	contents map[digest.Digest][]Reference
+	// paths are the files of content when they cannot be derived from the digest.
+	paths  map[digest.Digest]string
+	images []Image
+	// versions are the states of the index file and dependencies the index was read from.
+	versions []fileVersion
+}
+
+func newContentIndex() *contentIndex {
+	return &contentIndex{
+		images:   []Image{},
+		tags:     map[string]Image{},
+		descs:    map[digest.Digest]ocispec.Descriptor{},
+		contents: map[digest.Digest][]Reference{},
+		paths:    map[digest.Digest]string{},
+	}
+}
+
+// addImage adds the image to the index. Images without a tag are dropped when the same digest is tagged.
+func (c *contentIndex) addImage(img Image) {
+	tagName, ok := img.TagName()
+	if ok {
+		c.tags[tagName] = img
+		c.images = slices.DeleteFunc(c.images, func(existing Image) bool {
+			return existing.Tag == "" && existing.Digest == img.Digest
+		})
+		c.images = append(c.images, img)
+		return
+	}
+	for _, existing := range c.images {
+		if existing == img || (existing.Tag != "" && existing.Digest == img.Digest) {
+			return
+		}
+	}
+	c.images = append(c.images, img)
+}
+
+// addContent adds the descriptor as content of the image.
+func (c *contentIndex) addContent(img Image, desc ocispec.Descriptor) {
+	ref := Reference{
+		Registry:   img.Registry,
+		Repository: img.Repository,
+		Digest:     desc.Digest,
+	}
+	if !slices.Contains(c.contents[desc.Digest], ref) {
+		c.contents[desc.Digest] = append(c.contents[desc.Digest], ref)
+	}
+	c.descs[desc.Digest] = ocispec.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}
+}
+
+func (c *contentIndex) listContent() [][]Reference {
+	contents := [][]Reference{}
+	for _, dgst := range slices.Sorted(maps.Keys(c.contents)) {
+		contents = append(contents, slices.Clone(c.contents[dgst]))
+	}
+	return contents
+}
+
+func (c *contentIndex) resolve(ref string) (digest.Digest, error) {
+	img, ok := c.tags[ref]
+	if !ok {
+		return "", errors.Join(ErrNotFound, fmt.Errorf("could not resolve tag %s to a digest", ref))
+	}
+	return img.Digest, nil
+}
+
+// indexReadDelay is how long changes are collected before the index is read again, as writing many blobs
+// would otherwise read the index for every blob.
+const indexReadDelay = 100 * time.Millisecond
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statVersion(path string) (fileVersion, bool, error) {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fileVersion{}, false, nil
+	}
+	if err != nil {
+		return fileVersion{}, false, err
+	}
+	return fileVersion{modTime: fi.ModTime(), size: fi.Size()}, true, nil
+}
+
+// indexFile caches the content index read from a file until the file or one of its dependencies changes.
+// Dependencies are directories whose content is part of the index, along with the directories directly within them,
+// which change when files are added or removed.
+type indexFile struct {
+	idx  *contentIndex
+	read func(ctx context.Context) (*contentIndex, error)
+	path string
+	deps []string
+	mx   sync.Mutex
+}
+
+func newIndexFile(path string, read func(ctx context.Context) (*contentIndex, error), deps ...string) *indexFile {
+	cleanDeps := []string{}
+	for _, dep := range deps {
+		cleanDeps = append(cleanDeps, filepath.Clean(dep))
+	}
+	return &indexFile{
+		path: filepath.Clean(path),
+		read: read,
+		deps: cleanDeps,
+	}
+}
+
+// get returns the content index, which is only read again when the file or a dependency has changed.
+// A missing file is treated as an empty index so that content can be added later.
+func (f *indexFile) get(ctx context.Context) (*contentIndex, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+
+	dirs, err := f.depDirs()
+	if err != nil {
+		return nil, err
+	}
+	versions := []fileVersion{}
+	exists := false
+	for i, path := range append([]string{f.path}, dirs...) {
+		version, ok, err := statVersion(path)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			exists = ok
+		}
+		versions = append(versions, version)
+	}
+	if f.idx != nil && slices.EqualFunc(f.idx.versions, versions, func(a, b fileVersion) bool {
+		return a.modTime.Equal(b.modTime) && a.size == b.size
+	}) {
+		return f.idx, nil
+	}
+	idx := newContentIndex()
+	if exists {
+		var err error
+		idx, err = f.read(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	idx.versions = versions
+	f.idx = idx
+	return idx, nil
+}
+
+// depDirs returns the dependencies and the directories directly within them.
+func (f *indexFile) depDirs() ([]string, error) {
+	dirs := []string{}
+	for _, dep := range f.deps {
+		dirs = append(dirs, dep)
+		entries, err := os.ReadDir(dep)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, filepath.Join(dep, entry.Name()))
+			}
+		}
+	}
+	return dirs, nil
+}
+
+// watchDeps adds the dependency directories to the watcher and returns them.
+// Directories which do not exist yet are added on later calls.
+func (f *indexFile) watchDeps(watcher *fsnotify.Watcher) ([]string, error) {
+	dirs, err := f.depDirs()
+	if err != nil {
+		return nil, err
+	}
+	watchList := watcher.WatchList()
+	for _, dir := range dirs {
+		if slices.Contains(watchList, dir) {
+			continue
+		}
+		err := watcher.Add(dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+// subscribe watches the file for changes and emits the events for the content that changed.
+// The directory is watched as index files are commonly replaced by renaming a new file.
+func (f *indexFile) subscribe(ctx context.Context) (<-chan OCIEvent, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watcher.Add(filepath.Dir(f.path))
+	if err != nil {
+		return nil, errors.Join(err, watcher.Close())
+	}
+	_, err = f.watchDeps(watcher)
+	if err != nil {
+		return nil, errors.Join(err, watcher.Close())
+	}
+	prev, err := f.get(ctx)
+	if err != nil {
+		return nil, errors.Join(err, watcher.Close())
+	}
+
+	eventCh := make(chan OCIEvent)
+	go func() {
+		defer close(eventCh)
+		defer watcher.Close()
+		var readCh <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error(err, "received index file watch error", "path", f.path)
+			case fsEvent, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				dirs, err := f.watchDeps(watcher)
+				if err != nil {
+					log.Error(err, "could not watch index dependencies", "path", f.path)
+				}
+				if filepath.Clean(fsEvent.Name) != f.path && !slices.Contains(dirs, filepath.Dir(fsEvent.Name)) {
+					continue
+				}
+				if readCh == nil {
+					readCh = time.After(indexReadDelay)
+				}
+			case <-readCh:
+				readCh = nil
+				next, err := f.get(ctx)
+				if err != nil {
+					log.Error(err, "could not read index file", "path", f.path)
+					continue
+				}
+				for _, event := range diffContentIndex(prev, next) {
+					select {
+					case <-ctx.Done():
+						return
+					case eventCh <- event:
+					}
+				}
+				prev = next
+			}
+		}
+	}()
+	return eventCh, nil
+}
+
+// diffContentIndex returns the events required to go from the previous to the next index.
+func diffContentIndex(prev, next *contentIndex) []OCIEvent {
+	events := []OCIEvent{}
+	for _, tagName := range slices.Sorted(maps.Keys(prev.tags)) {
+		prevImg := prev.tags[tagName]
+		nextImg, ok := next.tags[tagName]
+		if ok && nextImg.Digest == prevImg.Digest {
+			continue
+		}
+		events = append(events, OCIEvent{Type: DeleteEvent, Reference: tagReference(prevImg)})
+	}
+	for _, dgst := range slices.Sorted(maps.Keys(prev.contents)) {
+		if _, ok := next.contents[dgst]; ok {
+			continue
+		}
+		for _, ref := range prev.contents[dgst] {
+			events = append(events, OCIEvent{Type: DeleteEvent, Reference: ref})
+		}
+	}
+	for _, dgst := range slices.Sorted(maps.Keys(next.contents)) {
+		if _, ok := prev.contents[dgst]; ok {
+			continue
+		}
+		for _, ref := range next.contents[dgst] {
+			events = append(events, OCIEvent{Type: CreateEvent, Reference: ref})
+		}
+	}
+	for _, tagName := range slices.Sorted(maps.Keys(next.tags)) {
+		nextImg := next.tags[tagName]
+		prevImg, ok := prev.tags[tagName]
+		if ok && nextImg.Digest == prevImg.Digest {
+			continue
+		}
+		events = append(events, OCIEvent{Type: CreateEvent, Reference: tagReference(nextImg)})
+	}
+	return events
+}
+
+// tagReference returns the tag reference of the image without the digest, matching the events of other stores.
+func tagReference(img Image) Reference {
+	return Reference{
+		Registry:   img.Registry,
+		Repository: img.Repository,
+		Tag:        img.Tag,
+	}
+}
@@ -0,0 +1,265 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/spegel-org/spegel/internal/option"
+	"github.com/spegel-org/spegel/pkg/httpx"
+)
+
+var _ Store = &Layout{}
+
+type LayoutConfig struct {
+	Repository string
+}
+
+type LayoutOption = option.Option[LayoutConfig]
+
+// WithLayoutRepository sets the registry and repository of images whose ref name is only a tag,
+// which is common for layouts written by tools like skopeo and oras.
+func WithLayoutRepository(repository string) LayoutOption {
+	return func(cfg *LayoutConfig) error {
+		if repository != "" {
+			// Repositories which already contain a tag or digest fail to parse when a tag is appended.
+			_, err := ParseImage(repository+":"+DefaultTag, AllowTagOnly())
+			if err != nil {
+				return fmt.Errorf("invalid layout repository %s: %w", repository, err)
+			}
+		}
+		cfg.Repository = repository
+		return nil
+	}
+}
+
+// Layout is a store backed by an OCI image layout directory.
+// Images are read from the index.json file and content from the blobs directory.
+// https://github.com/opencontainers/image-spec/blob/main/image-layout.md
+type Layout struct {
+	index      *indexFile
+	path       string
+	repository string
+}
+
+func NewLayout(path string, opts ...LayoutOption) (*Layout, error) {
+	cfg := LayoutConfig{}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("OCI layout path %s is not a directory", path)
+	}
+	l := &Layout{
+		path:       path,
+		repository: cfg.Repository,
+	}
+	// Blobs are watched as well as images can be referenced in the index before their blobs are written.
+	l.index = newIndexFile(filepath.Join(path, ocispec.ImageIndexFile), l.readIndex, filepath.Join(path, ocispec.ImageBlobsDir))
+	return l, nil
+}
+
+func (l *Layout) Name() string {
+	return "oci-layout"
+}
+
+func (l *Layout) ListImages(ctx context.Context) ([]Image, error) {
+	idx, err := l.index.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(idx.images), nil
+}
+
+func (l *Layout) ListContent(ctx context.Context) ([][]Reference, error) {
+	idx, err := l.index.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return idx.listContent(), nil
+}
+
+func (l *Layout) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
+	idx, err := l.index.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	return idx.resolve(ref)
+}
+
+func (l *Layout) Descriptor(ctx context.Context, dgst digest.Digest) (ocispec.Descriptor, error) {
+	idx, err := l.index.get(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc, ok := idx.descs[dgst]
+	if ok {
+		return desc, nil
+	}
+
+	// Fall back to fingerprinting blobs that are not referenced by any image.
+	rc, err := l.Open(ctx, dgst)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer rc.Close()
+	size, err := rc.Seek(0, io.SeekEnd)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	mt := httpx.ContentTypeBinary
+	if size <= ManifestMaxSize {
+		_, err := rc.Seek(0, io.SeekStart)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		mt, err = FingerprintMediaType(rc)
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+	desc = ocispec.Descriptor{
+		Size:      size,
+		Digest:    dgst,
+		MediaType: mt,
+	}
+	return desc, nil
+}
+
+func (l *Layout) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	err := dgst.Validate()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(l.blobPath(dgst))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Join(ErrNotFound, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (l *Layout) Subscribe(ctx context.Context) (<-chan OCIEvent, error) {
+	return l.index.subscribe(ctx)
+}
+
+func (l *Layout) readIndex(ctx context.Context) (*contentIndex, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	b, err := os.ReadFile(filepath.Join(l.path, ocispec.ImageIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	index := ocispec.Index{}
+	err = json.Unmarshal(b, &index)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode OCI layout index: %w", err)
+	}
+
+	idx := newContentIndex()
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[images.AnnotationImageName]
+		if name == "" {
+			name = desc.Annotations[ocispec.AnnotationRefName]
+			if l.repository != "" && tagRegex.MatchString(name) {
+				name = l.repository + ":" + name
+			}
+		}
+		img, err := ParseImage(name, WithDigest(desc.Digest))
+		if err != nil {
+			log.Error(err, "skipping image that cannot be parsed", "digest", desc.Digest.String(), "name", name)
+			continue
+		}
+		err = l.walk(desc, img, idx)
+		if err != nil {
+			log.Error(err, "skipping image that cannot be walked", "image", img.String())
+			continue
+		}
+		idx.addImage(img)
+	}
+	return idx, nil
+}
+
+// walk indexes the descriptor and all of its children that exist in the layout.
+func (l *Layout) walk(desc ocispec.Descriptor, img Image, idx *contentIndex) error {
+	err := desc.Digest.Validate()
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(l.blobPath(desc.Digest))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	desc.Size = fi.Size()
+	idx.addContent(img, desc)
+
+	children := []ocispec.Descriptor{}
+	switch {
+	case images.IsIndexType(desc.MediaType):
+		b, err := readFileLimit(l.blobPath(desc.Digest), ManifestMaxSize)
+		if err != nil {
+			return err
+		}
+		var index ocispec.Index
+		err = json.Unmarshal(b, &index)
+		if err != nil {
+			return err
+		}
+		children = index.Manifests
+	case images.IsManifestType(desc.MediaType):
+		b, err := readFileLimit(l.blobPath(desc.Digest), ManifestMaxSize)
+		if err != nil {
+			return err
+		}
+		var manifest ocispec.Manifest
+		err = json.Unmarshal(b, &manifest)
+		if err != nil {
+			return err
+		}
+		children = append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...)
+	}
+	for _, child := range children {
+		err := l.walk(child, img, idx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Layout) blobPath(dgst digest.Digest) string {
+	return filepath.Join(l.path, ocispec.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func readFileLimit(path string, limit int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	b, err := io.ReadAll(io.LimitReader(file, limit))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
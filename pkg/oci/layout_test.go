@@ -0,0 +1,244 @@
+package oci
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+
+	"github.com/spegel-org/spegel/pkg/httpx"
+)
+
+func TestLayout(t *testing.T) {
+	t.Parallel()
+
+	layoutPath := t.TempDir()
+	configDesc := writeLayoutBlob(t, layoutPath, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layerDesc := writeLayoutBlob(t, layoutPath, ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	missingDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("missing"), Size: 7}
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc, missingDesc},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifestDesc := writeLayoutBlob(t, layoutPath, ocispec.MediaTypeImageManifest, b)
+	unreferencedDesc := writeLayoutBlob(t, layoutPath, "", []byte("unreferenced"))
+
+	_, err = NewLayout(filepath.Join(layoutPath, "does-not-exist"))
+	require.Error(t, err)
+	_, err = NewLayout(filepath.Join(layoutPath, "oci-layout"))
+	require.EqualError(t, err, "OCI layout path "+filepath.Join(layoutPath, "oci-layout")+" is not a directory")
+	layout, err := NewLayout(layoutPath)
+	require.NoError(t, err)
+	require.Equal(t, "oci-layout", layout.Name())
+
+	// A layout without an index is empty.
+	imgs, err := layout.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, imgs)
+	eventCh, err := layout.Subscribe(t.Context())
+	require.NoError(t, err)
+
+	tagDesc := manifestDesc
+	tagDesc.Annotations = map[string]string{images.AnnotationImageName: "docker.io/library/alpine:3.18"}
+	refNameDesc := manifestDesc
+	refNameDesc.Annotations = map[string]string{ocispec.AnnotationRefName: "ghcr.io/spegel-org/spegel@" + manifestDesc.Digest.String()}
+	unnamedDesc := manifestDesc
+	writeLayoutIndex(t, layoutPath, tagDesc, refNameDesc, unnamedDesc)
+
+	expectedCreate := []OCIEvent{
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: configDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Digest: configDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: layerDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Digest: layerDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: manifestDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Digest: manifestDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18"}},
+	}
+	require.ElementsMatch(t, expectedCreate, receiveEvents(t, eventCh, len(expectedCreate)))
+
+	imgs, err = layout.ListImages(t.Context())
+	require.NoError(t, err)
+	// Digest images are removed when the same digest is tagged.
+	expectedImgs := []Image{
+		{Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18", Digest: manifestDesc.Digest}},
+	}
+	require.Equal(t, expectedImgs, imgs)
+	contents, err := layout.ListContent(t.Context())
+	require.NoError(t, err)
+	require.Len(t, contents, 3)
+	for _, refs := range contents {
+		require.Len(t, refs, 2)
+		require.NotEqual(t, missingDesc.Digest, refs[0].Digest)
+	}
+
+	dgst, err := layout.Resolve(t.Context(), "docker.io/library/alpine:3.18")
+	require.NoError(t, err)
+	require.Equal(t, manifestDesc.Digest, dgst)
+	_, err = layout.Resolve(t.Context(), "docker.io/library/alpine:latest")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	for _, expected := range []ocispec.Descriptor{configDesc, layerDesc, manifestDesc} {
+		desc, err := layout.Descriptor(t.Context(), expected.Digest)
+		require.NoError(t, err)
+		require.Equal(t, expected, desc)
+	}
+	desc, err := layout.Descriptor(t.Context(), unreferencedDesc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, httpx.ContentTypeBinary, desc.MediaType)
+	require.Equal(t, unreferencedDesc.Size, desc.Size)
+	_, err = layout.Descriptor(t.Context(), missingDesc.Digest)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	rc, err := layout.Open(t.Context(), layerDesc.Digest)
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "layer", string(b))
+	_, err = layout.Open(t.Context(), missingDesc.Digest)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = layout.Open(t.Context(), "sha256:../../oci-layout")
+	require.Error(t, err)
+
+	// Removing an image only deletes content no longer referenced by another image.
+	writeLayoutIndex(t, layoutPath, refNameDesc)
+	expectedDelete := []OCIEvent{
+		{Type: DeleteEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18"}},
+	}
+	require.Equal(t, expectedDelete, receiveEvents(t, eventCh, len(expectedDelete)))
+	writeLayoutIndex(t, layoutPath)
+	expectedDelete = []OCIEvent{
+		{Type: DeleteEvent, Reference: Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Digest: configDesc.Digest}},
+		{Type: DeleteEvent, Reference: Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Digest: layerDesc.Digest}},
+		{Type: DeleteEvent, Reference: Reference{Registry: "ghcr.io", Repository: "spegel-org/spegel", Digest: manifestDesc.Digest}},
+	}
+	require.ElementsMatch(t, expectedDelete, receiveEvents(t, eventCh, len(expectedDelete)))
+}
+
+func TestLayoutRepository(t *testing.T) {
+	t.Parallel()
+
+	layoutPath := t.TempDir()
+	configDesc := writeLayoutBlob(t, layoutPath, ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux"}`))
+	layerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.SHA512.FromString("layer"), Size: 5}
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifestDesc := writeLayoutBlob(t, layoutPath, ocispec.MediaTypeImageManifest, b)
+	manifestDesc.Annotations = map[string]string{ocispec.AnnotationRefName: "latest"}
+	writeLayoutIndex(t, layoutPath, manifestDesc)
+
+	for _, repository := range []string{"alpine", "docker.io/library/alpine:latest", "docker.io/library/alpine@" + manifestDesc.Digest.String()} {
+		_, err := NewLayout(layoutPath, WithLayoutRepository(repository))
+		require.Error(t, err, repository)
+	}
+
+	// Tag only ref names are skipped without a repository.
+	layout, err := NewLayout(layoutPath)
+	require.NoError(t, err)
+	imgs, err := layout.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, imgs)
+
+	layout, err = NewLayout(layoutPath, WithLayoutRepository("docker.io/library/alpine"))
+	require.NoError(t, err)
+	imgs, err = layout.ListImages(t.Context())
+	require.NoError(t, err)
+	expectedImgs := []Image{
+		{Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "latest", Digest: manifestDesc.Digest}},
+	}
+	require.Equal(t, expectedImgs, imgs)
+	dgst, err := layout.Resolve(t.Context(), "docker.io/library/alpine:latest")
+	require.NoError(t, err)
+	require.Equal(t, manifestDesc.Digest, dgst)
+	contents, err := layout.ListContent(t.Context())
+	require.NoError(t, err)
+	require.Len(t, contents, 2)
+
+	// Blobs written after the index should be indexed, for any digest algorithm.
+	err = os.MkdirAll(filepath.Join(layoutPath, ocispec.ImageBlobsDir, digest.SHA512.String()), 0o755)
+	require.NoError(t, err)
+	eventCh, err := layout.Subscribe(t.Context())
+	require.NoError(t, err)
+	writeLayoutBlobAlgorithm(t, layoutPath, digest.SHA512, ocispec.MediaTypeImageLayerGzip, []byte("layer"))
+	expectedCreate := []OCIEvent{
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: layerDesc.Digest}},
+	}
+	require.Equal(t, expectedCreate, receiveEvents(t, eventCh, len(expectedCreate)))
+	contents, err = layout.ListContent(t.Context())
+	require.NoError(t, err)
+	require.Len(t, contents, 3)
+}
+
+func writeLayoutBlob(t *testing.T, layoutPath, mediaType string, b []byte) ocispec.Descriptor {
+	t.Helper()
+
+	return writeLayoutBlobAlgorithm(t, layoutPath, digest.Canonical, mediaType, b)
+}
+
+func writeLayoutBlobAlgorithm(t *testing.T, layoutPath string, alg digest.Algorithm, mediaType string, b []byte) ocispec.Descriptor {
+	t.Helper()
+
+	err := os.WriteFile(filepath.Join(layoutPath, ocispec.ImageLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0o644)
+	require.NoError(t, err)
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    alg.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	blobDir := filepath.Join(layoutPath, ocispec.ImageBlobsDir, desc.Digest.Algorithm().String())
+	err = os.MkdirAll(blobDir, 0o755)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(blobDir, desc.Digest.Encoded()), b, 0o644)
+	require.NoError(t, err)
+	return desc
+}
+
+func writeLayoutIndex(t *testing.T, layoutPath string, descs ...ocispec.Descriptor) {
+	t.Helper()
+
+	index := ocispec.Index{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: descs,
+	}
+	index.SchemaVersion = 2
+	b, err := json.Marshal(index)
+	require.NoError(t, err)
+	// Replace the index atomically, like tools writing OCI layouts do.
+	tmpPath := filepath.Join(layoutPath, ocispec.ImageIndexFile+".tmp")
+	err = os.WriteFile(tmpPath, b, 0o644)
+	require.NoError(t, err)
+	err = os.Rename(tmpPath, filepath.Join(layoutPath, ocispec.ImageIndexFile))
+	require.NoError(t, err)
+}
+
+func receiveEvents(t *testing.T, eventCh <-chan OCIEvent, n int) []OCIEvent {
+	t.Helper()
+
+	events := []OCIEvent{}
+	for range n {
+		select {
+		case event := <-eventCh:
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for events", "received %d of %d events", len(events), n)
+		}
+	}
+	return events
+}
@@ -3,31 +3,84 @@ package oci
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"sync"
 
+	"github.com/containerd/containerd/v2/core/images"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 var _ Store = &Memory{}
 
+// Memory is a store that keeps all content in memory.
+// Events are emitted to subscribers when images or content are added or deleted.
+// Events are queued per subscriber so that changes are not blocked by subscribers that stop reading.
 type Memory struct {
-	descs  map[digest.Digest]ocispec.Descriptor
-	blobs  map[digest.Digest][]byte
-	tags   map[string]digest.Digest
-	images []Image
-	mx     sync.RWMutex
+	descs       map[digest.Digest]ocispec.Descriptor
+	blobs       map[digest.Digest][]byte
+	tags        map[string]digest.Digest
+	subscribers map[*memorySubscriber]any
+	images      []Image
+	mx          sync.RWMutex
+	// eventMx serializes changes so that events are delivered in order.
+	eventMx sync.Mutex
 }
 
 func NewMemory() *Memory {
 	return &Memory{
-		images: []Image{},
-		tags:   map[string]digest.Digest{},
-		descs:  map[digest.Digest]ocispec.Descriptor{},
-		blobs:  map[digest.Digest][]byte{},
+		images:      []Image{},
+		tags:        map[string]digest.Digest{},
+		descs:       map[digest.Digest]ocispec.Descriptor{},
+		blobs:       map[digest.Digest][]byte{},
+		subscribers: map[*memorySubscriber]any{},
+	}
+}
+
+// memorySubscriber delivers queued events in order until the context is cancelled.
+type memorySubscriber struct {
+	ctx      context.Context
+	eventCh  chan OCIEvent
+	notifyCh chan any
+	queue    []OCIEvent
+	mx       sync.Mutex
+}
+
+func (s *memorySubscriber) enqueue(events []OCIEvent) {
+	if len(events) == 0 {
+		return
+	}
+	s.mx.Lock()
+	s.queue = append(s.queue, events...)
+	s.mx.Unlock()
+	select {
+	case s.notifyCh <- nil:
+	default:
+	}
+}
+
+func (s *memorySubscriber) run() {
+	for {
+		s.mx.Lock()
+		events := s.queue
+		s.queue = nil
+		s.mx.Unlock()
+		for _, event := range events {
+			select {
+			case <-s.ctx.Done():
+				return
+			case s.eventCh <- event:
+			}
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.notifyCh:
+		}
 	}
 }
 
@@ -36,25 +89,36 @@ func (m *Memory) Name() string {
 }
 
 func (m *Memory) Subscribe(ctx context.Context) (<-chan OCIEvent, error) {
-	return nil, nil
+	sub := &memorySubscriber{
+		ctx:      ctx,
+		eventCh:  make(chan OCIEvent),
+		notifyCh: make(chan any, 1),
+	}
+	m.eventMx.Lock()
+	m.subscribers[sub] = nil
+	m.eventMx.Unlock()
+	go func() {
+		sub.run()
+		m.eventMx.Lock()
+		defer m.eventMx.Unlock()
+		delete(m.subscribers, sub)
+		close(sub.eventCh)
+	}()
+	return sub.eventCh, nil
 }
 
 func (m *Memory) ListImages(ctx context.Context) ([]Image, error) {
 	m.mx.RLock()
 	defer m.mx.RUnlock()
 
-	return m.images, nil
+	return slices.Clone(m.images), nil
 }
 
 func (m *Memory) ListContent(ctx context.Context) ([][]Reference, error) {
 	m.mx.RLock()
 	defer m.mx.RUnlock()
 
-	contents := [][]Reference{}
-	for k := range m.blobs {
-		contents = append(contents, []Reference{{Digest: k}})
-	}
-	return contents, nil
+	return m.index().listContent(), nil
 }
 
 func (m *Memory) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
@@ -63,7 +127,7 @@ func (m *Memory) Resolve(ctx context.Context, ref string) (digest.Digest, error)
 
 	dgst, ok := m.tags[ref]
 	if !ok {
-		return "", fmt.Errorf("could not resolve tag %s to a digest", ref)
+		return "", errors.Join(ErrNotFound, fmt.Errorf("could not resolve tag %s to a digest", ref))
 	}
 	return dgst, nil
 }
@@ -98,21 +162,35 @@ func (m *Memory) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekClose
 }
 
 func (m *Memory) AddImage(img Image) {
-	m.mx.Lock()
-	defer m.mx.Unlock()
+	//nolint: errcheck // Adding an image cannot fail.
+	m.update(func() error {
+		m.images = append(m.images, img)
+		tagName, ok := img.TagName()
+		if !ok {
+			return nil
+		}
+		m.tags[tagName] = img.Digest
+		return nil
+	})
+}
 
-	m.images = append(m.images, img)
-	tagName, ok := img.TagName()
-	if !ok {
-		return
-	}
-	m.tags[tagName] = img.Digest
+// DeleteImage removes the image, the content of the image is kept until it is deleted.
+func (m *Memory) DeleteImage(img Image) {
+	//nolint: errcheck // Deleting an image cannot fail.
+	m.update(func() error {
+		m.images = slices.DeleteFunc(m.images, func(existing Image) bool {
+			return existing == img
+		})
+		tagName, ok := img.TagName()
+		if !ok || m.tags[tagName] != img.Digest {
+			return nil
+		}
+		delete(m.tags, tagName)
+		return nil
+	})
 }
 
 func (m *Memory) Write(desc ocispec.Descriptor, b []byte) error {
-	m.mx.Lock()
-	defer m.mx.Unlock()
-
 	if desc.Size == 0 {
 		desc.Size = int64(len(b))
 	}
@@ -130,7 +208,90 @@ func (m *Memory) Write(desc ocispec.Descriptor, b []byte) error {
 		return fmt.Errorf("computed digest %s does not match given digest %s", computedDgst, desc.Digest)
 	}
 
-	m.descs[desc.Digest] = desc
-	m.blobs[desc.Digest] = b
+	return m.update(func() error {
+		m.descs[desc.Digest] = desc
+		m.blobs[desc.Digest] = b
+		return nil
+	})
+}
+
+// Delete removes the content with the given digest.
+func (m *Memory) Delete(dgst digest.Digest) error {
+	return m.update(func() error {
+		if _, ok := m.blobs[dgst]; !ok {
+			return errors.Join(ErrNotFound, fmt.Errorf("blob with digest %s not found", dgst))
+		}
+		delete(m.descs, dgst)
+		delete(m.blobs, dgst)
+		return nil
+	})
+}
+
+// update applies the change and queues the events for the content that changed for all subscribers.
+func (m *Memory) update(fn func() error) error {
+	m.eventMx.Lock()
+	defer m.eventMx.Unlock()
+
+	m.mx.Lock()
+	prev := m.index()
+	err := fn()
+	if err != nil {
+		m.mx.Unlock()
+		return err
+	}
+	next := m.index()
+	m.mx.Unlock()
+
+	events := diffContentIndex(prev, next)
+	for sub := range m.subscribers {
+		sub.enqueue(events)
+	}
 	return nil
 }
+
+// index returns the content index of the store. Content referenced by images is walked from the image
+// so that the content references the image repository, other content is referenced by digest only.
+func (m *Memory) index() *contentIndex {
+	idx := newContentIndex()
+	for _, img := range m.images {
+		idx.addImage(img)
+		m.walk(idx, img, img.Digest)
+	}
+	for dgst, desc := range m.descs {
+		if _, ok := idx.contents[dgst]; ok {
+			continue
+		}
+		idx.contents[dgst] = []Reference{{Digest: dgst}}
+		idx.descs[dgst] = desc
+	}
+	return idx
+}
+
+func (m *Memory) walk(idx *contentIndex, img Image, dgst digest.Digest) {
+	desc, ok := m.descs[dgst]
+	if !ok {
+		return
+	}
+	idx.addContent(img, desc)
+	children := []ocispec.Descriptor{}
+	switch {
+	case images.IsIndexType(desc.MediaType):
+		var index ocispec.Index
+		err := json.Unmarshal(m.blobs[dgst], &index)
+		if err != nil {
+			return
+		}
+		children = index.Manifests
+	case images.IsManifestType(desc.MediaType):
+		var manifest ocispec.Manifest
+		err := json.Unmarshal(m.blobs[dgst], &manifest)
+		if err != nil {
+			return
+		}
+		children = append(children, manifest.Config)
+		children = append(children, manifest.Layers...)
+	}
+	for _, child := range children {
+		m.walk(idx, img, child.Digest)
+	}
+}
@@ -0,0 +1,124 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	t.Parallel()
+
+	store := NewMemory()
+	require.Equal(t, "memory", store.Name())
+	ctx, cancel := context.WithCancel(t.Context())
+	eventCh, err := store.Subscribe(ctx)
+	require.NoError(t, err)
+
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	configDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))}
+	layer := []byte("layer")
+	layerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+
+	err = store.Write(ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: layerDesc.Digest}, []byte("invalid"))
+	require.ErrorContains(t, err, "does not match given digest")
+
+	// Events are sent for written content, which is only referenced by digest until an image references it.
+	err = store.Write(manifestDesc, b)
+	require.NoError(t, err)
+	err = store.Write(configDesc, config)
+	require.NoError(t, err)
+	expectedCreate := []OCIEvent{
+		{Type: CreateEvent, Reference: Reference{Digest: manifestDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Digest: configDesc.Digest}},
+	}
+	require.Equal(t, expectedCreate, receiveEvents(t, eventCh, len(expectedCreate)))
+	contents, err := store.ListContent(t.Context())
+	require.NoError(t, err)
+	require.Len(t, contents, 2)
+
+	// Adding an image walks the manifest so that content references the image repository.
+	img, err := ParseImage("docker.io/library/alpine:3.18", WithDigest(manifestDesc.Digest))
+	require.NoError(t, err)
+	store.AddImage(img)
+	expectedCreate = []OCIEvent{
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18"}},
+	}
+	require.Equal(t, expectedCreate, receiveEvents(t, eventCh, len(expectedCreate)))
+	err = store.Write(layerDesc, layer)
+	require.NoError(t, err)
+	expectedCreate = []OCIEvent{
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: layerDesc.Digest}},
+	}
+	require.Equal(t, expectedCreate, receiveEvents(t, eventCh, len(expectedCreate)))
+
+	imgs, err := store.ListImages(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []Image{img}, imgs)
+	contents, err = store.ListContent(t.Context())
+	require.NoError(t, err)
+	require.Len(t, contents, 3)
+	for _, refs := range contents {
+		require.Equal(t, []Reference{{Registry: "docker.io", Repository: "library/alpine", Digest: refs[0].Digest}}, refs)
+	}
+	dgst, err := store.Resolve(t.Context(), "docker.io/library/alpine:3.18")
+	require.NoError(t, err)
+	require.Equal(t, manifestDesc.Digest, dgst)
+	desc, err := store.Descriptor(t.Context(), layerDesc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, layerDesc, desc)
+	rc, err := store.Open(t.Context(), layerDesc.Digest)
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, layer, b)
+
+	// Deleting the image only removes the tag, content is removed when deleted.
+	store.DeleteImage(img)
+	expectedDelete := []OCIEvent{
+		{Type: DeleteEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18"}},
+	}
+	require.Equal(t, expectedDelete, receiveEvents(t, eventCh, len(expectedDelete)))
+	_, err = store.Resolve(t.Context(), "docker.io/library/alpine:3.18")
+	require.ErrorIs(t, err, ErrNotFound)
+	err = store.Delete(layerDesc.Digest)
+	require.NoError(t, err)
+	expectedDelete = []OCIEvent{
+		{Type: DeleteEvent, Reference: Reference{Digest: layerDesc.Digest}},
+	}
+	require.Equal(t, expectedDelete, receiveEvents(t, eventCh, len(expectedDelete)))
+	_, err = store.Open(t.Context(), layerDesc.Digest)
+	require.ErrorIs(t, err, ErrNotFound)
+	err = store.Delete(layerDesc.Digest)
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// The channel is closed when the context is cancelled.
+	cancel()
+	_, ok := <-eventCh
+	require.False(t, ok)
+
+	// Subscribers that stop reading should not block changes.
+	_, err = store.Subscribe(t.Context())
+	require.NoError(t, err)
+	for range 10 {
+		err = store.Write(layerDesc, layer)
+		require.NoError(t, err)
+		err = store.Delete(layerDesc.Digest)
+		require.NoError(t, err)
+	}
+}
@@ -27,6 +27,8 @@ type EventType string
 const (
 	CreateEvent EventType = "CREATE"
 	DeleteEvent EventType = "DELETE"
+	// ReconcileEvent signals that events may have been missed and that all content has to be listed again.
+	ReconcileEvent EventType = "RECONCILE"
 )
 
 type OCIEvent struct {
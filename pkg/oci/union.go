@@ -0,0 +1,224 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/spegel-org/spegel/internal/channel"
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+var _ Store = &Union{}
+
+// Union is a store that combines multiple stores.
+// Content is listed from all stores while requests are served by the first store that has the content.
+type Union struct {
+	stores []Store
+}
+
+func NewUnion(stores ...Store) (*Union, error) {
+	if len(stores) == 0 {
+		return nil, errors.New("union requires at least one store")
+	}
+	return &Union{
+		stores: stores,
+	}, nil
+}
+
+// Close closes all stores that can be closed.
+func (u *Union) Close() error {
+	errs := []error{}
+	for _, store := range u.stores {
+		closer, ok := store.(io.Closer)
+		if !ok {
+			continue
+		}
+		err := closer.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (u *Union) Name() string {
+	names := []string{}
+	for _, store := range u.stores {
+		names = append(names, store.Name())
+	}
+	return fmt.Sprintf("union(%s)", strings.Join(names, ","))
+}
+
+func (u *Union) ListImages(ctx context.Context) ([]Image, error) {
+	imgs := []Image{}
+	for _, store := range u.stores {
+		storeImgs, err := store.ListImages(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list images in store %s: %w", store.Name(), err)
+		}
+		for _, img := range storeImgs {
+			if slices.Contains(imgs, img) {
+				continue
+			}
+			imgs = append(imgs, img)
+		}
+	}
+	return imgs, nil
+}
+
+func (u *Union) ListContent(ctx context.Context) ([][]Reference, error) {
+	storeContents := [][][]Reference{}
+	for _, store := range u.stores {
+		contents, err := store.ListContent(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list content in store %s: %w", store.Name(), err)
+		}
+		storeContents = append(storeContents, contents)
+	}
+	return mergeContents(storeContents...), nil
+}
+
+func (u *Union) Resolve(ctx context.Context, ref string) (digest.Digest, error) {
+	return unionFirst(ctx, u.stores, "resolve", func(store Store) (digest.Digest, error) {
+		return store.Resolve(ctx, ref)
+	})
+}
+
+func (u *Union) Descriptor(ctx context.Context, dgst digest.Digest) (ocispec.Descriptor, error) {
+	return unionFirst(ctx, u.stores, "descriptor", func(store Store) (ocispec.Descriptor, error) {
+		return store.Descriptor(ctx, dgst)
+	})
+}
+
+func (u *Union) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	return unionFirst(ctx, u.stores, "open", func(store Store) (io.ReadSeekCloser, error) {
+		return store.Open(ctx, dgst)
+	})
+}
+
+// unionEvent is an event together with the store it was received from.
+type unionEvent struct {
+	store Store
+	event OCIEvent
+}
+
+func (u *Union) Subscribe(ctx context.Context) (<-chan OCIEvent, error) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	subCtx, subCancel := context.WithCancel(ctx)
+	storeChs := []<-chan unionEvent{}
+	for _, store := range u.stores {
+		storeCh, err := store.Subscribe(subCtx)
+		if err != nil {
+			subCancel()
+			return nil, fmt.Errorf("could not subscribe to store %s: %w", store.Name(), err)
+		}
+		// Stores without events return a nil channel.
+		if storeCh == nil {
+			continue
+		}
+		unionCh := make(chan unionEvent)
+		go func() {
+			// The union is closed when any of the stores closes its channel.
+			defer subCancel()
+			defer close(unionCh)
+			// Events are drained after cancellation so that the store is not blocked.
+			for event := range storeCh {
+				select {
+				case <-subCtx.Done():
+				case unionCh <- unionEvent{store: store, event: event}:
+				}
+			}
+		}()
+		storeChs = append(storeChs, unionCh)
+	}
+
+	eventCh := make(chan OCIEvent)
+	go func() {
+		defer close(eventCh)
+		defer subCancel()
+		for unionEvent := range channel.Merge(storeChs...) {
+			// Deletions are dropped while the content is still present in another store.
+			if unionEvent.event.Type == DeleteEvent && u.existsInOtherStore(subCtx, unionEvent.store, unionEvent.event.Reference) {
+				log.V(1).Info("ignoring delete event for reference present in another store", "ref", unionEvent.event.Reference.String(), "store", unionEvent.store.Name())
+				continue
+			}
+			select {
+			case <-subCtx.Done():
+			case eventCh <- unionEvent.event:
+			}
+		}
+	}()
+	return eventCh, nil
+}
+
+func (u *Union) existsInOtherStore(ctx context.Context, source Store, ref Reference) bool {
+	for _, store := range u.stores {
+		if store == source {
+			continue
+		}
+		var err error
+		if ref.Digest == "" {
+			_, err = store.Resolve(ctx, ref.Identifier())
+		} else {
+			_, err = store.Descriptor(ctx, ref.Digest)
+		}
+		if err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// unionFirst returns the result of the first store that succeeds, reporting which store served the request.
+func unionFirst[T any](ctx context.Context, stores []Store, operation string, fn func(store Store) (T, error)) (T, error) {
+	errs := []error{}
+	for _, store := range stores {
+		v, err := fn(store)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("store %s: %w", store.Name(), err))
+			continue
+		}
+		metrics.StoreRequestsTotal.WithLabelValues(store.Name(), operation).Inc()
+		logr.FromContextOrDiscard(ctx).V(1).Info("store served request", "store", store.Name(), "operation", operation)
+		return v, nil
+	}
+	var zero T
+	return zero, errors.Join(errs...)
+}
+
+// mergeContents merges content listed multiple times so that each digest is only listed once.
+func mergeContents(contentsList ...[][]Reference) [][]Reference {
+	dgsts := []digest.Digest{}
+	contentRefs := map[digest.Digest][]Reference{}
+	for _, contents := range contentsList {
+		for _, refs := range contents {
+			if len(refs) == 0 {
+				continue
+			}
+			dgst := refs[0].Digest
+			if _, ok := contentRefs[dgst]; !ok {
+				dgsts = append(dgsts, dgst)
+			}
+			for _, ref := range refs {
+				if slices.Contains(contentRefs[dgst], ref) {
+					continue
+				}
+				contentRefs[dgst] = append(contentRefs[dgst], ref)
+			}
+		}
+	}
+	contents := [][]Reference{}
+	for _, dgst := range dgsts {
+		contents = append(contents, contentRefs[dgst])
+	}
+	return contents
+}
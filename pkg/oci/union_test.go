@@ -0,0 +1,108 @@
+package oci
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnion(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewUnion()
+	require.EqualError(t, err, "union requires at least one store")
+
+	layoutPath := t.TempDir()
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	configDesc := writeLayoutBlob(t, layoutPath, ocispec.MediaTypeImageConfig, config)
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	manifestDesc := writeLayoutBlob(t, layoutPath, ocispec.MediaTypeImageManifest, b)
+	layout, err := NewLayout(layoutPath)
+	require.NoError(t, err)
+
+	// The memory store contains the same config and tag as the layout together with a blob of its own.
+	memory := NewMemory()
+	err = memory.Write(configDesc, config)
+	require.NoError(t, err)
+	blob := []byte("memory")
+	blobDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	err = memory.Write(blobDesc, blob)
+	require.NoError(t, err)
+	memoryImg, err := ParseImage("docker.io/library/alpine:3.18", WithDigest(blobDesc.Digest))
+	require.NoError(t, err)
+	memory.AddImage(memoryImg)
+
+	union, err := NewUnion(layout, memory)
+	require.NoError(t, err)
+	require.Equal(t, "union(oci-layout,memory)", union.Name())
+	eventCh, err := union.Subscribe(t.Context())
+	require.NoError(t, err)
+
+	tagDesc := manifestDesc
+	tagDesc.Annotations = map[string]string{images.AnnotationImageName: "docker.io/library/alpine:3.18"}
+	writeLayoutIndex(t, layoutPath, tagDesc)
+	expectedCreate := []OCIEvent{
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: configDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: manifestDesc.Digest}},
+		{Type: CreateEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18"}},
+	}
+	require.ElementsMatch(t, expectedCreate, receiveEvents(t, eventCh, len(expectedCreate)))
+
+	imgs, err := union.ListImages(t.Context())
+	require.NoError(t, err)
+	expectedImgs := []Image{
+		{Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18", Digest: manifestDesc.Digest}},
+		memoryImg,
+	}
+	require.Equal(t, expectedImgs, imgs)
+
+	// Content present in multiple stores is merged.
+	contents, err := union.ListContent(t.Context())
+	require.NoError(t, err)
+	expectedContents := [][]Reference{
+		{
+			{Registry: "docker.io", Repository: "library/alpine", Digest: configDesc.Digest},
+			{Digest: configDesc.Digest},
+		},
+		{{Registry: "docker.io", Repository: "library/alpine", Digest: manifestDesc.Digest}},
+		{{Registry: "docker.io", Repository: "library/alpine", Digest: blobDesc.Digest}},
+	}
+	require.ElementsMatch(t, expectedContents, contents)
+
+	// Stores are queried in order.
+	dgst, err := union.Resolve(t.Context(), "docker.io/library/alpine:3.18")
+	require.NoError(t, err)
+	require.Equal(t, manifestDesc.Digest, dgst)
+	_, err = union.Resolve(t.Context(), "docker.io/library/alpine:latest")
+	require.Error(t, err)
+	desc, err := union.Descriptor(t.Context(), blobDesc.Digest)
+	require.NoError(t, err)
+	require.Equal(t, blobDesc, desc)
+	rc, err := union.Open(t.Context(), blobDesc.Digest)
+	require.NoError(t, err)
+	b, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, blob, b)
+	_, err = union.Open(t.Context(), digest.FromString("missing"))
+	require.ErrorIs(t, err, ErrNotFound)
+
+	// Deletions are only emitted for content that is not present in another store.
+	writeLayoutIndex(t, layoutPath)
+	expectedDelete := []OCIEvent{
+		{Type: DeleteEvent, Reference: Reference{Registry: "docker.io", Repository: "library/alpine", Digest: manifestDesc.Digest}},
+	}
+	require.Equal(t, expectedDelete, receiveEvents(t, eventCh, len(expectedDelete)))
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/avast/retry-go/v4"
 	"github.com/go-logr/logr"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/spegel-org/spegel/internal/option"
 	"github.com/spegel-org/spegel/pkg/httpx"
@@ -31,8 +33,11 @@ const (
 
 type RegistryConfig struct {
 	OCIClient      *oci.Client
+	LoadTracker    *routing.LoadTracker
+	PeerDialer     func(ctx context.Context, id string) (net.Conn, error)
 	Username       string
 	Password       string
+	Architecture   string
 	Filters        []oci.Filter
 	ResolveTimeout time.Duration
 	ResolveRetries int
@@ -68,6 +73,31 @@ func WithOCIClient(ociClient *oci.Client) RegistryOption {
 	}
 }
 
+// WithLoadTracker sets the load tracker used to record uploads served by the registry.
+func WithLoadTracker(lt *routing.LoadTracker) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.LoadTracker = lt
+		return nil
+	}
+}
+
+// WithPeerDialer sets the dialer used to mirror from peers reached over router streams, such as peers behind NAT.
+func WithPeerDialer(dialer func(ctx context.Context, id string) (net.Conn, error)) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.PeerDialer = dialer
+		return nil
+	}
+}
+
+// WithPreferredArchitecture sets the architecture of peers that are preferred when mirroring content.
+// Peers with other or unknown architectures are only used when no peer with the architecture is found.
+func WithPreferredArchitecture(arch string) RegistryOption {
+	return func(cfg *RegistryConfig) error {
+		cfg.Architecture = arch
+		return nil
+	}
+}
+
 func WithBasicAuth(username, password string) RegistryOption {
 	return func(cfg *RegistryConfig) error {
 		cfg.Username = username
@@ -84,9 +114,12 @@ type Registry struct {
 	bufferPool     *sync.Pool
 	ociStore       oci.Store
 	ociClient      *oci.Client
+	peerClient     *oci.Client
 	router         routing.Router
+	loadTracker    *routing.LoadTracker
 	username       string
 	password       string
+	architecture   string
 	filters        []oci.Filter
 	resolveTimeout time.Duration
 	resolveRetries int
@@ -109,6 +142,23 @@ func NewRegistry(ociStore oci.Store, router routing.Router, opts ...RegistryOpti
 		}
 		cfg.OCIClient = ociClient
 	}
+	if cfg.LoadTracker == nil {
+		cfg.LoadTracker = routing.NewLoadTracker()
+	}
+	var peerClient *oci.Client
+	if cfg.PeerDialer != nil {
+		// Stream peers are dialed using the peer ID as the host.
+		peerClient, err = oci.NewClient(oci.WithDialContext(func(ctx context.Context, _, addr string) (net.Conn, error) {
+			id, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return cfg.PeerDialer(ctx, id)
+		}))
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	bufferPool := &sync.Pool{
 		New: func() any {
@@ -121,11 +171,14 @@ func NewRegistry(ociStore oci.Store, router routing.Router, opts ...RegistryOpti
 		ociStore:       ociStore,
 		router:         router,
 		ociClient:      cfg.OCIClient,
+		peerClient:     peerClient,
+		loadTracker:    cfg.LoadTracker,
 		resolveRetries: cfg.ResolveRetries,
 		filters:        cfg.Filters,
 		resolveTimeout: cfg.ResolveTimeout,
 		username:       cfg.Username,
 		password:       cfg.Password,
+		architecture:   cfg.Architecture,
 		bufferPool:     bufferPool,
 		stats:          Statistics{},
 	}
@@ -266,9 +319,16 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 		rw.WriteError(http.StatusNotFound, errors.Join(respErr, err))
 		return
 	}
+	if r.architecture != "" {
+		balancer = routing.NewPreferBalancer(balancer, func(peer routing.PeerInfo) bool {
+			return peer.Architecture == r.architecture
+		})
+	}
 
 	// Resume range for when blobs fail midway through copying.
 	var resumeRng *httpx.Range
+	// Last peer attempted, used to log which peer failed.
+	var peer routing.PeerInfo
 
 	retryOpts := []retry.Option{
 		retry.Context(req.Context()),
@@ -276,24 +336,53 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 		retry.DelayType(retry.FixedDelay),
 		retry.Delay(0),
 		retry.OnRetry(func(attempt uint, err error) {
-			log.Error(err, "retrying mirror request", "attempt", attempt)
+			log.Error(err, "retrying mirror request", "attempt", attempt, "peer", peer.ID, "addr", peer.Addr.String())
 		}),
 	}
 	err = retry.Do(func() error {
-		peer, err := balancer.Next()
+		var err error
+		peer, err = balancer.Next()
 		if err != nil {
 			return retry.Unrecoverable(err)
 		}
 
+		// Head requests can be answered with the metadata advertised by the peer without contacting it.
+		if req.Method == http.MethodHead && req.Header.Get(httpx.HeaderRange) == "" && peer.Metadata.IsValid() {
+			log.V(1).Info("answering head request with peer metadata", "peer", peer.ID)
+			desc := ocispec.Descriptor{
+				MediaType: peer.Metadata.MediaType,
+				Digest:    peer.Metadata.Digest,
+				Size:      peer.Metadata.Size,
+			}
+			oci.WriteDescriptorToHeader(desc, rw.Header())
+			if dist.Kind == oci.DistributionKindBlob {
+				rw.Header().Set(httpx.HeaderAcceptRanges, httpx.RangeUnit)
+			}
+			rw.WriteHeader(http.StatusOK)
+			return nil
+		}
+
 		mirrorDetails.Attempts += 1
+		log.V(1).Info("mirroring request to peer", "peer", peer.ID, "addr", peer.Addr.String(), "seen", peer.Seen)
 
+		ociClient := r.ociClient
 		mirror := &url.URL{
 			Scheme: "http",
-			Host:   peer.String(),
+			Host:   peer.Addr.String(),
 		}
 		if req.TLS != nil {
 			mirror.Scheme = "https"
 		}
+		if peer.Stream {
+			if r.peerClient == nil {
+				balancer.Remove(peer)
+				return errors.New("peer is only reachable over a stream but no peer dialer is set")
+			}
+			// Connections through the router are already encrypted.
+			ociClient = r.peerClient
+			mirror.Scheme = "http"
+			mirror.Host = peer.ID
+		}
 		fetchOpts := []oci.FetchOption{
 			oci.WithFetchHeader(HeaderSpegelMirrored, "true"),
 			oci.WithFetchMirror(mirror),
@@ -317,7 +406,7 @@ func (r *Registry) mirrorHandler(rw httpx.ResponseWriter, req *http.Request, dis
 			defer reqCancel()
 		}
 
-		rc, desc, err := r.ociClient.Fetch(fetchCtx, req.Method, dist, fetchOpts...)
+		rc, desc, err := ociClient.Fetch(fetchCtx, req.Method, dist, fetchOpts...)
 		if err != nil {
 			balancer.Remove(peer)
 			return fmt.Errorf("request to mirror failed: %w", err)
@@ -427,8 +516,10 @@ func (r *Registry) manifestHandler(rw httpx.ResponseWriter, req *http.Request, d
 		return
 	}
 	defer rc.Close()
+	w, done := r.loadTracker.StartUpload(rw)
+	defer done()
 	rw.WriteHeader(http.StatusOK)
-	_, err = io.Copy(rw, rc)
+	_, err = io.Copy(w, rc)
 	if err != nil {
 		logr.FromContextOrDiscard(req.Context()).Error(err, "error occurred when writing manifest")
 		return
@@ -491,8 +582,10 @@ func (r *Registry) blobHandler(rw httpx.ResponseWriter, req *http.Request, dist
 		}
 		src = io.LimitReader(rc, rng.Size())
 	}
+	w, done := r.loadTracker.StartUpload(rw)
+	defer done()
 	rw.WriteHeader(status)
-	_, err = io.Copy(rw, src)
+	_, err = io.Copy(w, src)
 	if err != nil {
 		logr.FromContextOrDiscard(req.Context()).Error(err, "failed to write blob")
 		return
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
@@ -448,6 +449,94 @@ func TestRegistryHandler(t *testing.T) {
 	}
 }
 
+func TestStreamPeer(t *testing.T) {
+	t.Parallel()
+
+	memStore := oci.NewMemory()
+	err := memStore.Write(ocispec.Descriptor{Digest: digest.Digest("sha256:0b7e0ac6364af64af017531f137a95f3a5b12ea38be0e74a860004d3e5760a67"), MediaType: "dummy"}, []byte("first peer"))
+	require.NoError(t, err)
+	peerReg, err := NewRegistry(memStore, routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}))
+	require.NoError(t, err)
+	peerSvr := httptest.NewServer(peerReg.Handler(logr.Discard()))
+	t.Cleanup(func() {
+		peerSvr.Close()
+	})
+
+	router := &streamRouter{MemoryRouter: routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.AddrPort{}), id: "stream"}
+	dialer := func(ctx context.Context, id string) (net.Conn, error) {
+		if id != "stream" {
+			return nil, fmt.Errorf("unknown peer %s", id)
+		}
+		return (&net.Dialer{}).DialContext(ctx, "tcp", peerSvr.Listener.Addr().String())
+	}
+	target := "http://example.com/v2/foo/blobs/sha256:0b7e0ac6364af64af017531f137a95f3a5b12ea38be0e74a860004d3e5760a67?ns=docker.io"
+
+	// Stream peers should be skipped without a peer dialer.
+	reg, err := NewRegistry(oci.NewMemory(), router)
+	require.NoError(t, err)
+	rw := httptest.NewRecorder()
+	reg.Handler(logr.Discard()).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, target, nil))
+	require.Equal(t, http.StatusNotFound, rw.Result().StatusCode)
+
+	// Stream peers should be mirrored through the peer dialer.
+	reg, err = NewRegistry(oci.NewMemory(), router, WithPeerDialer(dialer))
+	require.NoError(t, err)
+	rw = httptest.NewRecorder()
+	reg.Handler(logr.Discard()).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, target, nil))
+	require.Equal(t, http.StatusOK, rw.Result().StatusCode)
+	b, err := io.ReadAll(rw.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "first peer", string(b))
+}
+
+func TestMetadataHead(t *testing.T) {
+	t.Parallel()
+
+	unreachableAddrPort := netip.MustParseAddrPort("127.0.0.1:0")
+	dgst := digest.FromString("manifest")
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{
+		dgst.String():           {unreachableAddrPort},
+		"example.com/foo:v1":    {unreachableAddrPort},
+		"example.com/foo:empty": {unreachableAddrPort},
+	}, netip.AddrPort{})
+	metadata := routing.Metadata{MediaType: ocispec.MediaTypeImageManifest, Digest: dgst, Size: 8}
+	router.SetMetadata(dgst.String(), metadata)
+	router.SetMetadata("example.com/foo:v1", metadata)
+	reg, err := NewRegistry(oci.NewMemory(), router)
+	require.NoError(t, err)
+	handler := reg.Handler(logr.Discard())
+
+	// Head requests should be answered with the metadata without contacting the peer.
+	for _, ref := range []string{dgst.String(), "v1"} {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(http.MethodHead, "http://example.com/v2/foo/manifests/"+ref+"?ns=example.com", nil))
+		require.Equal(t, http.StatusOK, rw.Result().StatusCode)
+		require.Equal(t, ocispec.MediaTypeImageManifest, rw.Result().Header.Get(httpx.HeaderContentType))
+		require.Equal(t, "8", rw.Result().Header.Get(httpx.HeaderContentLength))
+		require.Equal(t, dgst.String(), rw.Result().Header.Get(oci.HeaderDockerDigest))
+	}
+
+	// Requests without metadata or content should still contact the peer.
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodHead, "http://example.com/v2/foo/manifests/empty?ns=example.com", nil))
+	require.Equal(t, http.StatusNotFound, rw.Result().StatusCode)
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/v2/foo/manifests/"+dgst.String()+"?ns=example.com", nil))
+	require.Equal(t, http.StatusNotFound, rw.Result().StatusCode)
+}
+
+// streamRouter returns a single stream peer for all lookups.
+type streamRouter struct {
+	*routing.MemoryRouter
+	id string
+}
+
+func (r *streamRouter) Lookup(ctx context.Context, key string, count int) (routing.Balancer, error) {
+	rr := routing.NewRoundRobin()
+	rr.Add(routing.PeerInfo{ID: r.id, Stream: true})
+	return rr, nil
+}
+
 type flakyStore struct {
 	*oci.Memory
 }
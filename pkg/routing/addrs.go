@@ -0,0 +1,163 @@
+package routing
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// addrSelector decides which addresses are advertised to peers and which peer address is used.
+// Addresses in preferred networks and of the preferred address family are chosen over others.
+type addrSelector struct {
+	family        string
+	prefixes      []netip.Prefix
+	allowLoopback bool
+}
+
+func newAddrSelector(cfg P2PRouterConfig) (addrSelector, error) {
+	prefixes := slices.Clone(cfg.PreferredCIDRs)
+	for _, name := range cfg.PreferredInterfaces {
+		ifacePrefixes, err := interfacePrefixes(name)
+		if err != nil {
+			return addrSelector{}, err
+		}
+		prefixes = append(prefixes, ifacePrefixes...)
+	}
+	return addrSelector{
+		prefixes:      prefixes,
+		family:        cfg.AddressFamily,
+		allowLoopback: cfg.AllowLoopback,
+	}, nil
+}
+
+// interfacePrefixes returns the networks of the addresses assigned to the interface.
+func interfacePrefixes(name string) ([]netip.Prefix, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not get preferred interface %s: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("could not get addresses of preferred interface %s: %w", name, err)
+	}
+	prefixes := []netip.Prefix{}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		ones, _ := ipNet.Mask.Size()
+		prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ones).Masked())
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("preferred interface %s has no addresses", name)
+	}
+	return prefixes, nil
+}
+
+// filterAddrs returns the addresses that should be advertised to peers.
+// When any address is in a preferred network only those addresses are advertised, after which
+// only addresses of the preferred address family are advertised if there are any.
+// Relay addresses are kept as they are used to reach the host and not to select an IP.
+func (s addrSelector) filterAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	ip6Addrs, ip4Addrs := filterAndSplitAddrs(addrs, s.allowLoopback)
+	if len(s.prefixes) > 0 {
+		preferredIP6Addrs := slices.DeleteFunc(slices.Clone(ip6Addrs), s.isNotPreferredNetwork)
+		preferredIP4Addrs := slices.DeleteFunc(slices.Clone(ip4Addrs), s.isNotPreferredNetwork)
+		if slices.ContainsFunc(preferredIP6Addrs, isDirectAddr) || slices.ContainsFunc(preferredIP4Addrs, isDirectAddr) {
+			ip6Addrs, ip4Addrs = preferredIP6Addrs, preferredIP4Addrs
+		}
+	}
+	switch s.family {
+	case AddressFamilyIPv4:
+		if slices.ContainsFunc(ip4Addrs, isDirectAddr) {
+			ip6Addrs = slices.DeleteFunc(ip6Addrs, isDirectAddr)
+		}
+	case AddressFamilyIPv6:
+		if slices.ContainsFunc(ip6Addrs, isDirectAddr) {
+			ip4Addrs = slices.DeleteFunc(ip4Addrs, isDirectAddr)
+		}
+	}
+	return slices.Concat(ip6Addrs, ip4Addrs)
+}
+
+// selectIPAddr returns the IP address from the addresses that the local host is able to reach.
+// Addresses in preferred networks are selected first, followed by the preferred address family.
+// IPv6 is preferred over IPv4 when no address family is set.
+func (s addrSelector) selectIPAddr(addrs []ma.Multiaddr, ip6Support, ip4Support bool) (netip.Addr, error) {
+	// Relay addresses contain the IP of the relay and not the peer.
+	addrs = slices.DeleteFunc(slices.Clone(addrs), isRelayAddr)
+	ip6Addrs, ip4Addrs := filterAndSplitAddrs(addrs, s.allowLoopback)
+	if !ip6Support {
+		ip6Addrs = nil
+	}
+	if !ip4Support {
+		ip4Addrs = nil
+	}
+	candidates := slices.Concat(ip6Addrs, ip4Addrs)
+	if s.family == AddressFamilyIPv4 {
+		candidates = slices.Concat(ip4Addrs, ip6Addrs)
+	}
+	slices.SortStableFunc(candidates, func(a, b ma.Multiaddr) int {
+		return cmp.Compare(s.rank(a), s.rank(b))
+	})
+	errs := []error{}
+	for _, addr := range candidates {
+		ipAddr, err := toIPAddr(addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return ipAddr, nil
+	}
+	errs = append(errs, errors.New("could not get IP from address"))
+	return netip.Addr{}, errors.Join(errs...)
+}
+
+func (s addrSelector) rank(addr ma.Multiaddr) int {
+	if s.isNotPreferredNetwork(addr) {
+		return 1
+	}
+	return 0
+}
+
+func (s addrSelector) isNotPreferredNetwork(addr ma.Multiaddr) bool {
+	if isRelayAddr(addr) {
+		return false
+	}
+	ipAddr, err := toIPAddr(addr)
+	if err != nil {
+		return true
+	}
+	ipAddr = ipAddr.Unmap()
+	for _, prefix := range s.prefixes {
+		if prefix.Contains(ipAddr) {
+			return false
+		}
+	}
+	return true
+}
+
+// isRelayAddr returns true if the address is a circuit relay address.
+func isRelayAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+func isDirectAddr(addr ma.Multiaddr) bool {
+	return !isRelayAddr(addr)
+}
@@ -0,0 +1,195 @@
+package routing
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectIPAddr(t *testing.T) {
+	t.Parallel()
+
+	relayAddr := ma.StringCast("/ip4/10.0.0.1/tcp/5001/p2p/12D3KooWAsvvigG9jqjMNWMmqXph6BvszxTus6Fg6k5UZda2iKDB/p2p-circuit")
+	mgmtAddr := ma.StringCast("/ip4/10.0.0.2/tcp/5001")
+	podAddr := ma.StringCast("/ip4/192.168.1.2/tcp/5001")
+	ip6Addr := ma.StringCast("/ip6/fd00::2/tcp/5001")
+	loopbackAddr := ma.StringCast("/ip4/127.0.0.1/tcp/5001")
+	require.True(t, isRelayAddr(relayAddr))
+	require.False(t, isRelayAddr(mgmtAddr))
+
+	tests := []struct {
+		name       string
+		selector   addrSelector
+		addrs      []ma.Multiaddr
+		ip6Support bool
+		ip4Support bool
+		expected   string
+	}{
+		{
+			name:       "prefer IPv6 by default",
+			addrs:      []ma.Multiaddr{mgmtAddr, ip6Addr},
+			ip6Support: true,
+			ip4Support: true,
+			expected:   "fd00::2",
+		},
+		{
+			name:       "prefer IPv4 family",
+			selector:   addrSelector{family: AddressFamilyIPv4},
+			addrs:      []ma.Multiaddr{ip6Addr, mgmtAddr},
+			ip6Support: true,
+			ip4Support: true,
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "fall back to supported family",
+			selector:   addrSelector{family: AddressFamilyIPv4},
+			addrs:      []ma.Multiaddr{ip6Addr},
+			ip6Support: true,
+			ip4Support: true,
+			expected:   "fd00::2",
+		},
+		{
+			name:       "prefer network over family",
+			selector:   addrSelector{prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}},
+			addrs:      []ma.Multiaddr{ip6Addr, mgmtAddr, podAddr},
+			ip6Support: true,
+			ip4Support: true,
+			expected:   "192.168.1.2",
+		},
+		{
+			name:       "preferred network not supported",
+			selector:   addrSelector{prefixes: []netip.Prefix{netip.MustParsePrefix("fd00::/64")}},
+			addrs:      []ma.Multiaddr{ip6Addr, mgmtAddr, podAddr},
+			ip4Support: true,
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "skip relay address",
+			addrs:      []ma.Multiaddr{relayAddr, mgmtAddr},
+			ip6Support: true,
+			ip4Support: true,
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "skip loopback address",
+			addrs:      []ma.Multiaddr{loopbackAddr, mgmtAddr},
+			ip4Support: true,
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "allow loopback address",
+			selector:   addrSelector{allowLoopback: true},
+			addrs:      []ma.Multiaddr{loopbackAddr, mgmtAddr},
+			ip4Support: true,
+			expected:   "127.0.0.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ipAddr, err := tt.selector.selectIPAddr(tt.addrs, tt.ip6Support, tt.ip4Support)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, ipAddr.String())
+		})
+	}
+
+	_, err := addrSelector{}.selectIPAddr([]ma.Multiaddr{relayAddr}, true, true)
+	require.Error(t, err)
+	_, err = addrSelector{}.selectIPAddr([]ma.Multiaddr{ip6Addr}, false, true)
+	require.Error(t, err)
+}
+
+func TestFilterAddrs(t *testing.T) {
+	t.Parallel()
+
+	relayAddr := ma.StringCast("/ip4/10.0.0.1/tcp/5001/p2p/12D3KooWAsvvigG9jqjMNWMmqXph6BvszxTus6Fg6k5UZda2iKDB/p2p-circuit")
+	mgmtAddr := ma.StringCast("/ip4/10.0.0.2/tcp/5001")
+	podAddr := ma.StringCast("/ip4/192.168.1.2/tcp/5001")
+	ip6Addr := ma.StringCast("/ip6/fd00::2/tcp/5001")
+	loopbackAddr := ma.StringCast("/ip4/127.0.0.1/tcp/5001")
+	addrs := []ma.Multiaddr{loopbackAddr, mgmtAddr, podAddr, ip6Addr, relayAddr}
+
+	tests := []struct {
+		name     string
+		selector addrSelector
+		expected []ma.Multiaddr
+	}{
+		{
+			name:     "no preference",
+			expected: []ma.Multiaddr{ip6Addr, mgmtAddr, podAddr, relayAddr},
+		},
+		{
+			name:     "preferred network",
+			selector: addrSelector{prefixes: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}},
+			expected: []ma.Multiaddr{podAddr, relayAddr},
+		},
+		{
+			name:     "no address in preferred network",
+			selector: addrSelector{prefixes: []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")}},
+			expected: []ma.Multiaddr{ip6Addr, mgmtAddr, podAddr, relayAddr},
+		},
+		{
+			name:     "IPv4 family",
+			selector: addrSelector{family: AddressFamilyIPv4},
+			expected: []ma.Multiaddr{mgmtAddr, podAddr, relayAddr},
+		},
+		{
+			name:     "IPv6 family",
+			selector: addrSelector{family: AddressFamilyIPv6},
+			expected: []ma.Multiaddr{ip6Addr, relayAddr},
+		},
+		{
+			name: "preferred network and IPv6 family",
+			selector: addrSelector{
+				prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+				family:   AddressFamilyIPv6,
+			},
+			expected: []ma.Multiaddr{mgmtAddr, relayAddr},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			filtered := tt.selector.filterAddrs(addrs)
+			require.Equal(t, tt.expected, filtered)
+		})
+	}
+}
+
+func TestNewAddrSelector(t *testing.T) {
+	t.Parallel()
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+	var loopback net.Interface
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface
+			break
+		}
+	}
+	if loopback.Name == "" {
+		t.Skip("no loopback interface available")
+	}
+
+	cidr := netip.MustParsePrefix("10.0.0.0/8")
+	selector, err := newAddrSelector(P2PRouterConfig{
+		PreferredCIDRs:      []netip.Prefix{cidr},
+		PreferredInterfaces: []string{loopback.Name},
+		AddressFamily:       AddressFamilyIPv4,
+		AllowLoopback:       true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, AddressFamilyIPv4, selector.family)
+	require.True(t, selector.allowLoopback)
+	require.Equal(t, cidr, selector.prefixes[0])
+	require.Contains(t, selector.prefixes, netip.MustParsePrefix("127.0.0.0/8"))
+
+	_, err = newAddrSelector(P2PRouterConfig{PreferredInterfaces: []string{"does-not-exist"}})
+	require.ErrorContains(t, err, "could not get preferred interface does-not-exist")
+}
@@ -0,0 +1,45 @@
+package routing
+
+import (
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// architectureConnectTimeout bounds connecting to peers with an unknown architecture.
+const architectureConnectTimeout = 5 * time.Second
+
+// architectureProtocol returns the protocol advertised by peers to share their architecture. Supported protocols
+// are exchanged when peers connect, so the architecture of connected peers is known without querying them.
+func architectureProtocol(namespace, arch string) protocol.ID {
+	return protocolPrefix(namespace) + "/architecture/1.0.0/" + protocol.ID(arch)
+}
+
+// newArchitectureHandler returns a stream handler for the architecture protocol, which only has to be
+// advertised as the architecture is part of the protocol ID.
+func newArchitectureHandler() network.StreamHandler {
+	return func(s network.Stream) {
+		//nolint: errcheck // Nothing is exchanged over the stream.
+		s.Close()
+	}
+}
+
+// peerArchitecture returns the architecture advertised by the peer, empty when unknown.
+func peerArchitecture(ps peerstore.Peerstore, namespace string, id peer.ID) string {
+	protocols, err := ps.GetProtocols(id)
+	if err != nil {
+		return ""
+	}
+	prefix := string(architectureProtocol(namespace, ""))
+	for _, p := range protocols {
+		arch, ok := strings.CutPrefix(string(p), prefix)
+		if ok && arch != "" {
+			return arch
+		}
+	}
+	return ""
+}
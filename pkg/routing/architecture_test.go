@@ -0,0 +1,63 @@
+package routing
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerArchitecture(t *testing.T) {
+	t.Parallel()
+
+	routers := []*P2PRouter{}
+	for _, arch := range []string{"amd64", "arm64", "amd64", ""} {
+		opts := []P2PRouterOption{}
+		if arch != "" {
+			opts = append(opts, WithArchitecture(arch))
+		}
+		r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", opts...)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.host.Close()
+		})
+		routers = append(routers, r)
+	}
+	for _, r := range routers[1:] {
+		err := routers[0].host.Connect(t.Context(), *host.InfoFromHost(r.host))
+		require.NoError(t, err)
+	}
+
+	// Architecture is shared when peers connect, peers not sharing their architecture are unknown.
+	expected := []string{"arm64", "amd64", ""}
+	for i, r := range routers[1:] {
+		require.Eventually(t, func() bool {
+			return peerArchitecture(routers[0].host.Peerstore(), "", r.host.ID()) == expected[i]
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	protocols, err := routers[0].host.Peerstore().GetProtocols(routers[3].host.ID())
+	require.NoError(t, err)
+	require.NotEmpty(t, protocols)
+	require.Empty(t, peerArchitecture(routers[0].host.Peerstore(), "", routers[3].host.ID()))
+	require.Empty(t, peerArchitecture(routers[0].host.Peerstore(), "", generatePeerID(t)))
+
+	pb := NewPreferBalancer(NewRoundRobin(), func(peer PeerInfo) bool {
+		return peer.Architecture == routers[0].architecture
+	})
+	for i, r := range routers[1:] {
+		pb.Add(PeerInfo{
+			ID:           r.host.ID().String(),
+			Addr:         netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(5000+i)),
+			Architecture: peerArchitecture(routers[0].host.Peerstore(), "", r.host.ID()),
+		})
+	}
+
+	// Peers with the same architecture are preferred over peers with another or unknown architecture.
+	for range 3 {
+		peer, err := pb.Next()
+		require.NoError(t, err)
+		require.Equal(t, routers[2].host.ID().String(), peer.ID)
+	}
+}
@@ -3,8 +3,6 @@ package routing
 import (
 	"context"
 	"errors"
-	"net/netip"
-	"slices"
 	"sync"
 )
 
@@ -13,19 +11,25 @@ var ErrNoNext = errors.New("no peers available for selection")
 // Balancer defines how peers looked up are returned.
 type Balancer interface {
 	// Next returns the next peer.
-	Next() (netip.AddrPort, error)
+	Next() (PeerInfo, error)
 	// Size returns the amount of peers.
 	Size() int
-	// Add adds a peer to the balancer.
-	Add(netip.AddrPort)
-	// Remove removes the peer from the balancer.
-	Remove(netip.AddrPort)
+	// Add adds a peer to the balancer, peers with the same address, or ID when reached over a stream, are updated.
+	Add(PeerInfo)
+	// Remove removes the peer with the same address, or ID when reached over a stream, from the balancer.
+	Remove(PeerInfo)
+}
+
+// waiter is implemented by balancers which peers are added to while being used.
+type waiter interface {
+	// wait waits for a peer to be added when the balancer has the given size, returning false when no peer will be added.
+	wait(size int) bool
 }
 
 var _ Balancer = &RoundRobin{}
 
 type RoundRobin struct {
-	peers   []netip.AddrPort
+	peers   []PeerInfo
 	nextIdx int
 	peerMx  sync.Mutex
 }
@@ -35,25 +39,31 @@ func NewRoundRobin() *RoundRobin {
 }
 
 func (rr *RoundRobin) Size() int {
+	rr.peerMx.Lock()
+	defer rr.peerMx.Unlock()
+
 	return len(rr.peers)
 }
 
-func (rr *RoundRobin) Add(item netip.AddrPort) {
+func (rr *RoundRobin) Add(item PeerInfo) {
 	rr.peerMx.Lock()
 	defer rr.peerMx.Unlock()
 
-	if slices.Contains(rr.peers, item) {
-		return
+	for i, v := range rr.peers {
+		if samePeer(v, item) {
+			rr.peers[i] = item
+			return
+		}
 	}
 	rr.peers = append(rr.peers, item)
 }
 
-func (rr *RoundRobin) Remove(item netip.AddrPort) {
+func (rr *RoundRobin) Remove(item PeerInfo) {
 	rr.peerMx.Lock()
 	defer rr.peerMx.Unlock()
 
 	for i, v := range rr.peers {
-		if v == item {
+		if samePeer(v, item) {
 			rr.peers = append(rr.peers[:i], rr.peers[i+1:]...)
 			if rr.nextIdx > i {
 				rr.nextIdx--
@@ -65,18 +75,62 @@ func (rr *RoundRobin) Remove(item netip.AddrPort) {
 	}
 }
 
-func (rr *RoundRobin) Next() (netip.AddrPort, error) {
+// Next returns the next peer in order, skipping overloaded peers unless all peers are overloaded.
+func (rr *RoundRobin) Next() (PeerInfo, error) {
 	rr.peerMx.Lock()
 	defer rr.peerMx.Unlock()
 
 	if len(rr.peers) == 0 {
-		return netip.AddrPort{}, ErrNoNext
+		return PeerInfo{}, ErrNoNext
+	}
+	idx := rr.nextIdx
+	for i := range len(rr.peers) {
+		candidate := (rr.nextIdx + i) % len(rr.peers)
+		if !rr.peers[candidate].Overloaded {
+			idx = candidate
+			break
+		}
 	}
-	item := rr.peers[rr.nextIdx]
-	rr.nextIdx = (rr.nextIdx + 1) % len(rr.peers)
+	item := rr.peers[idx]
+	rr.nextIdx = (idx + 1) % len(rr.peers)
 	return item, nil
 }
 
+var _ Balancer = &PreferBalancer{}
+
+// PreferBalancer returns preferred peers before other peers, other peers are only returned when none
+// of the peers in the balancer are preferred. Balancers which peers are added to are waited on for a
+// preferred peer until no more peers will be added.
+type PreferBalancer struct {
+	Balancer
+	prefer func(PeerInfo) bool
+}
+
+func NewPreferBalancer(balancer Balancer, prefer func(PeerInfo) bool) *PreferBalancer {
+	return &PreferBalancer{
+		Balancer: balancer,
+		prefer:   prefer,
+	}
+}
+
+func (pb *PreferBalancer) Next() (PeerInfo, error) {
+	for {
+		size := pb.Size()
+		// Iterate all peers once to look for a preferred peer.
+		for range max(size, 1) {
+			peer, err := pb.Balancer.Next()
+			if err != nil || pb.prefer(peer) {
+				return peer, err
+			}
+		}
+		w, ok := pb.Balancer.(waiter)
+		if !ok || !w.wait(size) {
+			// Iterating all peers returns to the first peer, which is skipped so that other peers are returned in turn.
+			return pb.Balancer.Next()
+		}
+	}
+}
+
 var _ Balancer = &ClosableBalancer{}
 
 type ClosableBalancer struct {
@@ -96,7 +150,7 @@ func NewClosableBalancer(balancer Balancer) *ClosableBalancer {
 	}
 }
 
-func (cb *ClosableBalancer) Add(item netip.AddrPort) {
+func (cb *ClosableBalancer) Add(item PeerInfo) {
 	cb.Balancer.Add(item)
 
 	cb.waitersMx.Lock()
@@ -107,7 +161,12 @@ func (cb *ClosableBalancer) Add(item netip.AddrPort) {
 	cb.waitersMx.Unlock()
 }
 
-func (cb *ClosableBalancer) Next() (netip.AddrPort, error) {
+func (cb *ClosableBalancer) Next() (PeerInfo, error) {
+	return cb.next(context.Background())
+}
+
+// next waits for a peer to be added until the balancer is closed or the context is done.
+func (cb *ClosableBalancer) next(ctx context.Context) (PeerInfo, error) {
 	for {
 		cb.waitersMx.Lock()
 		peer, err := cb.Balancer.Next()
@@ -118,19 +177,73 @@ func (cb *ClosableBalancer) Next() (netip.AddrPort, error) {
 
 			select {
 			case <-cb.closeCtx.Done():
-				return netip.AddrPort{}, ErrNoNext
+				return PeerInfo{}, ErrNoNext
+			case <-ctx.Done():
+				return PeerInfo{}, ErrNoNext
 			case <-ch:
 				continue
 			}
 		}
 		cb.waitersMx.Unlock()
 		if err != nil {
-			return netip.AddrPort{}, err
+			return PeerInfo{}, err
 		}
 		return peer, nil
 	}
 }
 
+func (cb *ClosableBalancer) wait(size int) bool {
+	return cb.waitAdd(context.Background(), size)
+}
+
+// waitAdd waits for a peer to be added when the balancer has the given size, returning false when the balancer
+// is closed or the context is done.
+func (cb *ClosableBalancer) waitAdd(ctx context.Context, size int) bool {
+	cb.waitersMx.Lock()
+	if cb.Balancer.Size() != size {
+		cb.waitersMx.Unlock()
+		return true
+	}
+	ch := make(chan any)
+	cb.waiters = append(cb.waiters, ch)
+	cb.waitersMx.Unlock()
+
+	select {
+	case <-cb.closeCtx.Done():
+		return false
+	case <-ctx.Done():
+		return false
+	case <-ch:
+		return true
+	}
+}
+
 func (cb *ClosableBalancer) Close() {
 	cb.closeFunc()
 }
+
+var _ Balancer = &contextBalancer{}
+
+// contextBalancer stops waiting for peers to be added to a shared balancer when the context is done,
+// without closing the shared balancer for other callers.
+type contextBalancer struct {
+	*ClosableBalancer
+	ctx context.Context
+	// metadata returns the metadata of the key, which may be known after peers were added.
+	metadata func() Metadata
+}
+
+func (cb *contextBalancer) Next() (PeerInfo, error) {
+	peer, err := cb.next(cb.ctx)
+	if err != nil {
+		return PeerInfo{}, err
+	}
+	if !peer.Metadata.IsValid() && cb.metadata != nil {
+		peer.Metadata = cb.metadata()
+	}
+	return peer, nil
+}
+
+func (cb *contextBalancer) wait(size int) bool {
+	return cb.waitAdd(cb.ctx, size)
+}
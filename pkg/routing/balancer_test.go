@@ -1,6 +1,154 @@
 package routing
 
-import "testing"
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundRobin(t *testing.T) {
+	t.Parallel()
+
+	rr := NewRoundRobin()
+	_, err := rr.Next()
+	require.ErrorIs(t, err, ErrNoNext)
+
+	first := PeerInfo{ID: "first", Addr: netip.MustParseAddrPort("10.0.0.1:5000")}
+	second := PeerInfo{ID: "second", Addr: netip.MustParseAddrPort("10.0.0.2:5000")}
+	rr.Add(first)
+	rr.Add(second)
+	require.Equal(t, 2, rr.Size())
+
+	// Adding a peer with the same address should update it.
+	updated := PeerInfo{ID: "first", Addr: first.Addr, Seen: time.Now()}
+	rr.Add(updated)
+	require.Equal(t, 2, rr.Size())
+	peer, err := rr.Next()
+	require.NoError(t, err)
+	require.Equal(t, updated, peer)
+	peer, err = rr.Next()
+	require.NoError(t, err)
+	require.Equal(t, second, peer)
+
+	// Removing should match the address.
+	rr.Remove(PeerInfo{Addr: first.Addr})
+	require.Equal(t, 1, rr.Size())
+	peer, err = rr.Next()
+	require.NoError(t, err)
+	require.Equal(t, second, peer)
+
+	// Stream peers without an address should match the ID.
+	relayedFirst := PeerInfo{ID: "relayed-first", Stream: true}
+	relayedSecond := PeerInfo{ID: "relayed-second", Stream: true}
+	rr.Add(relayedFirst)
+	rr.Add(relayedSecond)
+	require.Equal(t, 3, rr.Size())
+	rr.Remove(PeerInfo{ID: "relayed-first"})
+	require.Equal(t, 2, rr.Size())
+	rr.Remove(second)
+	peer, err = rr.Next()
+	require.NoError(t, err)
+	require.Equal(t, relayedSecond, peer)
+}
+
+func TestRoundRobinOverloaded(t *testing.T) {
+	t.Parallel()
+
+	rr := NewRoundRobin()
+	overloaded := PeerInfo{Addr: netip.MustParseAddrPort("10.0.0.1:5000"), Overloaded: true}
+	available := PeerInfo{Addr: netip.MustParseAddrPort("10.0.0.2:5000")}
+	rr.Add(overloaded)
+	rr.Add(available)
+
+	// Overloaded peers should be skipped while other peers are available.
+	for range 3 {
+		peer, err := rr.Next()
+		require.NoError(t, err)
+		require.Equal(t, available, peer)
+	}
+
+	// Overloaded peers should be returned when no other peers are available.
+	rr.Remove(available)
+	peer, err := rr.Next()
+	require.NoError(t, err)
+	require.Equal(t, overloaded, peer)
+}
+
+func TestPreferBalancer(t *testing.T) {
+	t.Parallel()
+
+	pb := NewPreferBalancer(NewRoundRobin(), func(peer PeerInfo) bool {
+		return peer.Architecture == "arm64"
+	})
+	_, err := pb.Next()
+	require.ErrorIs(t, err, ErrNoNext)
+
+	// Other peers are returned when no peer is preferred.
+	amd64 := PeerInfo{Addr: netip.MustParseAddrPort("10.0.0.1:5000"), Architecture: "amd64"}
+	unknown := PeerInfo{Addr: netip.MustParseAddrPort("10.0.0.2:5000")}
+	pb.Add(amd64)
+	pb.Add(unknown)
+	peer, err := pb.Next()
+	require.NoError(t, err)
+	require.Equal(t, amd64, peer)
+	peer, err = pb.Next()
+	require.NoError(t, err)
+	require.Equal(t, unknown, peer)
+
+	// Preferred peers are returned before other peers.
+	arm64 := PeerInfo{Addr: netip.MustParseAddrPort("10.0.0.3:5000"), Architecture: "arm64"}
+	pb.Add(arm64)
+	for range 3 {
+		peer, err = pb.Next()
+		require.NoError(t, err)
+		require.Equal(t, arm64, peer)
+	}
+	pb.Remove(arm64)
+	peer, err = pb.Next()
+	require.NoError(t, err)
+	require.NotEqual(t, arm64, peer)
+}
+
+func TestPreferBalancerWait(t *testing.T) {
+	t.Parallel()
+
+	cb := NewClosableBalancer(NewRoundRobin())
+	amd64 := PeerInfo{Addr: netip.MustParseAddrPort("10.0.0.1:5000"), Architecture: "amd64"}
+	cb.Add(amd64)
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	pb := NewPreferBalancer(&contextBalancer{ClosableBalancer: cb, ctx: ctx}, func(peer PeerInfo) bool {
+		return peer.Architecture == "arm64"
+	})
+
+	// Preferred peers added while waiting are returned.
+	arm64 := PeerInfo{Addr: netip.MustParseAddrPort("10.0.0.2:5000"), Architecture: "arm64"}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cb.Add(arm64)
+	}()
+	peer, err := pb.Next()
+	require.NoError(t, err)
+	require.Equal(t, arm64, peer)
+
+	// Other peers are returned once no more peers will be added.
+	cb.Remove(arm64)
+	cancel()
+	peer, err = pb.Next()
+	require.NoError(t, err)
+	require.Equal(t, amd64, peer)
+	cb.Close()
+	pb = NewPreferBalancer(cb, func(peer PeerInfo) bool {
+		return peer.Architecture == "arm64"
+	})
+	peer, err = pb.Next()
+	require.NoError(t, err)
+	require.Equal(t, amd64, peer)
+}
 
 func TestClosableBalancer(t *testing.T) {
 	t.Parallel()
@@ -11,3 +159,35 @@ func TestClosableBalancer(t *testing.T) {
 		cb.Close()
 	}
 }
+
+func TestContextBalancer(t *testing.T) {
+	t.Parallel()
+
+	cb := NewClosableBalancer(NewRoundRobin())
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	bal := &contextBalancer{ClosableBalancer: cb, ctx: ctx}
+
+	// Waiting for peers stops when the context is done without closing the shared balancer.
+	start := time.Now()
+	_, err := bal.Next()
+	require.ErrorIs(t, err, ErrNoNext)
+	require.Less(t, time.Since(start), time.Second)
+	require.NoError(t, cb.closeCtx.Err())
+
+	// Peers added to the shared balancer are still returned.
+	peer := PeerInfo{Addr: netip.MustParseAddrPort("10.0.0.1:5000")}
+	cb.Add(peer)
+	next, err := bal.Next()
+	require.NoError(t, err)
+	require.Equal(t, peer, next)
+
+	// Metadata known after peers were added is set on returned peers.
+	metadata := Metadata{MediaType: "application/octet-stream", Digest: digest.FromString("foo"), Size: 3}
+	bal.metadata = func() Metadata {
+		return metadata
+	}
+	next, err = bal.Next()
+	require.NoError(t, err)
+	require.Equal(t, metadata, next.Metadata)
+}
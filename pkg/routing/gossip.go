@@ -0,0 +1,737 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/spegel-org/spegel/internal/option"
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+const (
+	maxGossipMessageSize   = 32 * 1024 * 1024
+	gossipRemoveMultiplier = 5
+	gossipBootstrapDelay   = 10 * time.Second
+)
+
+type GossipRouterConfig struct {
+	P2PRouterOpts  []P2PRouterOption
+	GossipInterval time.Duration
+	PeerTimeout    time.Duration
+	Fanout         int
+}
+
+type GossipRouterOption = option.Option[GossipRouterConfig]
+
+// WithHostOptions sets the P2P router options used to create the libp2p host.
+// Options like data directory, libp2p options, namespace, and membership are shared with the P2P router.
+func WithHostOptions(opts ...P2PRouterOption) GossipRouterOption {
+	return func(cfg *GossipRouterConfig) error {
+		cfg.P2PRouterOpts = opts
+		return nil
+	}
+}
+
+// WithGossipInterval sets how often the local state is exchanged with random peers.
+func WithGossipInterval(interval time.Duration) GossipRouterOption {
+	return func(cfg *GossipRouterConfig) error {
+		if interval <= 0 {
+			return errors.New("gossip interval has to be greater than zero")
+		}
+		cfg.GossipInterval = interval
+		return nil
+	}
+}
+
+// WithPeerTimeout sets the duration after which a peer without a heartbeat is considered dead.
+func WithPeerTimeout(timeout time.Duration) GossipRouterOption {
+	return func(cfg *GossipRouterConfig) error {
+		if timeout <= 0 {
+			return errors.New("peer timeout has to be greater than zero")
+		}
+		cfg.PeerTimeout = timeout
+		return nil
+	}
+}
+
+// WithFanout sets the amount of peers to gossip with every interval.
+func WithFanout(fanout int) GossipRouterOption {
+	return func(cfg *GossipRouterConfig) error {
+		if fanout <= 0 {
+			return errors.New("fanout has to be greater than zero")
+		}
+		cfg.Fanout = fanout
+		return nil
+	}
+}
+
+type gossipDigest struct {
+	Version   uint64 `json:"version"`
+	Heartbeat uint64 `json:"heartbeat"`
+}
+
+type gossipEntry struct {
+	Metadata  map[string]Metadata `json:"metadata,omitempty"`
+	ID        peer.ID             `json:"id"`
+	Addrs     []string            `json:"addrs,omitempty"`
+	Keys      []string            `json:"keys,omitempty"`
+	Version   uint64              `json:"version"`
+	Heartbeat uint64              `json:"heartbeat"`
+}
+
+type gossipMessage struct {
+	Digests  map[peer.ID]gossipDigest `json:"digests,omitempty"`
+	Entries  []gossipEntry            `json:"entries,omitempty"`
+	Requests []peer.ID                `json:"requests,omitempty"`
+}
+
+type gossipState struct {
+	updated time.Time
+	keys    map[string]Metadata
+	addrs   []ma.Multiaddr
+	gossipDigest
+}
+
+type gossipTombstone struct {
+	removed time.Time
+	gossipDigest
+}
+
+var _ MetadataRouter = &GossipRouter{}
+
+// GossipRouter is a router where every node gossips its full key set to all other nodes.
+// Each node has a complete local view of the cluster which makes lookups instant, at the
+// cost of state growing with the cluster size. It is meant to be used in small clusters.
+type GossipRouter struct {
+	bootstrapper           Bootstrapper
+	host                   host.Host
+	membership             *Membership
+	states                 map[peer.ID]*gossipState
+	tombstones             map[peer.ID]gossipTombstone
+	protocolID             protocol.ID
+	protocols              []ma.Multiaddr
+	addrSelector           addrSelector
+	gossipInterval         time.Duration
+	peerTimeout            time.Duration
+	fanout                 int
+	mx                     sync.RWMutex
+	ip6Support, ip4Support bool
+	registryPort           uint16
+}
+
+func NewGossipRouter(ctx context.Context, addr string, bs Bootstrapper, registryPortStr string, opts ...GossipRouterOption) (*GossipRouter, error) {
+	cfg := GossipRouterConfig{
+		GossipInterval: time.Second,
+		PeerTimeout:    30 * time.Second,
+		Fanout:         3,
+	}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	p2pCfg := P2PRouterConfig{}
+	err = option.Apply(&p2pCfg, cfg.P2PRouterOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	registryPort, err := strconv.ParseUint(registryPortStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	selector, err := newAddrSelector(p2pCfg)
+	if err != nil {
+		return nil, err
+	}
+	host, err := newHost(ctx, addr, p2pCfg, selector)
+	if err != nil {
+		return nil, err
+	}
+	ip6Addrs, ip4Addrs := filterAndSplitAddrs(host.Addrs(), p2pCfg.AllowLoopback)
+
+	r := &GossipRouter{
+		bootstrapper: bs,
+		host:         host,
+		membership:   p2pCfg.Membership,
+		states: map[peer.ID]*gossipState{
+			host.ID(): {
+				gossipDigest: gossipDigest{
+					// Start version from the current time so that state after a restart supersedes the previous state.
+					Version: uint64(time.Now().UnixNano()),
+				},
+				keys:    map[string]Metadata{},
+				addrs:   host.Addrs(),
+				updated: time.Now(),
+			},
+		},
+		tombstones:     map[peer.ID]gossipTombstone{},
+		protocolID:     protocolPrefix(p2pCfg.Namespace) + "/gossip/1.0.0",
+		protocols:      protocolsFromAddrs(host.Addrs()),
+		gossipInterval: cfg.GossipInterval,
+		peerTimeout:    cfg.PeerTimeout,
+		fanout:         cfg.Fanout,
+		ip6Support:     len(ip6Addrs) > 0,
+		ip4Support:     len(ip4Addrs) > 0,
+		addrSelector:   selector,
+		registryPort:   uint16(registryPort),
+	}
+	return r, nil
+}
+
+func (r *GossipRouter) Host() host.Host {
+	return r.host
+}
+
+func (r *GossipRouter) ID() string {
+	return r.host.ID().String()
+}
+
+func (r *GossipRouter) Run(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("gossip")
+	log.Info("starting gossip router", "id", r.host.ID())
+
+	r.host.SetStreamHandler(r.protocolID, func(s network.Stream) {
+		defer s.Close()
+		err := r.handleStream(ctx, s)
+		if err != nil {
+			//nolint: errcheck // Ignore error as stream is already failing.
+			s.Reset()
+			// Streams are expected to fail when shutting down.
+			if ctx.Err() == nil {
+				log.Error(err, "could not handle gossip stream", "peer", s.Conn().RemotePeer())
+			}
+		}
+	})
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		err := r.bootstrapper.Run(gCtx, *host.InfoFromHost(r.host))
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	g.Go(func() error {
+		for {
+			if len(r.host.Network().Peers()) == 0 {
+				err := connectBootstrapPeers(gCtx, r.bootstrapper, r.host, r.protocols)
+				if err != nil {
+					log.Error(err, "could not connect to bootstrap peers")
+				}
+			}
+			select {
+			case <-gCtx.Done():
+				return nil
+			case <-time.After(gossipBootstrapDelay):
+			}
+		}
+	})
+	g.Go(func() error {
+		ticker := time.NewTicker(r.gossipInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-gCtx.Done():
+				return nil
+			case <-ticker.C:
+				r.tick(gCtx)
+			}
+		}
+	})
+
+	errs := []error{}
+	err := g.Wait()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	r.host.RemoveStreamHandler(r.protocolID)
+	err = r.host.Close()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (r *GossipRouter) Ready(ctx context.Context) (bool, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	now := time.Now()
+	for id, state := range r.states {
+		if id == r.host.ID() {
+			continue
+		}
+		if r.isLive(state, now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *GossipRouter) Lookup(ctx context.Context, key string, count int) (Balancer, error) {
+	log := logr.FromContextOrDiscard(ctx).WithValues("host", r.host.ID().String(), "key", key)
+
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	rr := NewRoundRobin()
+	now := time.Now()
+	for id, state := range r.states {
+		if count > 0 && rr.Size() >= count {
+			break
+		}
+		if id == r.host.ID() || !r.isLive(state, now) {
+			continue
+		}
+		if r.membership != nil && !r.membership.IsMember(id) {
+			continue
+		}
+		metadata, ok := state.keys[key]
+		if !ok {
+			continue
+		}
+		ipAddr, err := r.addrSelector.selectIPAddr(state.addrs, r.ip6Support, r.ip4Support)
+		if err != nil {
+			log.Error(err, "no suitable IP address found for peer", "peer", id.String())
+			continue
+		}
+		rr.Add(PeerInfo{
+			ID:       id.String(),
+			Addr:     netip.AddrPortFrom(ipAddr, r.registryPort),
+			Seen:     state.updated,
+			Metadata: metadata,
+		})
+	}
+	return rr, nil
+}
+
+func (r *GossipRouter) Advertise(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	self := r.states[r.host.ID()]
+	changed := false
+	for _, key := range keys {
+		if _, ok := self.keys[key]; ok {
+			continue
+		}
+		self.keys[key] = Metadata{}
+		changed = true
+	}
+	if changed {
+		self.Version++
+	}
+	return nil
+}
+
+// AdvertiseMetadata advertises the keys with the metadata gossiped to all other peers.
+func (r *GossipRouter) AdvertiseMetadata(ctx context.Context, metadata map[string]Metadata) error {
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	self := r.states[r.host.ID()]
+	changed := false
+	for key, m := range metadata {
+		if v, ok := self.keys[key]; ok && v == m {
+			continue
+		}
+		self.keys[key] = m
+		changed = true
+	}
+	if changed {
+		self.Version++
+	}
+	return nil
+}
+
+func (r *GossipRouter) Withdraw(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	self := r.states[r.host.ID()]
+	changed := false
+	for _, key := range keys {
+		if _, ok := self.keys[key]; !ok {
+			continue
+		}
+		delete(self.keys, key)
+		changed = true
+	}
+	if changed {
+		self.Version++
+	}
+	return nil
+}
+
+// WithdrawAll stops advertising all keys, peers are notified through the next gossip rounds.
+func (r *GossipRouter) WithdrawAll(ctx context.Context) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	self := r.states[r.host.ID()]
+	if len(self.keys) == 0 {
+		return nil
+	}
+	self.keys = map[string]Metadata{}
+	self.Version++
+	return nil
+}
+
+func (r *GossipRouter) ListPeers() ([]Peer, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	peers := []Peer{}
+	now := time.Now()
+	for id, state := range r.states {
+		if id == r.host.ID() || !r.isLive(state, now) {
+			continue
+		}
+		peer := Peer{ID: id.String()}
+		for _, addr := range state.addrs {
+			ipAddr, err := toIPAddr(addr)
+			if err != nil {
+				continue
+			}
+			peer.Addresses = append(peer.Addresses, ipAddr.String())
+		}
+		if len(peer.Addresses) == 0 {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+func (r *GossipRouter) LocalAddresses() []string {
+	localAddrs := []string{}
+	for _, addr := range r.host.Addrs() {
+		localAddr, err := toIPAddr(addr)
+		if err != nil {
+			continue
+		}
+		localAddrs = append(localAddrs, localAddr.String())
+	}
+	return localAddrs
+}
+
+func (r *GossipRouter) tick(ctx context.Context) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	now := time.Now()
+	r.mx.Lock()
+	self := r.states[r.host.ID()]
+	self.Heartbeat++
+	self.addrs = r.host.Addrs()
+	self.updated = now
+	r.removeExpired(now)
+	targets := map[peer.ID]any{}
+	for _, id := range r.host.Network().Peers() {
+		targets[id] = nil
+	}
+	for id, state := range r.states {
+		if id == r.host.ID() || !r.isLive(state, now) {
+			continue
+		}
+		r.host.Peerstore().AddAddrs(id, state.addrs, peerstore.TempAddrTTL)
+		targets[id] = nil
+	}
+	r.mx.Unlock()
+
+	ids := slices.Collect(maps.Keys(targets))
+	rand.Shuffle(len(ids), func(i, j int) {
+		ids[i], ids[j] = ids[j], ids[i]
+	})
+	ids = ids[:min(r.fanout, len(ids))]
+	wg := sync.WaitGroup{}
+	for _, id := range ids {
+		wg.Go(func() {
+			gossipCtx, cancel := context.WithTimeout(ctx, r.gossipInterval*5)
+			defer cancel()
+			err := r.gossip(gossipCtx, id)
+			if err != nil {
+				log.V(1).Info("could not gossip with peer", "peer", id.String(), "err", err.Error())
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// gossip performs a push pull exchange with the peer.
+// The local digests are sent to the peer which responds with newer entries and requests
+// for entries where the local state is newer. The requested entries are finally sent to the peer.
+func (r *GossipRouter) gossip(ctx context.Context, id peer.ID) error {
+	if r.membership != nil && !r.membership.Verify(ctx, peer.AddrInfo{ID: id}) {
+		return errors.New("peer is not a member")
+	}
+	s, err := r.host.NewStream(ctx, id, r.protocolID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	deadline, ok := ctx.Deadline()
+	if ok {
+		err := s.SetDeadline(deadline)
+		if err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(s)
+	dec := json.NewDecoder(io.LimitReader(s, maxGossipMessageSize))
+	err = enc.Encode(gossipMessage{Digests: r.digests()})
+	if err != nil {
+		return err
+	}
+	resp := gossipMessage{}
+	err = dec.Decode(&resp)
+	if err != nil {
+		return err
+	}
+	r.merge(ctx, resp.Entries)
+	err = enc.Encode(gossipMessage{Entries: r.entries(resp.Requests)})
+	if err != nil {
+		return err
+	}
+	return s.CloseWrite()
+}
+
+func (r *GossipRouter) handleStream(ctx context.Context, s network.Stream) error {
+	if r.membership != nil && !r.membership.Verify(ctx, peer.AddrInfo{ID: s.Conn().RemotePeer()}) {
+		return errors.New("peer is not a member")
+	}
+	err := s.SetDeadline(time.Now().Add(r.gossipInterval * 5))
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(s)
+	dec := json.NewDecoder(io.LimitReader(s, maxGossipMessageSize))
+	req := gossipMessage{}
+	err = dec.Decode(&req)
+	if err != nil {
+		return err
+	}
+	err = enc.Encode(r.diff(req.Digests))
+	if err != nil {
+		return err
+	}
+	final := gossipMessage{}
+	err = dec.Decode(&final)
+	if err != nil {
+		return err
+	}
+	r.merge(ctx, final.Entries)
+	return nil
+}
+
+func (r *GossipRouter) digests() map[peer.ID]gossipDigest {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	digests := map[peer.ID]gossipDigest{}
+	for id, state := range r.states {
+		digests[id] = state.gossipDigest
+	}
+	return digests
+}
+
+// diff returns the entries that are newer locally and requests entries that are newer remotely.
+func (r *GossipRouter) diff(digests map[peer.ID]gossipDigest) gossipMessage {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	msg := gossipMessage{}
+	for id, state := range r.states {
+		digest, ok := digests[id]
+		switch {
+		case !ok || state.Version > digest.Version:
+			msg.Entries = append(msg.Entries, newGossipEntry(id, state, true))
+		case state.Version == digest.Version && state.Heartbeat > digest.Heartbeat:
+			msg.Entries = append(msg.Entries, newGossipEntry(id, state, false))
+		}
+	}
+	for id, digest := range digests {
+		state, ok := r.states[id]
+		if ok && state.Version >= digest.Version {
+			continue
+		}
+		msg.Requests = append(msg.Requests, id)
+	}
+	return msg
+}
+
+func (r *GossipRouter) entries(ids []peer.ID) []gossipEntry {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	entries := []gossipEntry{}
+	for _, id := range ids {
+		state, ok := r.states[id]
+		if !ok {
+			continue
+		}
+		entries = append(entries, newGossipEntry(id, state, true))
+	}
+	return entries
+}
+
+// merge merges the entries of members into the local state, entries of peers that are not members are dropped.
+func (r *GossipRouter) merge(ctx context.Context, entries []gossipEntry) {
+	entries = r.memberEntries(ctx, entries)
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.ID == r.host.ID() {
+			continue
+		}
+		if tombstone, ok := r.tombstones[entry.ID]; ok {
+			if !isNewer(entry.Version, entry.Heartbeat, tombstone.gossipDigest) {
+				continue
+			}
+			delete(r.tombstones, entry.ID)
+		}
+		state, ok := r.states[entry.ID]
+		if !ok || entry.Version > state.Version {
+			keys := map[string]Metadata{}
+			for _, key := range entry.Keys {
+				keys[key] = entry.Metadata[key]
+			}
+			state = &gossipState{
+				keys: keys,
+			}
+			r.states[entry.ID] = state
+		} else if !isNewer(entry.Version, entry.Heartbeat, state.gossipDigest) {
+			continue
+		}
+		addrs := []ma.Multiaddr{}
+		for _, addrStr := range entry.Addrs {
+			addr, err := ma.NewMultiaddr(addrStr)
+			if err != nil {
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+		state.addrs = addrs
+		state.Version = entry.Version
+		state.Heartbeat = entry.Heartbeat
+		state.updated = now
+	}
+}
+
+// memberEntries returns the entries of peers that are members. Unknown peers are verified before taking the
+// state lock, as verification requests the certificate from the peer.
+func (r *GossipRouter) memberEntries(ctx context.Context, entries []gossipEntry) []gossipEntry {
+	if r.membership == nil {
+		return entries
+	}
+	members := []gossipEntry{}
+	for _, entry := range entries {
+		addrInfo := peer.AddrInfo{ID: entry.ID}
+		for _, addrStr := range entry.Addrs {
+			addr, err := ma.NewMultiaddr(addrStr)
+			if err != nil {
+				continue
+			}
+			addrInfo.Addrs = append(addrInfo.Addrs, addr)
+		}
+		if !r.membership.Verify(ctx, addrInfo) {
+			metrics.RouterRejectedPeersTotal.WithLabelValues("gossip").Inc()
+			continue
+		}
+		members = append(members, entry)
+	}
+	return members
+}
+
+// removeExpired removes states that have not been updated for a long time.
+// A tombstone is kept to avoid stale entries from other peers adding the state back.
+// Callers must hold the write lock.
+func (r *GossipRouter) removeExpired(now time.Time) {
+	removeTimeout := r.peerTimeout * gossipRemoveMultiplier
+	for id, state := range r.states {
+		if id == r.host.ID() || now.Sub(state.updated) <= removeTimeout {
+			continue
+		}
+		delete(r.states, id)
+		r.tombstones[id] = gossipTombstone{
+			gossipDigest: state.gossipDigest,
+			removed:      now,
+		}
+	}
+	for id, tombstone := range r.tombstones {
+		if now.Sub(tombstone.removed) <= removeTimeout {
+			continue
+		}
+		delete(r.tombstones, id)
+	}
+}
+
+func (r *GossipRouter) isLive(state *gossipState, now time.Time) bool {
+	return now.Sub(state.updated) <= r.peerTimeout
+}
+
+func newGossipEntry(id peer.ID, state *gossipState, full bool) gossipEntry {
+	entry := gossipEntry{
+		ID:        id,
+		Version:   state.Version,
+		Heartbeat: state.Heartbeat,
+	}
+	for _, addr := range state.addrs {
+		entry.Addrs = append(entry.Addrs, addr.String())
+	}
+	if full {
+		entry.Keys = slices.Collect(maps.Keys(state.keys))
+		for key, metadata := range state.keys {
+			if !metadata.IsValid() {
+				continue
+			}
+			if entry.Metadata == nil {
+				entry.Metadata = map[string]Metadata{}
+			}
+			entry.Metadata[key] = metadata
+		}
+	}
+	return entry
+}
+
+func isNewer(version, heartbeat uint64, digest gossipDigest) bool {
+	if version != digest.Version {
+		return version > digest.Version
+	}
+	return heartbeat > digest.Heartbeat
+}
@@ -0,0 +1,243 @@
+package routing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	tlog "github.com/go-logr/logr/testing"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/spegel-org/spegel/internal/option"
+)
+
+func TestGossipRouterOptions(t *testing.T) {
+	t.Parallel()
+
+	opts := []GossipRouterOption{
+		WithHostOptions(WithDataDir("foobar")),
+		WithGossipInterval(2 * time.Second),
+		WithPeerTimeout(time.Minute),
+		WithFanout(5),
+	}
+	cfg := GossipRouterConfig{}
+	err := option.Apply(&cfg, opts...)
+	require.NoError(t, err)
+	require.Len(t, cfg.P2PRouterOpts, 1)
+	require.Equal(t, 2*time.Second, cfg.GossipInterval)
+	require.Equal(t, time.Minute, cfg.PeerTimeout)
+	require.Equal(t, 5, cfg.Fanout)
+
+	err = option.Apply(&cfg, WithFanout(0))
+	require.EqualError(t, err, "fanout has to be greater than zero")
+}
+
+func TestGossipRouter(t *testing.T) {
+	t.Parallel()
+
+	log := tlog.NewTestLogger(t)
+	ctx := logr.NewContext(t.Context(), log)
+	ctx, cancel := context.WithCancel(ctx)
+	g, gCtx := errgroup.WithContext(ctx)
+
+	opts := []GossipRouterOption{
+		WithGossipInterval(100 * time.Millisecond),
+		WithPeerTimeout(time.Second),
+	}
+	primaryRouter, err := NewGossipRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", opts...)
+	require.NoError(t, err)
+	g.Go(func() error {
+		return primaryRouter.Run(gCtx)
+	})
+	ready, err := primaryRouter.Ready(t.Context())
+	require.NoError(t, err)
+	require.False(t, ready)
+
+	routers := []*GossipRouter{}
+	for range 5 {
+		bs := NewStaticBootstrapper([]peer.AddrInfo{*host.InfoFromHost(primaryRouter.host)})
+		r, err := NewGossipRouter(t.Context(), "localhost:0", bs, "9090", opts...)
+		require.NoError(t, err)
+		g.Go(func() error {
+			return r.Run(gCtx)
+		})
+		routers = append(routers, r)
+	}
+
+	// All routers should eventually know about each other.
+	allRouters := append([]*GossipRouter{primaryRouter}, routers...)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		for _, r := range allRouters {
+			ready, err := r.Ready(t.Context())
+			require.NoError(c, err)
+			require.True(c, ready)
+			peers, err := r.ListPeers()
+			require.NoError(c, err)
+			require.Len(c, peers, 5)
+		}
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// Advertised keys should be found by all other routers.
+	key := "foo"
+	lastRouter := routers[len(routers)-1]
+	ip6Addrs, ip4Addrs := filterAndSplitAddrs(lastRouter.host.Addrs(), false)
+	lastIP, err := manet.ToIP(append(ip6Addrs, ip4Addrs...)[0])
+	require.NoError(t, err)
+	err = lastRouter.Advertise(t.Context(), []string{key})
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		for _, r := range allRouters[:len(allRouters)-1] {
+			bal, err := r.Lookup(t.Context(), key, 3)
+			require.NoError(c, err)
+			peer, err := bal.Next()
+			require.NoError(c, err)
+			require.Equal(c, lastRouter.ID(), peer.ID)
+			require.Equal(c, lastIP.String(), peer.Addr.Addr().String())
+			require.Equal(c, uint16(9090), peer.Addr.Port())
+			require.False(c, peer.Seen.IsZero())
+		}
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// Lookup should not return self.
+	bal, err := lastRouter.Lookup(t.Context(), key, 3)
+	require.NoError(t, err)
+	_, err = bal.Next()
+	require.ErrorIs(t, err, ErrNoNext)
+
+	// Metadata should be returned with the peers of the key.
+	metadata := Metadata{MediaType: "application/octet-stream", Digest: digest.FromString("bar"), Size: 3}
+	err = lastRouter.AdvertiseMetadata(t.Context(), map[string]Metadata{"bar": metadata})
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		bal, err := primaryRouter.Lookup(t.Context(), "bar", 3)
+		require.NoError(c, err)
+		peer, err := bal.Next()
+		require.NoError(c, err)
+		require.Equal(c, metadata, peer.Metadata)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// Withdrawn keys should no longer be found.
+	err = lastRouter.Withdraw(t.Context(), []string{key})
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		bal, err := primaryRouter.Lookup(t.Context(), key, 3)
+		require.NoError(c, err)
+		_, err = bal.Next()
+		require.ErrorIs(c, err, ErrNoNext)
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// Shutdown should complete without errors.
+	cancel()
+	err = g.Wait()
+	require.NoError(t, err)
+}
+
+func TestGossipRouterMerge(t *testing.T) {
+	t.Parallel()
+
+	r, err := NewGossipRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithPeerTimeout(time.Minute))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		r.host.Close()
+	})
+	id := generatePeerID(t)
+
+	// Newer version should replace keys.
+	r.merge(t.Context(), []gossipEntry{{ID: id, Version: 1, Heartbeat: 1, Keys: []string{"foo"}}})
+	require.Equal(t, map[string]Metadata{"foo": {}}, r.states[id].keys)
+	metadata := Metadata{MediaType: "application/octet-stream", Digest: digest.FromString("bar"), Size: 3}
+	r.merge(t.Context(), []gossipEntry{{ID: id, Version: 2, Heartbeat: 1, Keys: []string{"bar"}, Metadata: map[string]Metadata{"bar": metadata}}})
+	require.Equal(t, map[string]Metadata{"bar": metadata}, r.states[id].keys)
+
+	// Newer heartbeat with same version should keep keys.
+	r.merge(t.Context(), []gossipEntry{{ID: id, Version: 2, Heartbeat: 5}})
+	require.Equal(t, map[string]Metadata{"bar": metadata}, r.states[id].keys)
+	require.Equal(t, uint64(5), r.states[id].Heartbeat)
+
+	// Older entries should be ignored.
+	r.merge(t.Context(), []gossipEntry{{ID: id, Version: 1, Heartbeat: 10, Keys: []string{"baz"}}})
+	require.Equal(t, gossipDigest{Version: 2, Heartbeat: 5}, r.states[id].gossipDigest)
+
+	// Diff should return newer entries and request unknown entries.
+	otherID := generatePeerID(t)
+	msg := r.diff(map[peer.ID]gossipDigest{
+		id:      {Version: 2, Heartbeat: 1},
+		otherID: {Version: 1, Heartbeat: 1},
+	})
+	require.Len(t, msg.Entries, 2)
+	for _, entry := range msg.Entries {
+		if entry.ID != id {
+			require.Equal(t, r.host.ID(), entry.ID)
+			continue
+		}
+		require.Nil(t, entry.Keys)
+		require.Equal(t, uint64(5), entry.Heartbeat)
+	}
+	require.Equal(t, []peer.ID{otherID}, msg.Requests)
+
+	// Expired states should be removed and not added back by stale entries.
+	r.mx.Lock()
+	r.removeExpired(time.Now().Add(time.Hour))
+	r.mx.Unlock()
+	require.NotContains(t, r.states, id)
+	require.Contains(t, r.states, r.host.ID())
+	r.merge(t.Context(), []gossipEntry{{ID: id, Version: 2, Heartbeat: 5, Keys: []string{"bar"}}})
+	require.NotContains(t, r.states, id)
+	r.merge(t.Context(), []gossipEntry{{ID: id, Version: 2, Heartbeat: 6, Keys: []string{"bar"}}})
+	require.Contains(t, r.states, id)
+}
+
+func TestGossipRouterMembership(t *testing.T) {
+	t.Parallel()
+
+	memberID := generatePeerID(t)
+	membership := NewMembership([]peer.ID{memberID}, nil)
+	r, err := NewGossipRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithPeerTimeout(time.Minute), WithHostOptions(WithMembership(membership)))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		r.host.Close()
+	})
+	other, err := NewGossipRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		other.host.Close()
+	})
+
+	// Entries of peers that are not members are dropped.
+	nonMemberID := generatePeerID(t)
+	r.merge(t.Context(), []gossipEntry{
+		{ID: memberID, Version: 1, Heartbeat: 1, Keys: []string{"foo"}, Addrs: []string{"/ip4/10.0.0.1/tcp/5001"}},
+		{ID: nonMemberID, Version: 1, Heartbeat: 1, Keys: []string{"foo"}, Addrs: []string{"/ip4/10.0.0.2/tcp/5002"}},
+	})
+	require.Contains(t, r.states, memberID)
+	require.NotContains(t, r.states, nonMemberID)
+
+	// Lookups only return members.
+	r.mx.Lock()
+	r.states[nonMemberID] = &gossipState{
+		gossipDigest: gossipDigest{Version: 1, Heartbeat: 1},
+		keys:         map[string]Metadata{"foo": {}},
+		addrs:        []ma.Multiaddr{ma.StringCast("/ip4/10.0.0.2/tcp/5002")},
+		updated:      time.Now(),
+	}
+	r.mx.Unlock()
+	bal, err := r.Lookup(t.Context(), "foo", 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, bal.Size())
+	peer, err := bal.Next()
+	require.NoError(t, err)
+	require.Equal(t, memberID.String(), peer.ID)
+
+	// Gossiping with a peer that is not a member fails before exchanging state.
+	err = r.gossip(t.Context(), other.host.ID())
+	require.EqualError(t, err, "peer is not a member")
+	require.NotContains(t, r.states, other.host.ID())
+}
@@ -0,0 +1,138 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	flow "github.com/libp2p/go-flow-metrics"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	loadCacheTTL     = 5 * time.Second
+	loadFetchTimeout = time.Second
+	maxLoadSize      = 1024
+)
+
+// Load is the upload load of a peer registry.
+type Load struct {
+	// ActiveUploads is the amount of uploads currently being served.
+	ActiveUploads int64 `json:"activeUploads"`
+	// BytesPerSecond is the upload bandwidth currently used.
+	BytesPerSecond int64 `json:"bytesPerSecond"`
+}
+
+// Exceeds returns true if the load is above the threshold.
+// Threshold values that are zero are ignored.
+func (l Load) Exceeds(threshold Load) bool {
+	if threshold.ActiveUploads > 0 && l.ActiveUploads >= threshold.ActiveUploads {
+		return true
+	}
+	if threshold.BytesPerSecond > 0 && l.BytesPerSecond >= threshold.BytesPerSecond {
+		return true
+	}
+	return false
+}
+
+// LoadTracker tracks the upload load of the local registry so that it can be shared with peers.
+type LoadTracker struct {
+	meter         *flow.Meter
+	activeUploads atomic.Int64
+}
+
+func NewLoadTracker() *LoadTracker {
+	return &LoadTracker{
+		meter: flow.NewMeter(),
+	}
+}
+
+// StartUpload tracks an active upload and returns a writer which records the bytes written to it.
+// The returned function has to be called when the upload is done.
+func (lt *LoadTracker) StartUpload(w io.Writer) (io.Writer, func()) {
+	lt.activeUploads.Add(1)
+	done := func() {
+		lt.activeUploads.Add(-1)
+	}
+	return &meteredWriter{Writer: w, meter: lt.meter}, done
+}
+
+// Load returns the current load.
+func (lt *LoadTracker) Load() Load {
+	return Load{
+		ActiveUploads:  lt.activeUploads.Load(),
+		BytesPerSecond: int64(lt.meter.Snapshot().Rate),
+	}
+}
+
+type meteredWriter struct {
+	io.Writer
+	meter *flow.Meter
+}
+
+func (mw *meteredWriter) Write(p []byte) (int, error) {
+	n, err := mw.Writer.Write(p)
+	mw.meter.Mark(uint64(n))
+	return n, err
+}
+
+// ReadFrom keeps optimizations like sendfile when the writer supports it.
+func (mw *meteredWriter) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := mw.Writer.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{mw}, r)
+	}
+	n, err := rf.ReadFrom(r)
+	mw.meter.Mark(uint64(n))
+	return n, err
+}
+
+func loadProtocol(namespace string) protocol.ID {
+	return protocolPrefix(namespace) + "/load/1.0.0"
+}
+
+// newLoadHandler returns a stream handler that writes the current load to the peer.
+func newLoadHandler(ctx context.Context, lt *LoadTracker) network.StreamHandler {
+	log := logr.FromContextOrDiscard(ctx).WithName("p2p")
+	return func(s network.Stream) {
+		defer s.Close()
+
+		err := s.SetWriteDeadline(time.Now().Add(loadFetchTimeout))
+		if err != nil {
+			log.Error(err, "could not set load stream deadline")
+			return
+		}
+		err = json.NewEncoder(s).Encode(lt.Load())
+		if err != nil {
+			log.Error(err, "could not write load", "peer", s.Conn().RemotePeer().String())
+			return
+		}
+	}
+}
+
+func fetchLoad(ctx context.Context, h host.Host, protocolID protocol.ID, id peer.ID) (Load, error) {
+	ctx, cancel := context.WithTimeout(ctx, loadFetchTimeout)
+	defer cancel()
+	s, err := h.NewStream(ctx, id, protocolID)
+	if err != nil {
+		return Load{}, err
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	err = s.SetReadDeadline(deadline)
+	if err != nil {
+		return Load{}, err
+	}
+	load := Load{}
+	err = json.NewDecoder(io.LimitReader(s, maxLoadSize)).Decode(&load)
+	if err != nil {
+		return Load{}, err
+	}
+	return load, nil
+}
@@ -0,0 +1,94 @@
+package routing
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadExceeds(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		load      Load
+		threshold Load
+		expected  bool
+	}{
+		{
+			name:      "no threshold",
+			load:      Load{ActiveUploads: 100, BytesPerSecond: 100},
+			threshold: Load{},
+			expected:  false,
+		},
+		{
+			name:      "below threshold",
+			load:      Load{ActiveUploads: 1, BytesPerSecond: 100},
+			threshold: Load{ActiveUploads: 2, BytesPerSecond: 200},
+			expected:  false,
+		},
+		{
+			name:      "active uploads threshold",
+			load:      Load{ActiveUploads: 2},
+			threshold: Load{ActiveUploads: 2},
+			expected:  true,
+		},
+		{
+			name:      "bandwidth threshold",
+			load:      Load{ActiveUploads: 1, BytesPerSecond: 300},
+			threshold: Load{ActiveUploads: 2, BytesPerSecond: 200},
+			expected:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tt.expected, tt.load.Exceeds(tt.threshold))
+		})
+	}
+}
+
+func TestLoadTracker(t *testing.T) {
+	t.Parallel()
+
+	lt := NewLoadTracker()
+	require.Equal(t, Load{}, lt.Load())
+
+	buf := &bytes.Buffer{}
+	w, done := lt.StartUpload(buf)
+	require.Equal(t, int64(1), lt.Load().ActiveUploads)
+	_, err := w.Write([]byte("foo"))
+	require.NoError(t, err)
+	_, err = io.Copy(w, strings.NewReader("bar"))
+	require.NoError(t, err)
+	require.Equal(t, "foobar", buf.String())
+	done()
+	require.Equal(t, int64(0), lt.Load().ActiveUploads)
+
+	// Load should be fetched by peers.
+	routers := []*P2PRouter{}
+	for _, opt := range []P2PRouterOption{WithLoadTracker(lt), WithLoadThreshold(Load{ActiveUploads: 1})} {
+		r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", opt)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.host.Close()
+		})
+		routers = append(routers, r)
+	}
+	_, done = lt.StartUpload(buf)
+	defer done()
+	err = routers[1].host.Connect(t.Context(), *host.InfoFromHost(routers[0].host))
+	require.NoError(t, err)
+	load, err := fetchLoad(t.Context(), routers[1].host, loadProtocol(""), routers[0].host.ID())
+	require.NoError(t, err)
+	require.Equal(t, int64(1), load.ActiveUploads)
+	routers[1].refreshLoad(t.Context(), routers[0].host.ID())
+	load, ok := routers[1].loadCache.Get(routers[0].host.ID())
+	require.True(t, ok)
+	require.True(t, load.Exceeds(routers[1].loadThreshold))
+}
@@ -0,0 +1,253 @@
+package routing
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+	msmux "github.com/multiformats/go-multistream"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+const (
+	maxCertificateSize    = 1024
+	membershipVerifyDelay = 10 * time.Second
+)
+
+// errInvalidCertificate is returned when a peer fails to present a valid certificate.
+// Other verification errors are transient and should not cause the peer to be rejected.
+var errInvalidCertificate = errors.New("invalid membership certificate")
+
+var _ connmgr.ConnectionGater = &Membership{}
+
+// Membership controls which peers are allowed to be part of the router network.
+// A peer is a member if its ID is part of the static peer list, or if it presents
+// a certificate for its peer ID signed by the cluster key.
+type Membership struct {
+	host        host.Host
+	clusterKey  crypto.PrivKey
+	peers       map[peer.ID]any
+	verified    map[peer.ID]any
+	rejected    *expirable.LRU[peer.ID, any]
+	verifyGroup *singleflight.Group
+	protocolID  protocol.ID
+	certificate []byte
+	mx          sync.RWMutex
+}
+
+// NewMembership creates a membership with the static list of peers.
+// If the cluster key is not nil peers with a certificate signed by the cluster key are also members.
+func NewMembership(peers []peer.ID, clusterKey crypto.PrivKey) *Membership {
+	peerSet := map[peer.ID]any{}
+	for _, p := range peers {
+		peerSet[p] = nil
+	}
+	return &Membership{
+		clusterKey:  clusterKey,
+		peers:       peerSet,
+		verified:    map[peer.ID]any{},
+		rejected:    expirable.NewLRU[peer.ID, any](0, nil, 10*time.Minute),
+		verifyGroup: &singleflight.Group{},
+	}
+}
+
+// ParsePeerIDs parses a membership file with one peer ID per line.
+// Empty lines and lines starting with # are ignored.
+func ParsePeerIDs(r io.Reader) ([]peer.ID, error) {
+	peers := []peer.ID{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := peer.Decode(line)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse peer ID %s: %w", line, err)
+		}
+		peers = append(peers, id)
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return peers, nil
+}
+
+func membershipProtocol(namespace string) protocol.ID {
+	return protocolPrefix(namespace) + "/membership/1.0.0"
+}
+
+func (m *Membership) attach(ctx context.Context, h host.Host, namespace string) error {
+	m.host = h
+	m.protocolID = membershipProtocol(namespace)
+	if m.clusterKey == nil {
+		return nil
+	}
+
+	log := logr.FromContextOrDiscard(ctx).WithName("membership")
+	certificate, err := m.clusterKey.Sign([]byte(h.ID()))
+	if err != nil {
+		return err
+	}
+	m.certificate = certificate
+	h.SetStreamHandler(m.protocolID, func(s network.Stream) {
+		defer s.Close()
+		err := s.SetWriteDeadline(time.Now().Add(membershipVerifyDelay))
+		if err != nil {
+			log.Error(err, "could not set write deadline")
+			return
+		}
+		_, err = s.Write(m.certificate)
+		if err != nil {
+			log.Error(err, "could not write membership certificate", "peer", s.Conn().RemotePeer())
+			return
+		}
+	})
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			go func() {
+				verifyCtx, cancel := context.WithTimeout(ctx, membershipVerifyDelay)
+				defer cancel()
+				m.Verify(verifyCtx, peer.AddrInfo{ID: c.RemotePeer()})
+			}()
+		},
+	})
+	return nil
+}
+
+// IsMember returns true if the peer is known to be a member.
+func (m *Membership) IsMember(p peer.ID) bool {
+	if m.host != nil && m.host.ID() == p {
+		return true
+	}
+	m.mx.RLock()
+	defer m.mx.RUnlock()
+	if _, ok := m.peers[p]; ok {
+		return true
+	}
+	if _, ok := m.verified[p]; ok {
+		return true
+	}
+	return false
+}
+
+// Verify returns true if the peer is a member. If the peer is not known and a cluster key
+// is configured the peer certificate will be requested and verified.
+func (m *Membership) Verify(ctx context.Context, addrInfo peer.AddrInfo) bool {
+	if m.IsMember(addrInfo.ID) {
+		return true
+	}
+	if m.clusterKey == nil || m.host == nil || m.rejected.Contains(addrInfo.ID) {
+		return false
+	}
+	v, _, _ := m.verifyGroup.Do(addrInfo.ID.String(), func() (any, error) {
+		log := logr.FromContextOrDiscard(ctx).WithValues("peer", addrInfo.ID)
+		if len(addrInfo.Addrs) > 0 {
+			m.host.Peerstore().AddAddrs(addrInfo.ID, addrInfo.Addrs, peerstore.TempAddrTTL)
+		}
+		err := m.verifyCertificate(ctx, addrInfo.ID)
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false, nil
+		}
+		if err != nil && !errors.Is(err, errInvalidCertificate) {
+			log.Error(err, "could not verify peer membership")
+			return false, nil
+		}
+		if err != nil {
+			log.Error(err, "rejecting peer with invalid membership")
+			m.rejected.Add(addrInfo.ID, nil)
+			metrics.RouterRejectedPeersTotal.WithLabelValues("certificate").Inc()
+			//nolint: errcheck // Ignore error as peer is rejected either way.
+			m.host.Network().ClosePeer(addrInfo.ID)
+			return false, nil
+		}
+		m.mx.Lock()
+		m.verified[addrInfo.ID] = nil
+		m.mx.Unlock()
+		return true, nil
+	})
+	//nolint: errcheck // Impossible to be another type other than bool.
+	return v.(bool)
+}
+
+func (m *Membership) verifyCertificate(ctx context.Context, p peer.ID) error {
+	s, err := m.host.NewStream(ctx, p, m.protocolID)
+	if errors.Is(err, msmux.ErrNotSupported[protocol.ID]{}) {
+		return fmt.Errorf("%w: peer does not support the membership protocol", errInvalidCertificate)
+	}
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	deadline, ok := ctx.Deadline()
+	if ok {
+		err := s.SetReadDeadline(deadline)
+		if err != nil {
+			return err
+		}
+	}
+	certificate, err := io.ReadAll(io.LimitReader(s, maxCertificateSize))
+	if err != nil {
+		return err
+	}
+	ok, err = m.clusterKey.GetPublic().Verify([]byte(p), certificate)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidCertificate, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: certificate is not signed by cluster key", errInvalidCertificate)
+	}
+	return nil
+}
+
+func (m *Membership) allowConnection(p peer.ID) bool {
+	if m.IsMember(p) {
+		return true
+	}
+	// Unknown peers are allowed to connect to present their certificate.
+	if m.clusterKey != nil && !m.rejected.Contains(p) {
+		return true
+	}
+	metrics.RouterRejectedPeersTotal.WithLabelValues("connection").Inc()
+	return false
+}
+
+func (m *Membership) InterceptPeerDial(p peer.ID) bool {
+	// Bootstrapping dials unknown peer IDs so only rejected peers are blocked.
+	return !m.rejected.Contains(p)
+}
+
+func (m *Membership) InterceptAddrDial(p peer.ID, _ ma.Multiaddr) bool {
+	return true
+}
+
+func (m *Membership) InterceptAccept(_ network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (m *Membership) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	return m.allowConnection(p)
+}
+
+func (m *Membership) InterceptUpgraded(_ network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,134 @@
+package routing
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePeerIDs(t *testing.T) {
+	t.Parallel()
+
+	id := generatePeerID(t)
+	input := "# cluster peers\n\n" + id.String() + "\n  \n"
+	peers, err := ParsePeerIDs(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Equal(t, []peer.ID{id}, peers)
+
+	_, err = ParsePeerIDs(strings.NewReader("foo\n"))
+	require.ErrorContains(t, err, "could not parse peer ID foo")
+}
+
+func TestMembershipStaticPeers(t *testing.T) {
+	t.Parallel()
+
+	member := generatePeerID(t)
+	unknown := generatePeerID(t)
+	m := NewMembership([]peer.ID{member}, nil)
+
+	require.True(t, m.IsMember(member))
+	require.False(t, m.IsMember(unknown))
+	require.True(t, m.InterceptPeerDial(unknown))
+	require.True(t, m.allowConnection(member))
+	require.False(t, m.allowConnection(unknown))
+	require.True(t, m.Verify(t.Context(), peer.AddrInfo{ID: member}))
+	require.False(t, m.Verify(t.Context(), peer.AddrInfo{ID: unknown}))
+}
+
+func TestMembershipClusterKey(t *testing.T) {
+	t.Parallel()
+
+	clusterKey, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	otherClusterKey, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+
+	routers := []*P2PRouter{}
+	for _, key := range []crypto.PrivKey{clusterKey, clusterKey, otherClusterKey} {
+		// The router with another cluster key accepts the first router, so that it presents its certificate
+		// instead of closing the connection after rejecting the first router.
+		peers := []peer.ID{}
+		if key == otherClusterKey {
+			peers = append(peers, routers[0].host.ID())
+		}
+		r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithMembership(NewMembership(peers, key)))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.host.Close()
+		})
+		routers = append(routers, r)
+	}
+
+	verifyCtx, verifyCancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer verifyCancel()
+	ok := routers[0].membership.Verify(verifyCtx, *host.InfoFromHost(routers[1].host))
+	require.True(t, ok)
+	require.True(t, routers[0].membership.IsMember(routers[1].host.ID()))
+
+	ok = routers[0].membership.Verify(verifyCtx, *host.InfoFromHost(routers[2].host))
+	require.False(t, ok)
+	require.False(t, routers[0].membership.IsMember(routers[2].host.ID()))
+	require.False(t, routers[0].membership.allowConnection(routers[2].host.ID()))
+	require.False(t, routers[0].membership.InterceptPeerDial(routers[2].host.ID()))
+
+	// Peers in another namespace do not share the membership protocol.
+	namespaced, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithNamespace("tenant"), WithMembership(NewMembership(nil, clusterKey)))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		namespaced.host.Close()
+	})
+	ok = routers[0].membership.Verify(verifyCtx, *host.InfoFromHost(namespaced.host))
+	require.False(t, ok)
+}
+
+func TestMembershipTransientError(t *testing.T) {
+	t.Parallel()
+
+	clusterKey, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithMembership(NewMembership(nil, clusterKey)))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		r.host.Close()
+	})
+	peerKey, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(peerKey)
+	require.NoError(t, err)
+
+	// Peers that cannot be reached are not rejected.
+	verifyCtx, verifyCancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer verifyCancel()
+	ok := r.membership.Verify(verifyCtx, peer.AddrInfo{ID: id})
+	require.False(t, ok)
+	require.False(t, r.membership.IsMember(id))
+	require.True(t, r.membership.allowConnection(id))
+	require.True(t, r.membership.InterceptPeerDial(id))
+
+	// Peers are verified once they can be reached.
+	member, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithLibP2POptions(libp2p.Identity(peerKey)), WithMembership(NewMembership(nil, clusterKey)))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		member.host.Close()
+	})
+	ok = r.membership.Verify(verifyCtx, *host.InfoFromHost(member.host))
+	require.True(t, ok)
+	require.True(t, r.membership.IsMember(id))
+}
+
+func generatePeerID(t *testing.T) peer.ID {
+	t.Helper()
+
+	priv, _, err := crypto.GenerateEd25519Key(nil)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	return id
+}
@@ -8,10 +8,11 @@ import (
 	"sync/atomic"
 )
 
-var _ Router = &MemoryRouter{}
+var _ MetadataRouter = &MemoryRouter{}
 
 type MemoryRouter struct {
 	resolver map[string][]netip.AddrPort
+	metadata map[string]Metadata
 	self     netip.AddrPort
 	ready    atomic.Bool
 	mx       sync.RWMutex
@@ -20,6 +21,7 @@ type MemoryRouter struct {
 func NewMemoryRouter(resolver map[string][]netip.AddrPort, self netip.AddrPort) *MemoryRouter {
 	r := &MemoryRouter{
 		resolver: resolver,
+		metadata: map[string]Metadata{},
 		self:     self,
 	}
 	r.ready.Store(true)
@@ -45,7 +47,7 @@ func (m *MemoryRouter) Lookup(ctx context.Context, key string, count int) (Balan
 
 	rr := NewRoundRobin()
 	for _, peer := range peers {
-		rr.Add(peer)
+		rr.Add(PeerInfo{Addr: peer, Metadata: m.metadata[key]})
 	}
 	return rr, nil
 }
@@ -57,6 +59,15 @@ func (m *MemoryRouter) Advertise(ctx context.Context, keys []string) error {
 	return nil
 }
 
+// AdvertiseMetadata advertises the keys with metadata that is shared by all peers of the key.
+func (m *MemoryRouter) AdvertiseMetadata(ctx context.Context, metadata map[string]Metadata) error {
+	for key, v := range metadata {
+		m.SetMetadata(key, v)
+		m.Add(key, m.self)
+	}
+	return nil
+}
+
 func (m *MemoryRouter) Withdraw(ctx context.Context, keys []string) error {
 	for _, key := range keys {
 		m.Delete(key, m.self)
@@ -64,6 +75,14 @@ func (m *MemoryRouter) Withdraw(ctx context.Context, keys []string) error {
 	return nil
 }
 
+// SetMetadata sets the metadata returned with peers of the key.
+func (m *MemoryRouter) SetMetadata(key string, metadata Metadata) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.metadata[key] = metadata
+}
+
 func (m *MemoryRouter) Add(key string, ap netip.AddrPort) {
 	m.mx.Lock()
 	defer m.mx.Unlock()
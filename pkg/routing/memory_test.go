@@ -4,6 +4,7 @@ import (
 	"net/netip"
 	"testing"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/require"
 )
 
@@ -30,7 +31,7 @@ func TestMemoryRouter(t *testing.T) {
 	for range 2 {
 		peer, err := rr.Next()
 		require.NoError(t, err)
-		peers = append(peers, peer)
+		peers = append(peers, peer.Addr)
 	}
 
 	require.Len(t, peers, 2)
@@ -44,4 +45,13 @@ func TestMemoryRouter(t *testing.T) {
 	require.ErrorIs(t, err, ErrNoNext)
 	_, ok = r.Get("bar")
 	require.False(t, ok)
+
+	metadata := Metadata{MediaType: "application/octet-stream", Digest: digest.FromString("baz"), Size: 3}
+	err = r.AdvertiseMetadata(t.Context(), map[string]Metadata{"baz": metadata})
+	require.NoError(t, err)
+	rr, err = r.Lookup(t.Context(), "baz", 1)
+	require.NoError(t, err)
+	peer, err := rr.Next()
+	require.NoError(t, err)
+	require.Equal(t, metadata, peer.Metadata)
 }
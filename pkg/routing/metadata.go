@@ -0,0 +1,152 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	metadataCacheTTL     = time.Minute
+	metadataFetchTimeout = time.Second
+	maxMetadataSize      = 4 * 1024
+)
+
+// Metadata describes the content of an advertised key.
+type Metadata struct {
+	// MediaType is the media type of the content.
+	MediaType string `json:"mediaType"`
+	// Digest is the digest of the content, which for tags is the digest the tag resolves to.
+	Digest digest.Digest `json:"digest"`
+	// Size is the size of the content in bytes.
+	Size int64 `json:"size"`
+}
+
+// IsValid returns true if the metadata is complete enough to describe the content.
+func (m Metadata) IsValid() bool {
+	return m.MediaType != "" && m.Digest.Validate() == nil && m.Size >= 0
+}
+
+// MetadataRouter is a router that advertises metadata together with keys.
+// Lookups return the metadata with peers, so that requests for the content can be answered without contacting a peer.
+type MetadataRouter interface {
+	Router
+	// AdvertiseMetadata broadcasts the availability of the given keys together with their metadata.
+	AdvertiseMetadata(ctx context.Context, metadata map[string]Metadata) error
+}
+
+// metadataStore keeps the metadata of keys advertised by the local host.
+type metadataStore struct {
+	metadata map[string]Metadata
+	mx       sync.RWMutex
+}
+
+func newMetadataStore() *metadataStore {
+	return &metadataStore{
+		metadata: map[string]Metadata{},
+	}
+}
+
+func (s *metadataStore) Get(key string) (Metadata, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	metadata, ok := s.metadata[key]
+	return metadata, ok
+}
+
+func (s *metadataStore) Set(key string, metadata Metadata) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.metadata[key] = metadata
+}
+
+func (s *metadataStore) Delete(keys ...string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	for _, key := range keys {
+		delete(s.metadata, key)
+	}
+}
+
+func (s *metadataStore) Clear() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	s.metadata = map[string]Metadata{}
+}
+
+func metadataProtocol(namespace string) protocol.ID {
+	return protocolPrefix(namespace) + "/metadata/1.0.0"
+}
+
+type metadataRequest struct {
+	Key string `json:"key"`
+}
+
+// newMetadataHandler returns a stream handler that writes the metadata of the requested key to the peer.
+// Empty metadata is written when the key is not advertised with metadata.
+func newMetadataHandler(ctx context.Context, store *metadataStore) network.StreamHandler {
+	log := logr.FromContextOrDiscard(ctx).WithName("p2p")
+	return func(s network.Stream) {
+		defer s.Close()
+
+		err := s.SetDeadline(time.Now().Add(metadataFetchTimeout))
+		if err != nil {
+			log.Error(err, "could not set metadata stream deadline")
+			return
+		}
+		req := metadataRequest{}
+		err = json.NewDecoder(io.LimitReader(s, maxMetadataSize)).Decode(&req)
+		if err != nil {
+			log.Error(err, "could not decode metadata request", "peer", s.Conn().RemotePeer().String())
+			return
+		}
+		metadata, _ := store.Get(req.Key)
+		err = json.NewEncoder(s).Encode(metadata)
+		if err != nil {
+			log.Error(err, "could not write metadata", "peer", s.Conn().RemotePeer().String())
+			return
+		}
+	}
+}
+
+func fetchMetadata(ctx context.Context, h host.Host, protocolID protocol.ID, id peer.ID, key string) (Metadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, metadataFetchTimeout)
+	defer cancel()
+	s, err := h.NewStream(ctx, id, protocolID)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	err = s.SetDeadline(deadline)
+	if err != nil {
+		return Metadata{}, err
+	}
+	err = json.NewEncoder(s).Encode(metadataRequest{Key: key})
+	if err != nil {
+		return Metadata{}, err
+	}
+	err = s.CloseWrite()
+	if err != nil {
+		return Metadata{}, err
+	}
+	metadata := Metadata{}
+	err = json.NewDecoder(io.LimitReader(s, maxMetadataSize)).Decode(&metadata)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return metadata, nil
+}
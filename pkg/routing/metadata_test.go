@@ -0,0 +1,95 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataIsValid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		metadata Metadata
+		expected bool
+	}{
+		{
+			name:     "empty",
+			metadata: Metadata{},
+			expected: false,
+		},
+		{
+			name:     "valid",
+			metadata: Metadata{MediaType: "application/octet-stream", Digest: digest.FromString("foo"), Size: 3},
+			expected: true,
+		},
+		{
+			name:     "missing media type",
+			metadata: Metadata{Digest: digest.FromString("foo"), Size: 3},
+			expected: false,
+		},
+		{
+			name:     "invalid digest",
+			metadata: Metadata{MediaType: "application/octet-stream", Digest: "sha256:foo", Size: 3},
+			expected: false,
+		},
+		{
+			name:     "negative size",
+			metadata: Metadata{MediaType: "application/octet-stream", Digest: digest.FromString("foo"), Size: -1},
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tt.expected, tt.metadata.IsValid())
+		})
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	t.Parallel()
+
+	routers := []*P2PRouter{}
+	for range 2 {
+		r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.host.Close()
+		})
+		routers = append(routers, r)
+	}
+	err := routers[1].host.Connect(t.Context(), *host.InfoFromHost(routers[0].host))
+	require.NoError(t, err)
+
+	metadata := Metadata{MediaType: "application/octet-stream", Digest: digest.FromString("foo"), Size: 3}
+	err = routers[0].AdvertiseMetadata(t.Context(), map[string]Metadata{metadata.Digest.String(): metadata})
+	require.NoError(t, err)
+	fetched, err := fetchMetadata(t.Context(), routers[1].host, metadataProtocol(""), routers[0].host.ID(), metadata.Digest.String())
+	require.NoError(t, err)
+	require.Equal(t, metadata, fetched)
+	routers[1].refreshMetadata(t.Context(), routers[0].host.ID(), metadata.Digest.String())
+	cached, ok := routers[1].metadataCache.Get(metadata.Digest.String())
+	require.True(t, ok)
+	require.Equal(t, metadata, cached)
+
+	// Metadata that could not be fetched should be cached as unknown.
+	routers[1].refreshMetadata(t.Context(), generatePeerID(t), "unreachable")
+	cached, ok = routers[1].metadataCache.Get("unreachable")
+	require.True(t, ok)
+	require.Equal(t, Metadata{}, cached)
+
+	// Unknown and withdrawn keys should return empty metadata.
+	fetched, err = fetchMetadata(t.Context(), routers[1].host, metadataProtocol(""), routers[0].host.ID(), "unknown")
+	require.NoError(t, err)
+	require.Equal(t, Metadata{}, fetched)
+	err = routers[0].Withdraw(t.Context(), []string{metadata.Digest.String()})
+	require.NoError(t, err)
+	fetched, err = fetchMetadata(t.Context(), routers[1].host, metadataProtocol(""), routers[0].host.ID(), metadata.Digest.String())
+	require.NoError(t, err)
+	require.Equal(t, Metadata{}, fetched)
+}
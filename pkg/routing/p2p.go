@@ -5,6 +5,7 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -13,7 +14,10 @@ import (
 	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
@@ -23,12 +27,20 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p-kad-dht/provider"
+	"github.com/libp2p/go-libp2p-kad-dht/provider/keystore"
+	"github.com/libp2p/go-libp2p-kad-dht/records"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/libp2p/go-libp2p/core/sec"
 	quic "github.com/libp2p/go-libp2p/p2p/transport/quic"
 	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
@@ -45,16 +57,34 @@ import (
 
 const (
 	maxReprovideDelay = 5 * time.Minute
+	// withdrawPeerCount is the amount of closest peers notified when withdrawing keys.
+	withdrawPeerCount = 20
+	// lookupQueryTimeout is the max duration of a provider query, which is independent of the caller.
+	lookupQueryTimeout = 10 * time.Second
 )
 
 type P2PRouterConfig struct {
-	DataDir      string
-	Libp2pOpts   []libp2p.Option
-	AdvertiseTTL time.Duration
+	Membership          *Membership
+	LoadTracker         *LoadTracker
+	DataDir             string
+	Namespace           string
+	Architecture        string
+	Libp2pOpts          []libp2p.Option
+	AddressFamily       string
+	PreferredCIDRs      []netip.Prefix
+	PreferredInterfaces []string
+	LoadThreshold       Load
+	AdvertiseTTL        time.Duration
+	NegativeCacheTTL    time.Duration
+	AllowLoopback       bool
+	Relay               bool
+	StreamTransport     bool
 }
 
 type P2PRouterOption = option.Option[P2PRouterConfig]
 
+// WithLibP2POptions sets options used when creating the libp2p host.
+// When a private network option is set only the TCP transport will be used as QUIC does not support private networks.
 func WithLibP2POptions(opts ...libp2p.Option) P2PRouterOption {
 	return func(cfg *P2PRouterConfig) error {
 		cfg.Libp2pOpts = opts
@@ -76,24 +106,172 @@ func WithAdvertiseTTL(ttl time.Duration) P2PRouterOption {
 	}
 }
 
-var _ Router = &P2PRouter{}
+// WithNegativeCacheTTL sets how long keys without providers are cached, a zero TTL disables the cache.
+// Cached keys are invalidated when an advertisement for the key is stored on the node, when the node
+// returns providers for the key to any lookup, or when a lookup finds a provider. Nodes which are not
+// among the closest to the key and receive no lookups for it keep the key cached until the TTL expires.
+func WithNegativeCacheTTL(ttl time.Duration) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		if ttl < 0 {
+			return errors.New("negative cache TTL cannot be negative")
+		}
+		cfg.NegativeCacheTTL = ttl
+		return nil
+	}
+}
+
+// WithLoadTracker shares the load of the local registry with peers.
+func WithLoadTracker(lt *LoadTracker) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		cfg.LoadTracker = lt
+		return nil
+	}
+}
+
+// WithLoadThreshold sets the load at which peers are deprioritized in lookups.
+// Zero values in the threshold are ignored. The load of a peer is fetched in the background when the peer is
+// first returned by a lookup, so the first lookup returning a peer does not deprioritize it.
+func WithLoadThreshold(threshold Load) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		if threshold.ActiveUploads < 0 || threshold.BytesPerSecond < 0 {
+			return errors.New("load threshold cannot be negative")
+		}
+		cfg.LoadThreshold = threshold
+		return nil
+	}
+}
+
+// WithAllowLoopback allows loopback addresses to be used by peers.
+// This is only useful when running multiple routers on the same host.
+func WithAllowLoopback(allow bool) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		cfg.AllowLoopback = allow
+		return nil
+	}
+}
+
+// WithPreferredCIDRs prefers addresses within the networks when advertising and selecting peer addresses.
+// This is useful on hosts with multiple networks to keep traffic on the intended network.
+func WithPreferredCIDRs(cidrs ...netip.Prefix) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		for _, cidr := range cidrs {
+			if !cidr.IsValid() {
+				return fmt.Errorf("invalid preferred CIDR %s", cidr)
+			}
+		}
+		cfg.PreferredCIDRs = cidrs
+		return nil
+	}
+}
+
+// WithPreferredInterfaces prefers addresses within the networks of the named interfaces.
+// The interface networks are resolved when the router is created.
+func WithPreferredInterfaces(names ...string) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		cfg.PreferredInterfaces = names
+		return nil
+	}
+}
+
+// WithAddressFamily sets the address family preferred when advertising and selecting peer addresses.
+// An empty family prefers IPv6 over IPv4 while still advertising both.
+func WithAddressFamily(family string) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		switch family {
+		case "", AddressFamilyIPv4, AddressFamilyIPv6:
+		default:
+			return fmt.Errorf("unknown address family %q", family)
+		}
+		cfg.AddressFamily = family
+		return nil
+	}
+}
+
+// WithRelay enables circuit relay and hole punching so that peers behind NAT are reachable.
+// Publicly reachable peers act as relays while peers that are not reachable advertise relay addresses.
+// Relays limit the duration and data of relayed connections, content is only transferred over direct
+// connections established through hole punching.
+func WithRelay(enabled bool) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		cfg.Relay = enabled
+		return nil
+	}
+}
+
+// WithStreamTransport makes lookups return peers that are dialed over router streams instead of the registry port.
+// Streams reuse the existing peer connections, and with it NAT traversal and peer authentication.
+// All peers have to serve the registry on the router listener for stream transport to work.
+func WithStreamTransport(enabled bool) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		cfg.StreamTransport = enabled
+		return nil
+	}
+}
+
+// WithArchitecture shares the architecture of the node with peers and sets the architecture of peers returned
+// by lookups. The architecture is exchanged when peers connect, so peers which are not yet connected or do not
+// share their architecture are returned with an unknown architecture.
+func WithArchitecture(arch string) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		cfg.Architecture = arch
+		return nil
+	}
+}
+
+// WithNamespace isolates the router from other routers using a different namespace.
+// The namespace is applied to the DHT protocol prefix and to all keys.
+func WithNamespace(namespace string) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		if strings.ContainsAny(namespace, "/ \t\n") {
+			return fmt.Errorf("invalid namespace %q cannot contain slashes or whitespace", namespace)
+		}
+		cfg.Namespace = namespace
+		return nil
+	}
+}
+
+// WithMembership restricts the router network to peers that are members.
+func WithMembership(membership *Membership) P2PRouterOption {
+	return func(cfg *P2PRouterConfig) error {
+		cfg.Membership = membership
+		return nil
+	}
+}
+
+var _ MetadataRouter = &P2PRouter{}
 
 type P2PRouter struct {
 	bootstrapper           Bootstrapper
 	host                   host.Host
 	kdht                   *dht.IpfsDHT
 	prov                   *provider.SweepingProvider
+	keystore               keystore.Keystore
+	providerStore          *withdrawableProviderStore
 	balancerGroup          *singleflight.Group
 	balancerCache          *expirable.LRU[string, *ClosableBalancer]
+	negativeCache          *expirable.LRU[string, any]
+	loadCache              *expirable.LRU[peer.ID, Load]
+	metadata               *metadataStore
+	metadataCache          *expirable.LRU[string, Metadata]
+	metadataGroup          *singleflight.Group
+	loadGroup              *singleflight.Group
 	connectivityGate       *channel.Gate
+	membership             *Membership
+	namespace              string
+	architecture           string
 	protocols              []ma.Multiaddr
+	addrSelector           addrSelector
+	loadThreshold          Load
 	ip6Support, ip4Support bool
+	relay                  bool
+	streamTransport        bool
 	registryPort           uint16
 }
 
 func NewP2PRouter(ctx context.Context, addr string, bs Bootstrapper, registryPortStr string, opts ...P2PRouterOption) (*P2PRouter, error) {
 	cfg := P2PRouterConfig{
-		AdvertiseTTL: 15 * time.Minute,
+		AdvertiseTTL:     15 * time.Minute,
+		NegativeCacheTTL: 5 * time.Second,
 	}
 	err := option.Apply(&cfg, opts...)
 	if err != nil {
@@ -105,48 +283,81 @@ func NewP2PRouter(ctx context.Context, addr string, bs Bootstrapper, registryPor
 		return nil, err
 	}
 
-	listenAddrs, err := listenMultiaddrs(addr)
+	selector, err := newAddrSelector(cfg)
 	if err != nil {
 		return nil, err
 	}
-	hostOpts := []libp2p.Option{
-		libp2p.ChainOptions(
-			libp2p.NoTransports,
-			libp2p.Transport(quic.NewTransport),
-			libp2p.Transport(tcp.NewTCPTransport),
-		),
-		libp2p.ListenAddrs(listenAddrs...),
-		libp2p.DisableIdentifyAddressDiscovery(),
-		libp2p.PrometheusRegisterer(metrics.DefaultRegisterer),
-		libp2p.AddrsFactory(func(addrs []ma.Multiaddr) []ma.Multiaddr {
-			ip6Addrs, ip4Addrs := filterAndSplitAddrs(addrs)
-			return append(ip6Addrs, ip4Addrs...)
-		}),
+	host, err := newHost(ctx, addr, cfg, selector)
+	if err != nil {
+		return nil, err
 	}
-	if cfg.DataDir != "" {
-		peerKey, err := loadOrCreatePrivateKey(ctx, cfg.DataDir)
-		if err != nil {
-			return nil, err
+	// Created resources are closed in reverse order when a later step fails.
+	closers := []io.Closer{host}
+	closeOnErr := func(err error) error {
+		errs := []error{err}
+		for _, c := range slices.Backward(closers) {
+			errs = append(errs, c.Close())
 		}
-		hostOpts = append(hostOpts, libp2p.Identity(peerKey))
-	}
-	hostOpts = append(hostOpts, cfg.Libp2pOpts...)
-	host, err := libp2p.New(hostOpts...)
-	if err != nil {
-		return nil, fmt.Errorf("could not create host: %w", err)
+		return errors.Join(errs...)
 	}
 	protocols := protocolsFromAddrs(host.Addrs())
-	ip6Addrs, ip4Addrs := filterAndSplitAddrs(host.Addrs())
+	ip6Addrs, ip4Addrs := filterAndSplitAddrs(host.Addrs(), cfg.AllowLoopback)
 
+	maxRecordAge := cfg.AdvertiseTTL + maxReprovideDelay
+	dhtMode := dht.ModeServer
+	if cfg.Relay {
+		// Peers behind NAT should not be part of other peers routing tables.
+		dhtMode = dht.ModeAutoServer
+	}
 	dhtOpts := []dht.Option{
-		dht.Mode(dht.ModeServer),
-		dht.ProtocolPrefix("/spegel"),
-		dht.MaxRecordAge(cfg.AdvertiseTTL + maxReprovideDelay),
+		dht.Mode(dhtMode),
+		dht.ProtocolPrefix(protocolPrefix(cfg.Namespace)),
+		dht.MaxRecordAge(maxRecordAge),
+	}
+	var baseProvStore records.ProviderStore
+	withdrawTTL := records.ProvideValidity
+	if cfg.DataDir != "" {
+		baseProvStore, err = NewPersistentProviderStore(ctx, filepath.Join(cfg.DataDir, "providers.db"), host.ID(), host.Peerstore(), maxRecordAge)
+		if err != nil {
+			return nil, closeOnErr(fmt.Errorf("could not create provider store: %w", err))
+		}
+		withdrawTTL = maxRecordAge
+	} else {
+		baseProvStore, err = records.NewProviderManager(ctx, host.ID(), host.Peerstore(), dssync.MutexWrap(ds.NewMapDatastore()))
+		if err != nil {
+			return nil, closeOnErr(fmt.Errorf("could not create provider store: %w", err))
+		}
 	}
+	closers = append(closers, baseProvStore)
+	provStore := newWithdrawableProviderStore(baseProvStore, withdrawTTL)
+	var negativeCache *expirable.LRU[string, any]
+	if cfg.NegativeCacheTTL > 0 {
+		negativeCache = expirable.NewLRU[string, any](0, nil, cfg.NegativeCacheTTL)
+		provStore.onProvidersFound = func(key []byte) {
+			negativeCache.Remove(cid.NewCidV1(uint64(mc.Raw), key).String())
+		}
+	}
+	dhtOpts = append(dhtOpts, dht.ProviderStore(provStore))
 	kdht, err := dht.New(ctx, host, dhtOpts...)
 	if err != nil {
-		return nil, fmt.Errorf("could not create distributed hash table: %w", err)
+		return nil, closeOnErr(fmt.Errorf("could not create distributed hash table: %w", err))
+	}
+	// The distributed hash table closes the provider store.
+	closers = []io.Closer{host, kdht}
+	host.SetStreamHandler(withdrawProtocol(cfg.Namespace), newWithdrawHandler(ctx, provStore))
+	if cfg.LoadTracker != nil {
+		host.SetStreamHandler(loadProtocol(cfg.Namespace), newLoadHandler(ctx, cfg.LoadTracker))
+	}
+	if cfg.Architecture != "" {
+		host.SetStreamHandler(architectureProtocol(cfg.Namespace, cfg.Architecture), newArchitectureHandler())
+	}
+	metadata := newMetadataStore()
+	host.SetStreamHandler(metadataProtocol(cfg.Namespace), newMetadataHandler(ctx, metadata))
+	ks, err := keystore.NewKeystore(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err != nil {
+		return nil, closeOnErr(fmt.Errorf("could not create keystore: %w", err))
 	}
+	closers = append(closers, ks)
 	connectivityGate := channel.NewGate()
 	connectivityGate.Set(true)
 	providerOpts := []provider.Option{
@@ -157,6 +368,7 @@ func NewP2PRouter(ctx context.Context, addr string, bs Bootstrapper, registryPor
 		),
 		provider.WithRouter(kdht),
 		provider.WithHost(host),
+		provider.WithKeystore(ks),
 		provider.WithMessageSender(kdht.MessageSender()),
 		provider.WithSelfAddrs(func() []ma.Multiaddr {
 			return host.Addrs()
@@ -171,7 +383,7 @@ func NewP2PRouter(ctx context.Context, addr string, bs Bootstrapper, registryPor
 	}
 	prov, err := provider.New(providerOpts...)
 	if err != nil {
-		return nil, err
+		return nil, closeOnErr(err)
 	}
 
 	return &P2PRouter{
@@ -179,20 +391,110 @@ func NewP2PRouter(ctx context.Context, addr string, bs Bootstrapper, registryPor
 		host:             host,
 		kdht:             kdht,
 		prov:             prov,
+		keystore:         ks,
+		providerStore:    provStore,
 		balancerGroup:    &singleflight.Group{},
 		balancerCache:    expirable.NewLRU[string, *ClosableBalancer](0, nil, 5*time.Second),
+		negativeCache:    negativeCache,
+		loadCache:        expirable.NewLRU[peer.ID, Load](0, nil, loadCacheTTL),
+		metadata:         metadata,
+		metadataCache:    expirable.NewLRU[string, Metadata](0, nil, metadataCacheTTL),
+		metadataGroup:    &singleflight.Group{},
+		loadGroup:        &singleflight.Group{},
+		loadThreshold:    cfg.LoadThreshold,
 		connectivityGate: connectivityGate,
+		membership:       cfg.Membership,
+		namespace:        cfg.Namespace,
+		architecture:     cfg.Architecture,
 		protocols:        protocols,
 		ip6Support:       len(ip6Addrs) > 0,
 		ip4Support:       len(ip4Addrs) > 0,
+		addrSelector:     selector,
+		relay:            cfg.Relay,
+		streamTransport:  cfg.StreamTransport,
 		registryPort:     uint16(registryPort),
 	}, nil
 }
 
+// newHost creates the libp2p host used by routers.
+func newHost(ctx context.Context, addr string, cfg P2PRouterConfig, selector addrSelector) (host.Host, error) {
+	libp2pCfg := libp2p.Config{}
+	err := libp2pCfg.Apply(cfg.Libp2pOpts...)
+	if err != nil {
+		return nil, err
+	}
+	privateNetwork := len(libp2pCfg.PSK) > 0
+
+	listenAddrs, err := listenMultiaddrs(addr)
+	if err != nil {
+		return nil, err
+	}
+	transportOpts := []libp2p.Option{
+		libp2p.NoTransports,
+	}
+	if privateNetwork {
+		listenAddrs = slices.DeleteFunc(listenAddrs, func(addr ma.Multiaddr) bool {
+			_, err := addr.ValueForProtocol(ma.P_QUIC_V1)
+			return err == nil
+		})
+	} else {
+		transportOpts = append(transportOpts, libp2p.Transport(quic.NewTransport))
+	}
+	transportOpts = append(transportOpts, libp2p.Transport(tcp.NewTCPTransport))
+	hostOpts := []libp2p.Option{
+		libp2p.ChainOptions(transportOpts...),
+		libp2p.ListenAddrs(listenAddrs...),
+		libp2p.PrometheusRegisterer(metrics.DefaultRegisterer),
+		libp2p.AddrsFactory(selector.filterAddrs),
+	}
+	// Relay hosts are set after the host is created as relay candidates are the connected peers.
+	relayHost := &atomic.Pointer[host.Host]{}
+	if cfg.Relay {
+		hostOpts = append(hostOpts,
+			libp2p.EnableRelay(),
+			// Relayed connections use the default limits, so they are only used to establish direct connections.
+			libp2p.EnableRelayService(),
+			libp2p.EnableAutoRelayWithPeerSource(newRelayPeerSource(relayHost)),
+			libp2p.EnableNATService(),
+			libp2p.EnableHolePunching(),
+		)
+	} else {
+		// Observed addresses are only required to traverse NAT.
+		hostOpts = append(hostOpts, libp2p.DisableIdentifyAddressDiscovery())
+	}
+	if cfg.DataDir != "" {
+		peerKey, err := loadOrCreatePrivateKey(ctx, cfg.DataDir)
+		if err != nil {
+			return nil, err
+		}
+		hostOpts = append(hostOpts, libp2p.Identity(peerKey))
+	}
+	if cfg.Membership != nil {
+		hostOpts = append(hostOpts, libp2p.ConnectionGater(cfg.Membership))
+	}
+	hostOpts = append(hostOpts, cfg.Libp2pOpts...)
+	host, err := libp2p.New(hostOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create host: %w", err)
+	}
+	relayHost.Store(&host)
+	if cfg.Membership != nil {
+		err := cfg.Membership.attach(ctx, host, cfg.Namespace)
+		if err != nil {
+			return nil, errors.Join(err, host.Close())
+		}
+	}
+	return host, nil
+}
+
 func (r *P2PRouter) Host() host.Host {
 	return r.host
 }
 
+func (r *P2PRouter) ID() string {
+	return r.host.ID().String()
+}
+
 func (r *P2PRouter) Run(ctx context.Context) error {
 	log := logr.FromContextOrDiscard(ctx).WithName("p2p")
 	log.Info("starting p2p router", "id", r.host.ID())
@@ -255,7 +557,7 @@ func (r *P2PRouter) Run(ctx context.Context) error {
 	if err != nil {
 		errs = append(errs, err)
 	}
-	for _, c := range []io.Closer{r.prov, r.kdht, r.host} {
+	for _, c := range []io.Closer{r.prov, r.keystore, r.kdht, r.host} {
 		err := c.Close()
 		if err != nil {
 			errs = append(errs, err)
@@ -274,11 +576,21 @@ func (r *P2PRouter) Ready(ctx context.Context) (bool, error) {
 
 func (r *P2PRouter) Lookup(ctx context.Context, key string, count int) (Balancer, error) {
 	log := logr.FromContextOrDiscard(ctx).WithValues("host", r.host.ID().String(), "key", key)
-	c, err := createCid(key)
+	c, err := createCid(r.namespace, key)
 	if err != nil {
 		return nil, err
 	}
 
+	if r.negativeCache != nil {
+		if r.negativeCache.Contains(c.String()) {
+			metrics.RouterNegativeCacheTotal.WithLabelValues("hit").Inc()
+			cb := NewClosableBalancer(NewRoundRobin())
+			cb.Close()
+			return cb, nil
+		}
+		metrics.RouterNegativeCacheTotal.WithLabelValues("miss").Inc()
+	}
+
 	bal, err, _ := r.balancerGroup.Do(c.String(), func() (any, error) {
 		cb, ok := r.balancerCache.Get(c.String())
 		if !ok {
@@ -302,10 +614,14 @@ func (r *P2PRouter) Lookup(ctx context.Context, key string, count int) (Balancer
 			r.balancerCache.Add(c.String(), cb)
 		}
 
-		addrInfoCh := r.kdht.FindProvidersAsync(ctx, c, count)
+		// The query is detached from the caller so that the result can be cached for later lookups.
+		queryCtx, queryCancel := context.WithTimeout(context.WithoutCancel(ctx), lookupQueryTimeout)
+		addrInfoCh := r.kdht.FindProvidersAsync(queryCtx, c, count)
 		go func() {
+			defer queryCancel()
 			defer cb.Close()
 
+			metadata, metadataFetched := r.metadataCache.Get(key)
 			lookupTimer := prometheus.NewTimer(metrics.ResolveDurHistogram.WithLabelValues("libp2p"))
 			for addrInfo := range addrInfoCh {
 				lookupTimer.ObserveDuration()
@@ -314,39 +630,68 @@ func (r *P2PRouter) Lookup(ctx context.Context, key string, count int) (Balancer
 				if addrInfo.ID == r.host.ID() {
 					continue
 				}
+				// Skip providers that are not members.
+				if r.membership != nil && !r.membership.Verify(queryCtx, addrInfo) {
+					log.Info("skipping provider that is not a member", "peer", addrInfo.ID.String())
+					metrics.RouterRejectedPeersTotal.WithLabelValues("lookup").Inc()
+					continue
+				}
 
-				ip6Addrs, ip4Addrs := filterAndSplitAddrs(addrInfo.Addrs)
-				ipAddr, err := func() (netip.Addr, error) {
-					errs := []error{}
-					if r.ip6Support {
-						for _, addr := range ip6Addrs {
-							ipAddr, err := toIPAddr(addr)
-							if err != nil {
-								errs = append(errs, err)
-								continue
-							}
-							return ipAddr, nil
-						}
+				peerInfo := PeerInfo{
+					ID: addrInfo.ID.String(),
+				}
+				// Record times are only known for providers stored on this node, as they are not part of DHT responses.
+				if seen, ok := r.providerStore.providerSeen(c.Hash(), addrInfo.ID); ok {
+					peerInfo.Seen = seen
+				}
+				switch {
+				case r.streamTransport:
+					peerInfo.Stream = true
+				case r.relay && slices.ContainsFunc(addrInfo.Addrs, isRelayAddr):
+					// Peers only advertise relay addresses when they are not directly reachable.
+					r.host.Peerstore().AddAddrs(addrInfo.ID, addrInfo.Addrs, peerstore.TempAddrTTL)
+					peerInfo.Stream = true
+				default:
+					ipAddr, err := r.addrSelector.selectIPAddr(addrInfo.Addrs, r.ip6Support, r.ip4Support)
+					if err != nil {
+						log.Error(err, "no suitable IP address found for peer")
+						continue
+					}
+					peerInfo.Addr = netip.AddrPortFrom(ipAddr, r.registryPort)
+				}
+				if !metadataFetched {
+					// Metadata only has to be fetched from the first provider as it describes the key content.
+					// Unknown metadata is fetched in the background to not delay the lookup.
+					metadataFetched = true
+					go r.refreshMetadata(logr.NewContext(context.WithoutCancel(queryCtx), log), addrInfo.ID, key)
+				}
+				peerInfo.Metadata = metadata
+				if r.architecture != "" {
+					peerInfo.Architecture = peerArchitecture(r.host.Peerstore(), r.namespace, addrInfo.ID)
+					if peerInfo.Architecture == "" && r.host.Network().Connectedness(addrInfo.ID) != network.Connected {
+						// Connecting exchanges the supported protocols, making the architecture known for later lookups.
+						go r.connectPeer(logr.NewContext(context.WithoutCancel(queryCtx), log), addrInfo)
 					}
-					if r.ip4Support {
-						for _, addr := range ip4Addrs {
-							ipAddr, err := toIPAddr(addr)
-							if err != nil {
-								errs = append(errs, err)
-								continue
-							}
-							return ipAddr, nil
-						}
+				}
+				if r.loadThreshold != (Load{}) {
+					// Unknown load is fetched in the background to not delay the lookup, peers with unknown load are not overloaded.
+					load, ok := r.loadCache.Get(addrInfo.ID)
+					if ok {
+						peerInfo.Load = load
+						peerInfo.Overloaded = load.Exceeds(r.loadThreshold)
+					} else {
+						go r.refreshLoad(logr.NewContext(context.WithoutCancel(queryCtx), log), addrInfo.ID)
 					}
-					errs = append(errs, errors.New("could not get IP from address"))
-					return netip.Addr{}, errors.Join(errs...)
-				}()
-				if err != nil {
-					log.Error(err, "no suitable IP address found for peer")
-					continue
 				}
-				peer := netip.AddrPortFrom(ipAddr, r.registryPort)
-				cb.Add(peer)
+				cb.Add(peerInfo)
+				if r.negativeCache != nil {
+					r.negativeCache.Remove(c.String())
+				}
+			}
+
+			// Cache keys without providers when the query completed.
+			if r.negativeCache != nil && queryCtx.Err() == nil && cb.Size() == 0 {
+				r.negativeCache.Add(c.String(), nil)
 			}
 		}()
 		return cb, nil
@@ -354,8 +699,55 @@ func (r *P2PRouter) Lookup(ctx context.Context, key string, count int) (Balancer
 	if err != nil {
 		return nil, err
 	}
-	//nolint: errcheck // Impossible to be another type other than Balancer.
-	return bal.(Balancer), nil
+	//nolint: errcheck // Impossible to be another type other than ClosableBalancer.
+	cb := bal.(*ClosableBalancer)
+	// Callers only wait for peers until their context is done, while the query keeps filling the caches.
+	// Metadata fetched in the background is set on peers which were added before it was known.
+	metadata := func() Metadata {
+		metadata, _ := r.metadataCache.Get(key)
+		return metadata
+	}
+	return &contextBalancer{ClosableBalancer: cb, ctx: ctx, metadata: metadata}, nil
+}
+
+// refreshMetadata fetches the metadata of the key from the peer. Metadata that could not be fetched or is
+// invalid is cached as unknown, so that peers are not queried again for every lookup of the key.
+func (r *P2PRouter) refreshMetadata(ctx context.Context, id peer.ID, key string) {
+	//nolint: errcheck // Errors are logged within the function.
+	r.metadataGroup.Do(key, func() (any, error) {
+		ctx := network.WithAllowLimitedConn(ctx, "metadata")
+		metadata, err := fetchMetadata(ctx, r.host, metadataProtocol(r.namespace), id, key)
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).V(1).Info("could not fetch key metadata", "peer", id.String(), "err", err.Error())
+		}
+		if !metadata.IsValid() {
+			metadata = Metadata{}
+		}
+		r.metadataCache.Add(key, metadata)
+		return nil, nil
+	})
+}
+
+func (r *P2PRouter) refreshLoad(ctx context.Context, id peer.ID) {
+	//nolint: errcheck // Errors are logged within the function.
+	r.loadGroup.Do(id.String(), func() (any, error) {
+		load, err := fetchLoad(ctx, r.host, loadProtocol(r.namespace), id)
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).V(1).Info("could not fetch peer load", "peer", id.String(), "err", err.Error())
+			return nil, nil
+		}
+		r.loadCache.Add(id, load)
+		return nil, nil
+	})
+}
+
+func (r *P2PRouter) connectPeer(ctx context.Context, addrInfo peer.AddrInfo) {
+	ctx, cancel := context.WithTimeout(ctx, architectureConnectTimeout)
+	defer cancel()
+	err := r.host.Connect(ctx, addrInfo)
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Info("could not connect to peer", "peer", addrInfo.ID.String(), "err", err.Error())
+	}
 }
 
 func (r *P2PRouter) Advertise(ctx context.Context, keys []string) error {
@@ -364,7 +756,7 @@ func (r *P2PRouter) Advertise(ctx context.Context, keys []string) error {
 	}
 	hs := []mh.Multihash{}
 	for _, key := range keys {
-		c, err := createCid(key)
+		c, err := createCid(r.namespace, key)
 		if err != nil {
 			return err
 		}
@@ -382,13 +774,24 @@ func (r *P2PRouter) Advertise(ctx context.Context, keys []string) error {
 	return nil
 }
 
+// AdvertiseMetadata advertises the keys and serves the metadata to peers that find the keys.
+func (r *P2PRouter) AdvertiseMetadata(ctx context.Context, metadata map[string]Metadata) error {
+	keys := []string{}
+	for key, m := range metadata {
+		r.metadata.Set(key, m)
+		keys = append(keys, key)
+	}
+	return r.Advertise(ctx, keys)
+}
+
 func (r *P2PRouter) Withdraw(ctx context.Context, keys []string) error {
 	if len(keys) == 0 {
 		return nil
 	}
+	r.metadata.Delete(keys...)
 	mhs := []mh.Multihash{}
 	for _, key := range keys {
-		c, err := createCid(key)
+		c, err := createCid(r.namespace, key)
 		if err != nil {
 			return err
 		}
@@ -401,6 +804,48 @@ func (r *P2PRouter) Withdraw(ctx context.Context, keys []string) error {
 	return nil
 }
 
+// WithdrawAll stops advertising all keys and notifies the closest peers that the keys are no longer provided.
+// Peers will remove the provider records instead of waiting for them to expire.
+func (r *P2PRouter) WithdrawAll(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("p2p")
+
+	r.metadata.Clear()
+	hs, err := r.keystore.Get(ctx, "")
+	if err != nil {
+		return err
+	}
+	if len(hs) == 0 {
+		return nil
+	}
+	err = r.prov.StopProviding(hs...)
+	if err != nil {
+		return err
+	}
+
+	peerKeys := map[peer.ID][][]byte{}
+	for _, h := range hs {
+		r.providerStore.WithdrawProvider(h, r.host.ID())
+		for _, id := range r.kdht.RoutingTable().NearestPeers(kb.ConvertKey(string(h)), withdrawPeerCount) {
+			peerKeys[id] = append(peerKeys[id], h)
+		}
+	}
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(10)
+	for id, keys := range peerKeys {
+		g.Go(func() error {
+			err := sendWithdraw(gCtx, r.host, withdrawProtocol(r.namespace), id, keys)
+			if err != nil {
+				log.Error(err, "could not notify peer of withdrawn keys", "peer", id.String())
+			}
+			return nil
+		})
+	}
+	//nolint: errcheck // Errors are logged per peer.
+	g.Wait()
+	log.Info("withdrew all keys", "keys", len(hs), "peers", len(peerKeys))
+	return nil
+}
+
 type Peer struct {
 	ID        string
 	Addresses []string
@@ -498,11 +943,11 @@ func listenMultiaddrs(addr string) ([]ma.Multiaddr, error) {
 	return listenAddrs, nil
 }
 
-func filterAndSplitAddrs(addrs []ma.Multiaddr) ([]ma.Multiaddr, []ma.Multiaddr) {
+func filterAndSplitAddrs(addrs []ma.Multiaddr, allowLoopback bool) ([]ma.Multiaddr, []ma.Multiaddr) {
 	ip6Addrs := []ma.Multiaddr{}
 	ip4Addrs := []ma.Multiaddr{}
 	for _, addr := range addrs {
-		if manet.IsIPLoopback(addr) {
+		if !allowLoopback && manet.IsIPLoopback(addr) {
 			continue
 		}
 		c, _ := ma.SplitFirst(addr)
@@ -532,7 +977,80 @@ func protocolsFromAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
 	return protocols
 }
 
-func createCid(key string) (cid.Cid, error) {
+func protocolPrefix(namespace string) protocol.ID {
+	if namespace == "" {
+		return "/spegel"
+	}
+	return protocol.ID("/spegel/" + namespace)
+}
+
+func withdrawProtocol(namespace string) protocol.ID {
+	return protocolPrefix(namespace) + "/withdraw/1.0.0"
+}
+
+type withdrawMessage struct {
+	Keys [][]byte `json:"keys"`
+}
+
+func sendWithdraw(ctx context.Context, h host.Host, protocolID protocol.ID, id peer.ID, keys [][]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	s, err := h.NewStream(ctx, id, protocolID)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	deadline, _ := ctx.Deadline()
+	err = s.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(s).Encode(withdrawMessage{Keys: keys})
+	if err != nil {
+		return err
+	}
+	err = s.CloseWrite()
+	if err != nil {
+		return err
+	}
+	// Wait for the peer to close the stream after processing the message.
+	_, err = io.Copy(io.Discard, s)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// newWithdrawHandler returns a stream handler that withdraws the provider records of the remote peer.
+// Peers can only withdraw their own provider records.
+func newWithdrawHandler(ctx context.Context, ps *withdrawableProviderStore) network.StreamHandler {
+	log := logr.FromContextOrDiscard(ctx).WithName("p2p")
+	return func(s network.Stream) {
+		defer s.Close()
+
+		err := s.SetDeadline(time.Now().Add(5 * time.Second))
+		if err != nil {
+			log.Error(err, "could not set withdraw stream deadline")
+			return
+		}
+		msg := withdrawMessage{}
+		err = json.NewDecoder(io.LimitReader(s, 16<<20)).Decode(&msg)
+		if err != nil {
+			log.Error(err, "could not decode withdraw message")
+			return
+		}
+		id := s.Conn().RemotePeer()
+		for _, key := range msg.Keys {
+			ps.WithdrawProvider(key, id)
+		}
+		log.V(1).Info("withdrew provider records", "peer", id.String(), "keys", len(msg.Keys))
+	}
+}
+
+func createCid(namespace, key string) (cid.Cid, error) {
+	if namespace != "" {
+		key = namespace + "/" + key
+	}
 	pref := cid.Prefix{
 		Version:  1,
 		Codec:    uint64(mc.Raw),
@@ -558,7 +1076,26 @@ func addrsEqual(a1, a2 []ma.Multiaddr) bool {
 }
 
 func bootstrapPeers(ctx context.Context, bs Bootstrapper, kdht *dht.IpfsDHT, protocols []ma.Multiaddr) error {
-	// Attempt to connect to bootstrap peers.
+	err := connectBootstrapPeers(ctx, bs, kdht.Host(), protocols)
+	if err != nil {
+		return err
+	}
+
+	// Refresh routing table.
+	if kdht.RoutingTable().Size() == 0 {
+		return errors.New("routing table is empty after bootstrapping")
+	}
+	errCh := kdht.RefreshRoutingTable()
+	err = <-errCh
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// connectBootstrapPeers attempts to connect the host to the bootstrap peers.
+// An error is returned if the host is unable to connect to any of the peers.
+func connectBootstrapPeers(ctx context.Context, bs Bootstrapper, h host.Host, protocols []ma.Multiaddr) error {
 	bootstrapCtx, bootstrapCancel := context.WithTimeout(ctx, 30*time.Second)
 	defer bootstrapCancel()
 
@@ -567,7 +1104,7 @@ func bootstrapPeers(ctx context.Context, bs Bootstrapper, kdht *dht.IpfsDHT, pro
 		return err
 	}
 	errs := []error{}
-	self := *host.InfoFromHost(kdht.Host())
+	self := *host.InfoFromHost(h)
 	for _, addrInfo := range addrInfos {
 		// If ID is not empty and match it is self.
 		if self.ID != "" && addrInfo.ID != "" && self.ID == addrInfo.ID {
@@ -603,18 +1140,18 @@ func bootstrapPeers(ctx context.Context, bs Bootstrapper, kdht *dht.IpfsDHT, pro
 				return err
 			}
 			addrInfo.ID = id
-			err = kdht.Host().Connect(bootstrapCtx, addrInfo)
+			err = h.Connect(bootstrapCtx, addrInfo)
 			var mismatchErr sec.ErrPeerIDMismatch
 			if !errors.As(err, &mismatchErr) {
 				errs = append(errs, err)
 				continue
 			}
-			kdht.Host().Peerstore().ClearAddrs(addrInfo.ID)
-			kdht.Host().Peerstore().RemovePeer(addrInfo.ID)
+			h.Peerstore().ClearAddrs(addrInfo.ID)
+			h.Peerstore().RemovePeer(addrInfo.ID)
 			addrInfo.ID = mismatchErr.Actual
 		}
 
-		err := kdht.Host().Connect(bootstrapCtx, addrInfo)
+		err := h.Connect(bootstrapCtx, addrInfo)
 		if err != nil {
 			errs = append(errs, err)
 			continue
@@ -623,16 +1160,6 @@ func bootstrapPeers(ctx context.Context, bs Bootstrapper, kdht *dht.IpfsDHT, pro
 	if len(errs) == len(addrInfos) {
 		return errors.Join(errs...)
 	}
-
-	// Refresh routing table.
-	if kdht.RoutingTable().Size() == 0 {
-		return errors.New("routing table is empty after bootstrapping")
-	}
-	errCh := kdht.RefreshRoutingTable()
-	err = <-errCh
-	if err != nil {
-		return err
-	}
 	return nil
 }
 
@@ -673,8 +1200,16 @@ func loadOrCreatePrivateKey(ctx context.Context, dataDir string) (crypto.PrivKey
 		return privKey, nil
 	}
 	log.Info("loading the private key from data directory")
+	return ParsePrivateKey(b)
+}
+
+// ParsePrivateKey parses a PEM encoded PKCS8 Ed25519 private key.
+func ParsePrivateKey(b []byte) (crypto.PrivKey, error) {
 	block, _ := pem.Decode(b)
-	if block == nil || block.Type != "PRIVATE KEY" {
+	if block == nil {
+		return nil, errors.New("could not decode PEM block")
+	}
+	if block.Type != "PRIVATE KEY" {
 		return nil, fmt.Errorf("invalid PEM block type %s", block.Type)
 	}
 	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
@@ -2,6 +2,9 @@ package routing
 
 import (
 	"context"
+	"crypto/rand"
+	"net/netip"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -11,6 +14,9 @@ import (
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/pnet"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
 	"github.com/stretchr/testify/assert"
@@ -29,12 +35,40 @@ func TestP2PRouterOptions(t *testing.T) {
 	opts := []P2PRouterOption{
 		WithLibP2POptions(libp2pOpts...),
 		WithDataDir("foobar"),
+		WithNamespace("tenant"),
+		WithNegativeCacheTTL(time.Minute),
+		WithAllowLoopback(true),
+		WithPreferredCIDRs(netip.MustParsePrefix("10.0.0.0/8")),
+		WithPreferredInterfaces("eth1"),
+		WithAddressFamily(AddressFamilyIPv4),
+		WithRelay(true),
+		WithStreamTransport(true),
 	}
 	cfg := P2PRouterConfig{}
 	err := option.Apply(&cfg, opts...)
 	require.NoError(t, err)
 	require.Equal(t, libp2pOpts, cfg.Libp2pOpts)
 	require.Equal(t, "foobar", cfg.DataDir)
+	require.Equal(t, "tenant", cfg.Namespace)
+	require.Equal(t, time.Minute, cfg.NegativeCacheTTL)
+	require.True(t, cfg.AllowLoopback)
+	require.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, cfg.PreferredCIDRs)
+	require.Equal(t, []string{"eth1"}, cfg.PreferredInterfaces)
+	require.Equal(t, AddressFamilyIPv4, cfg.AddressFamily)
+	require.True(t, cfg.Relay)
+	require.True(t, cfg.StreamTransport)
+
+	err = option.Apply(&cfg, WithNegativeCacheTTL(-time.Second))
+	require.EqualError(t, err, "negative cache TTL cannot be negative")
+	err = option.Apply(&cfg, WithLoadThreshold(Load{ActiveUploads: -1}))
+	require.EqualError(t, err, "load threshold cannot be negative")
+	err = option.Apply(&cfg, WithAddressFamily("ipx"))
+	require.EqualError(t, err, `unknown address family "ipx"`)
+	err = option.Apply(&cfg, WithPreferredCIDRs(netip.Prefix{}))
+	require.EqualError(t, err, "invalid preferred CIDR invalid Prefix")
+
+	err = option.Apply(&cfg, WithNamespace("foo/bar"))
+	require.EqualError(t, err, `invalid namespace "foo/bar" cannot contain slashes or whitespace`)
 }
 
 func TestP2PRouter(t *testing.T) {
@@ -60,7 +94,7 @@ func TestP2PRouter(t *testing.T) {
 	ready, err := primaryRouter.Ready(t.Context())
 	require.NoError(t, err)
 	require.False(t, ready)
-	ip6Addrs, ip4Addrs := filterAndSplitAddrs(primaryRouter.host.Addrs())
+	ip6Addrs, ip4Addrs := filterAndSplitAddrs(primaryRouter.host.Addrs(), false)
 	primaryIP, err := manet.ToIP(append(ip6Addrs, ip4Addrs...)[0])
 	require.NoError(t, err)
 
@@ -76,7 +110,7 @@ func TestP2PRouter(t *testing.T) {
 	require.NoError(t, err)
 
 	// Provider store should contain self.
-	c, err := createCid(advertisedKey)
+	c, err := createCid("", advertisedKey)
 	require.NoError(t, err)
 	addrInfos, err := primaryRouter.kdht.FindProviders(t.Context(), c)
 	require.NoError(t, err)
@@ -127,10 +161,11 @@ func TestP2PRouter(t *testing.T) {
 	for _, r := range routers {
 		bal, err = r.Lookup(t.Context(), advertisedKey, 3)
 		require.NoError(t, err)
-		addrPort, err := bal.Next()
+		peer, err := bal.Next()
 		require.NoError(t, err)
-		require.Equal(t, primaryIP.String(), addrPort.Addr().String())
-		require.Equal(t, uint16(9091), addrPort.Port())
+		require.Equal(t, primaryRouter.ID(), peer.ID)
+		require.Equal(t, primaryIP.String(), peer.Addr.Addr().String())
+		require.Equal(t, uint16(9091), peer.Addr.Port())
 
 		bal, err = r.Lookup(t.Context(), "wont find key", 3)
 		require.NoError(t, err)
@@ -141,7 +176,7 @@ func TestP2PRouter(t *testing.T) {
 	// Advertise key from another router and lookup.
 	newKey := "new"
 	lastRouter := routers[len(routers)-1]
-	ip6Addrs, ip4Addrs = filterAndSplitAddrs(lastRouter.host.Addrs())
+	ip6Addrs, ip4Addrs = filterAndSplitAddrs(lastRouter.host.Addrs(), false)
 	lastIP, err := manet.ToIP(append(ip6Addrs, ip4Addrs...)[0])
 	require.NoError(t, err)
 	err = lastRouter.Advertise(t.Context(), []string{newKey})
@@ -153,9 +188,9 @@ func TestP2PRouter(t *testing.T) {
 
 	bal, err = primaryRouter.Lookup(t.Context(), newKey, 3)
 	require.NoError(t, err)
-	addrPort, err := bal.Next()
+	peer, err := bal.Next()
 	require.NoError(t, err)
-	require.Equal(t, lastIP.String(), addrPort.Addr().String())
+	require.Equal(t, lastIP.String(), peer.Addr.Addr().String())
 
 	// Shutdown should complete without errors.
 	cancel()
@@ -163,6 +198,147 @@ func TestP2PRouter(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestP2PRouterPrivateNetwork(t *testing.T) {
+	t.Parallel()
+
+	psk := make(pnet.PSK, 32)
+	_, err := rand.Read(psk)
+	require.NoError(t, err)
+	otherPsk := make(pnet.PSK, 32)
+	_, err = rand.Read(otherPsk)
+	require.NoError(t, err)
+
+	routers := []*P2PRouter{}
+	for _, key := range []pnet.PSK{psk, psk, otherPsk} {
+		r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithLibP2POptions(libp2p.PrivateNetwork(key)))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.host.Close()
+		})
+		for _, addr := range r.host.Addrs() {
+			_, err := addr.ValueForProtocol(ma.P_QUIC_V1)
+			require.Error(t, err)
+		}
+		routers = append(routers, r)
+	}
+
+	err = routers[0].host.Connect(t.Context(), *host.InfoFromHost(routers[1].host))
+	require.NoError(t, err)
+	connectCtx, connectCancel := context.WithTimeout(t.Context(), time.Second)
+	defer connectCancel()
+	err = routers[0].host.Connect(connectCtx, *host.InfoFromHost(routers[2].host))
+	require.Error(t, err)
+}
+
+func TestP2PRouterWithdrawAll(t *testing.T) {
+	t.Parallel()
+
+	routers := []*P2PRouter{}
+	for range 2 {
+		r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.host.Close()
+		})
+		routers = append(routers, r)
+	}
+	withdrawRouter, otherRouter := routers[0], routers[1]
+	err := withdrawRouter.host.Connect(t.Context(), *host.InfoFromHost(otherRouter.host))
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		require.NotEmpty(c, withdrawRouter.kdht.RoutingTable().Find(otherRouter.host.ID()))
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Withdraw without keys should do nothing.
+	err = withdrawRouter.WithdrawAll(t.Context())
+	require.NoError(t, err)
+
+	err = withdrawRouter.Advertise(t.Context(), []string{"foo", "bar"})
+	require.NoError(t, err)
+	hs := [][]byte{}
+	for _, key := range []string{"foo", "bar"} {
+		c, err := createCid("", key)
+		require.NoError(t, err)
+		hs = append(hs, c.Hash())
+		err = otherRouter.providerStore.AddProvider(t.Context(), c.Hash(), peer.AddrInfo{ID: withdrawRouter.host.ID()})
+		require.NoError(t, err)
+	}
+
+	err = withdrawRouter.WithdrawAll(t.Context())
+	require.NoError(t, err)
+	keys, err := withdrawRouter.keystore.Get(t.Context(), "")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	for _, h := range hs {
+		addrInfos, err := withdrawRouter.providerStore.GetProviders(t.Context(), h)
+		require.NoError(t, err)
+		require.Empty(t, addrInfos)
+		addrInfos, err = otherRouter.providerStore.GetProviders(t.Context(), h)
+		require.NoError(t, err)
+		require.Empty(t, addrInfos)
+	}
+}
+
+func TestP2PRouterNegativeCache(t *testing.T) {
+	t.Parallel()
+
+	r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithNegativeCacheTTL(time.Minute))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		r.host.Close()
+	})
+	keyCid, err := createCid("", "foo")
+	require.NoError(t, err)
+
+	// Keys without providers should be cached after the query completes.
+	bal, err := r.Lookup(t.Context(), "foo", 1)
+	require.NoError(t, err)
+	_, err = bal.Next()
+	require.ErrorIs(t, err, ErrNoNext)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		require.True(c, r.negativeCache.Contains(keyCid.String()))
+	}, 5*time.Second, 10*time.Millisecond)
+	bal, err = r.Lookup(t.Context(), "foo", 1)
+	require.NoError(t, err)
+	_, err = bal.Next()
+	require.ErrorIs(t, err, ErrNoNext)
+
+	// Observing a provider should invalidate the cache.
+	err = r.providerStore.AddProvider(t.Context(), keyCid.Hash(), peer.AddrInfo{ID: generatePeerID(t)})
+	require.NoError(t, err)
+	require.False(t, r.negativeCache.Contains(keyCid.String()))
+
+	// Returning providers to any lookup should invalidate the cache.
+	r.negativeCache.Add(keyCid.String(), nil)
+	addrInfos, err := r.providerStore.GetProviders(t.Context(), keyCid.Hash())
+	require.NoError(t, err)
+	require.NotEmpty(t, addrInfos)
+	require.False(t, r.negativeCache.Contains(keyCid.String()))
+
+	// Advertising the key should invalidate the cache.
+	r.negativeCache.Add(keyCid.String(), nil)
+	err = r.Advertise(t.Context(), []string{"foo"})
+	require.NoError(t, err)
+	require.False(t, r.negativeCache.Contains(keyCid.String()))
+}
+
+func TestP2PRouterCloseOnError(t *testing.T) {
+	t.Parallel()
+
+	// Creating the provider fails after the provider store has been opened.
+	dataDir := t.TempDir()
+	_, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithDataDir(dataDir), WithAdvertiseTTL(0))
+	require.Error(t, err)
+
+	// The provider store lock should be released.
+	pstore, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	defer pstore.Close()
+	ps, err := NewPersistentProviderStore(t.Context(), filepath.Join(dataDir, "providers.db"), generatePeerID(t), pstore, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, ps.Close())
+}
+
 func TestListenMultiaddrs(t *testing.T) {
 	t.Parallel()
 
@@ -214,9 +390,24 @@ func TestListenMultiaddrs(t *testing.T) {
 func TestCreateCid(t *testing.T) {
 	t.Parallel()
 
-	c, err := createCid("foobar")
+	c, err := createCid("", "foobar")
 	require.NoError(t, err)
 	require.Equal(t, "bafkreigdvoh7cnza5cwzar65hfdgwpejotszfqx2ha6uuolaofgk54ge6i", c.String())
+
+	// Namespaced keys should not collide with the same key in another namespace.
+	nsC, err := createCid("tenant", "foobar")
+	require.NoError(t, err)
+	require.NotEqual(t, c, nsC)
+	otherNsC, err := createCid("other", "foobar")
+	require.NoError(t, err)
+	require.NotEqual(t, nsC, otherNsC)
+}
+
+func TestProtocolPrefix(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, protocol.ID("/spegel"), protocolPrefix(""))
+	require.Equal(t, protocol.ID("/spegel/tenant"), protocolPrefix("tenant"))
 }
 
 func TestAddrsEqual(t *testing.T) {
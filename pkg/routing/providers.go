@@ -0,0 +1,434 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/libp2p/go-libp2p-kad-dht/records"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	bolt "go.etcd.io/bbolt"
+)
+
+// providerFlushInterval is how often added provider records are written to disk.
+const providerFlushInterval = time.Second
+
+var providersBucket = []byte("providers")
+
+type providerRecord struct {
+	Seen     time.Time     `json:"seen"`
+	AddrInfo peer.AddrInfo `json:"addrInfo"`
+}
+
+var _ records.ProviderStore = &PersistentProviderStore{}
+
+// PersistentProviderStore is a provider store that persists provider records to disk.
+// Records are kept across restarts and expire when they are older than the max record age.
+// Added records are written to disk in batches, and provider addresses are also kept in the
+// peerstore so that addresses learned after the record was added are returned.
+type PersistentProviderStore struct {
+	pstore       peerstore.Peerstore
+	db           *bolt.DB
+	cancel       context.CancelFunc
+	closed       chan any
+	pending      map[string]map[peer.ID]providerRecord
+	self         peer.ID
+	maxRecordAge time.Duration
+	mx           sync.Mutex
+}
+
+func NewPersistentProviderStore(ctx context.Context, path string, self peer.ID, pstore peerstore.Peerstore, maxRecordAge time.Duration) (*PersistentProviderStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(providersBucket)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	ps := &PersistentProviderStore{
+		pstore:       pstore,
+		db:           db,
+		cancel:       cancel,
+		closed:       make(chan any),
+		pending:      map[string]map[peer.ID]providerRecord{},
+		self:         self,
+		maxRecordAge: maxRecordAge,
+	}
+	go ps.run(ctx)
+	return ps, nil
+}
+
+func (ps *PersistentProviderStore) run(ctx context.Context) {
+	defer close(ps.closed)
+
+	log := logr.FromContextOrDiscard(ctx).WithName("providers")
+	ticker := time.NewTicker(min(ps.maxRecordAge, time.Hour))
+	defer ticker.Stop()
+	flushTicker := time.NewTicker(providerFlushInterval)
+	defer flushTicker.Stop()
+	err := ps.removeExpired(time.Now())
+	if err != nil {
+		log.Error(err, "could not remove expired provider records")
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			err := ps.flush()
+			if err != nil {
+				log.Error(err, "could not write provider records")
+			}
+			return
+		case <-flushTicker.C:
+			err := ps.flush()
+			if err != nil {
+				log.Error(err, "could not write provider records")
+			}
+		case <-ticker.C:
+			err := ps.removeExpired(time.Now())
+			if err != nil {
+				log.Error(err, "could not remove expired provider records")
+			}
+		}
+	}
+}
+
+func (ps *PersistentProviderStore) AddProvider(ctx context.Context, key []byte, prov peer.AddrInfo) error {
+	if prov.ID != ps.self {
+		ps.pstore.AddAddrs(prov.ID, prov.Addrs, records.ProviderAddrTTL)
+	}
+	ps.put(key, prov, time.Now())
+	return nil
+}
+
+func (ps *PersistentProviderStore) GetProviders(ctx context.Context, key []byte) ([]peer.AddrInfo, error) {
+	// Records not yet written are read first so that records flushed in the meantime are read from disk.
+	ps.mx.Lock()
+	pending := maps.Clone(ps.pending[string(key)])
+	ps.mx.Unlock()
+
+	recs := []providerRecord{}
+	err := ps.db.View(func(tx *bolt.Tx) error {
+		keyBucket := tx.Bucket(providersBucket).Bucket(key)
+		if keyBucket == nil {
+			return nil
+		}
+		return keyBucket.ForEach(func(_, v []byte) error {
+			rec := providerRecord{}
+			err := json.Unmarshal(v, &rec)
+			if err != nil {
+				return err
+			}
+			recs = append(recs, rec)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Records not yet written to disk replace the persisted records of the same peer.
+	for i, rec := range recs {
+		if pendingRec, ok := pending[rec.AddrInfo.ID]; ok {
+			recs[i] = pendingRec
+		}
+	}
+	for id, rec := range pending {
+		if !slices.ContainsFunc(recs, func(existing providerRecord) bool { return existing.AddrInfo.ID == id }) {
+			recs = append(recs, rec)
+		}
+	}
+
+	now := time.Now()
+	addrInfos := []peer.AddrInfo{}
+	for _, rec := range recs {
+		if ps.isExpired(rec, now) {
+			continue
+		}
+		addrInfo := rec.AddrInfo
+		for _, addr := range ps.pstore.Addrs(addrInfo.ID) {
+			if slices.ContainsFunc(addrInfo.Addrs, addr.Equal) {
+				continue
+			}
+			addrInfo.Addrs = append(addrInfo.Addrs, addr)
+		}
+		addrInfos = append(addrInfos, addrInfo)
+	}
+	return addrInfos, nil
+}
+
+// ProviderSeen returns when the provider record of the peer for the key was last stored.
+func (ps *PersistentProviderStore) ProviderSeen(key []byte, id peer.ID) (time.Time, bool, error) {
+	ps.mx.Lock()
+	rec, found := ps.pending[string(key)][id]
+	ps.mx.Unlock()
+	if found {
+		return rec.Seen, !ps.isExpired(rec, time.Now()), nil
+	}
+	err := ps.db.View(func(tx *bolt.Tx) error {
+		keyBucket := tx.Bucket(providersBucket).Bucket(key)
+		if keyBucket == nil {
+			return nil
+		}
+		v := keyBucket.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &rec)
+	})
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !found || ps.isExpired(rec, time.Now()) {
+		return time.Time{}, false, nil
+	}
+	return rec.Seen, true, nil
+}
+
+func (ps *PersistentProviderStore) Close() error {
+	ps.cancel()
+	<-ps.closed
+	return ps.db.Close()
+}
+
+// put adds the provider record to the records written to disk on the next flush.
+func (ps *PersistentProviderStore) put(key []byte, prov peer.AddrInfo, seen time.Time) {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+
+	recs, ok := ps.pending[string(key)]
+	if !ok {
+		recs = map[peer.ID]providerRecord{}
+		ps.pending[string(key)] = recs
+	}
+	recs[prov.ID] = providerRecord{
+		AddrInfo: prov,
+		Seen:     seen,
+	}
+}
+
+// flush writes the added provider records to disk in a single transaction.
+func (ps *PersistentProviderStore) flush() error {
+	ps.mx.Lock()
+	pending := ps.pending
+	ps.pending = map[string]map[peer.ID]providerRecord{}
+	ps.mx.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := ps.db.Update(func(tx *bolt.Tx) error {
+		for key, recs := range pending {
+			keyBucket, err := tx.Bucket(providersBucket).CreateBucketIfNotExists([]byte(key))
+			if err != nil {
+				return err
+			}
+			for id, rec := range recs {
+				b, err := json.Marshal(rec)
+				if err != nil {
+					return err
+				}
+				err = keyBucket.Put([]byte(id), b)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Records are kept for the next flush, unless newer records have been added since.
+		ps.mx.Lock()
+		for key, recs := range pending {
+			if _, ok := ps.pending[key]; !ok {
+				ps.pending[key] = map[peer.ID]providerRecord{}
+			}
+			for id, rec := range recs {
+				if _, ok := ps.pending[key][id]; !ok {
+					ps.pending[key][id] = rec
+				}
+			}
+		}
+		ps.mx.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (ps *PersistentProviderStore) removeExpired(now time.Time) error {
+	return ps.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(providersBucket)
+		expired := map[string][][]byte{}
+		emptyKeys := [][]byte{}
+		err := bucket.ForEachBucket(func(key []byte) error {
+			total := 0
+			err := bucket.Bucket(key).ForEach(func(id, v []byte) error {
+				total++
+				rec := providerRecord{}
+				err := json.Unmarshal(v, &rec)
+				if err != nil || ps.isExpired(rec, now) {
+					expired[string(key)] = append(expired[string(key)], bytes.Clone(id))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if total == len(expired[string(key)]) {
+				emptyKeys = append(emptyKeys, bytes.Clone(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range emptyKeys {
+			err := bucket.DeleteBucket(key)
+			if err != nil {
+				return err
+			}
+			delete(expired, string(key))
+		}
+		for key, ids := range expired {
+			keyBucket := bucket.Bucket([]byte(key))
+			for _, id := range ids {
+				err := keyBucket.Delete(id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (ps *PersistentProviderStore) isExpired(rec providerRecord, now time.Time) bool {
+	return now.Sub(rec.Seen) > ps.maxRecordAge
+}
+
+var _ records.ProviderStore = &withdrawableProviderStore{}
+
+// withdrawableProviderStore wraps a provider store to allow peers to withdraw their provider records.
+// Withdrawn records are hidden until the peer provides the key again or the withdrawal expires.
+type withdrawableProviderStore struct {
+	records.ProviderStore
+	// onProvidersFound is called with the key when a provider is added or returned.
+	onProvidersFound func(key []byte)
+	withdrawn        map[string]map[peer.ID]time.Time
+	ttl              time.Duration
+	mx               sync.Mutex
+}
+
+func newWithdrawableProviderStore(ps records.ProviderStore, ttl time.Duration) *withdrawableProviderStore {
+	return &withdrawableProviderStore{
+		ProviderStore: ps,
+		withdrawn:     map[string]map[peer.ID]time.Time{},
+		ttl:           ttl,
+	}
+}
+
+func (ps *withdrawableProviderStore) AddProvider(ctx context.Context, key []byte, prov peer.AddrInfo) error {
+	ps.mx.Lock()
+	if ids, ok := ps.withdrawn[string(key)]; ok {
+		delete(ids, prov.ID)
+		if len(ids) == 0 {
+			delete(ps.withdrawn, string(key))
+		}
+	}
+	ps.mx.Unlock()
+	err := ps.ProviderStore.AddProvider(ctx, key, prov)
+	if err != nil {
+		return err
+	}
+	if ps.onProvidersFound != nil {
+		ps.onProvidersFound(key)
+	}
+	return nil
+}
+
+func (ps *withdrawableProviderStore) GetProviders(ctx context.Context, key []byte) ([]peer.AddrInfo, error) {
+	addrInfos, err := ps.ProviderStore.GetProviders(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ps.mx.Lock()
+	ids := ps.withdrawn[string(key)]
+	now := time.Now()
+	filtered := []peer.AddrInfo{}
+	for _, addrInfo := range addrInfos {
+		withdrawnAt, ok := ids[addrInfo.ID]
+		if ok && now.Sub(withdrawnAt) <= ps.ttl {
+			continue
+		}
+		filtered = append(filtered, addrInfo)
+	}
+	ps.mx.Unlock()
+	if len(filtered) > 0 && ps.onProvidersFound != nil {
+		ps.onProvidersFound(key)
+	}
+	return filtered, nil
+}
+
+// providerSeen returns when the provider record was stored if the wrapped store keeps record times.
+// Records which are withdrawn, expired or held by other nodes are unknown.
+func (ps *withdrawableProviderStore) providerSeen(key []byte, id peer.ID) (time.Time, bool) {
+	seenStore, ok := ps.ProviderStore.(interface {
+		ProviderSeen(key []byte, id peer.ID) (time.Time, bool, error)
+	})
+	if !ok {
+		return time.Time{}, false
+	}
+	ps.mx.Lock()
+	withdrawnAt, withdrawn := ps.withdrawn[string(key)][id]
+	ps.mx.Unlock()
+	if withdrawn && time.Since(withdrawnAt) <= ps.ttl {
+		return time.Time{}, false
+	}
+	seen, ok, err := seenStore.ProviderSeen(key, id)
+	if err != nil || !ok {
+		return time.Time{}, false
+	}
+	return seen, true
+}
+
+// WithdrawProvider hides the provider record of the peer for the given key.
+func (ps *withdrawableProviderStore) WithdrawProvider(key []byte, id peer.ID) {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+
+	now := time.Now()
+	ps.removeExpired(now)
+	ids, ok := ps.withdrawn[string(key)]
+	if !ok {
+		ids = map[peer.ID]time.Time{}
+		ps.withdrawn[string(key)] = ids
+	}
+	ids[id] = now
+}
+
+func (ps *withdrawableProviderStore) removeExpired(now time.Time) {
+	for key, ids := range ps.withdrawn {
+		for id, withdrawnAt := range ids {
+			if now.Sub(withdrawnAt) > ps.ttl {
+				delete(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(ps.withdrawn, key)
+		}
+	}
+}
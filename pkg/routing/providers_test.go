@@ -0,0 +1,151 @@
+package routing
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentProviderStore(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "providers.db")
+	key := []byte("foo")
+	ids := []peer.ID{}
+	for range 2 {
+		priv, _, err := crypto.GenerateEd25519Key(nil)
+		require.NoError(t, err)
+		id, err := peer.IDFromPrivateKey(priv)
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	addrInfo := peer.AddrInfo{
+		ID:    ids[0],
+		Addrs: []ma.Multiaddr{ma.StringCast("/ip4/10.0.0.1/tcp/5001")},
+	}
+	expiredAddrInfo := peer.AddrInfo{
+		ID: ids[1],
+	}
+
+	pstore, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		pstore.Close()
+	})
+	ps, err := NewPersistentProviderStore(t.Context(), path, generatePeerID(t), pstore, time.Minute)
+	require.NoError(t, err)
+	addrInfos, err := ps.GetProviders(t.Context(), key)
+	require.NoError(t, err)
+	require.Empty(t, addrInfos)
+	err = ps.AddProvider(t.Context(), key, addrInfo)
+	require.NoError(t, err)
+	ps.put(key, expiredAddrInfo, time.Now().Add(-2*time.Minute))
+	ps.put([]byte("bar"), expiredAddrInfo, time.Now().Add(-2*time.Minute))
+	addrInfos, err = ps.GetProviders(t.Context(), key)
+	require.NoError(t, err)
+	require.Equal(t, []peer.AddrInfo{addrInfo}, addrInfos)
+
+	// Records should be returned the same once written to disk.
+	err = ps.flush()
+	require.NoError(t, err)
+	require.Empty(t, ps.pending)
+	addrInfos, err = ps.GetProviders(t.Context(), key)
+	require.NoError(t, err)
+	require.Equal(t, []peer.AddrInfo{addrInfo}, addrInfos)
+
+	// Addresses of the provider in the peerstore should be merged with the stored addresses.
+	newAddr := ma.StringCast("/ip4/10.0.0.2/tcp/5001")
+	pstore.AddAddr(addrInfo.ID, newAddr, time.Minute)
+	addrInfos, err = ps.GetProviders(t.Context(), key)
+	require.NoError(t, err)
+	require.Equal(t, []peer.AddrInfo{{ID: addrInfo.ID, Addrs: append(slices.Clone(addrInfo.Addrs), newAddr)}}, addrInfos)
+	pstore.ClearAddrs(addrInfo.ID)
+
+	// Record times should only be returned for stored records which have not expired.
+	seen, ok, err := ps.ProviderSeen(key, addrInfo.ID)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now(), seen, 5*time.Second)
+	_, ok, err = ps.ProviderSeen(key, expiredAddrInfo.ID)
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = ps.ProviderSeen([]byte("baz"), addrInfo.ID)
+	require.NoError(t, err)
+	require.False(t, ok)
+	err = ps.Close()
+	require.NoError(t, err)
+
+	// Records should be available after reopening the store.
+	ps, err = NewPersistentProviderStore(t.Context(), path, generatePeerID(t), pstore, time.Minute)
+	require.NoError(t, err)
+	addrInfos, err = ps.GetProviders(t.Context(), key)
+	require.NoError(t, err)
+	require.Equal(t, []peer.AddrInfo{addrInfo}, addrInfos)
+
+	// Expired records should be removed.
+	err = ps.removeExpired(time.Now().Add(2 * time.Minute))
+	require.NoError(t, err)
+	addrInfos, err = ps.GetProviders(t.Context(), key)
+	require.NoError(t, err)
+	require.Empty(t, addrInfos)
+	addrInfos, err = ps.GetProviders(t.Context(), []byte("bar"))
+	require.NoError(t, err)
+	require.Empty(t, addrInfos)
+	err = ps.Close()
+	require.NoError(t, err)
+}
+
+func TestWithdrawableProviderStore(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("foo")
+	withdrawnID := generatePeerID(t)
+	otherID := generatePeerID(t)
+	pstore, err := pstoremem.NewPeerstore()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		pstore.Close()
+	})
+	base, err := NewPersistentProviderStore(t.Context(), filepath.Join(t.TempDir(), "providers.db"), generatePeerID(t), pstore, time.Hour)
+	require.NoError(t, err)
+	ps := newWithdrawableProviderStore(base, time.Minute)
+	t.Cleanup(func() {
+		ps.Close()
+	})
+
+	for _, id := range []peer.ID{withdrawnID, otherID} {
+		err = ps.AddProvider(t.Context(), key, peer.AddrInfo{ID: id})
+		require.NoError(t, err)
+	}
+
+	// Withdrawn providers should be hidden.
+	ps.WithdrawProvider(key, withdrawnID)
+	addrInfos, err := ps.GetProviders(t.Context(), key)
+	require.NoError(t, err)
+	require.Len(t, addrInfos, 1)
+	require.Equal(t, otherID, addrInfos[0].ID)
+	_, ok := ps.providerSeen(key, withdrawnID)
+	require.False(t, ok)
+	_, ok = ps.providerSeen(key, otherID)
+	require.True(t, ok)
+
+	// Providing again should clear the withdrawal.
+	err = ps.AddProvider(t.Context(), key, peer.AddrInfo{ID: withdrawnID})
+	require.NoError(t, err)
+	addrInfos, err = ps.GetProviders(t.Context(), key)
+	require.NoError(t, err)
+	require.Len(t, addrInfos, 2)
+	require.Empty(t, ps.withdrawn)
+
+	// Expired withdrawals should be removed.
+	ps.WithdrawProvider(key, withdrawnID)
+	ps.removeExpired(time.Now().Add(2 * time.Minute))
+	require.Empty(t, ps.withdrawn)
+}
@@ -2,6 +2,8 @@ package routing
 
 import (
 	"context"
+	"net/netip"
+	"time"
 )
 
 // Router implements the discovery of content.
@@ -15,3 +17,32 @@ type Router interface {
 	// Withdraw stops the broadcasting the availability of the given keys to the network.
 	Withdraw(ctx context.Context, keys []string) error
 }
+
+// PeerInfo describes a peer returned by a lookup.
+type PeerInfo struct {
+	// Seen is when the peer was last known to provide the key, zero when unknown.
+	Seen time.Time
+	// ID is the router specific identifier of the peer, empty when unknown.
+	ID string
+	// Architecture is the architecture of the peer, empty when unknown.
+	Architecture string
+	// Addr is the registry address of the peer, not set when the peer is reached over a stream.
+	Addr netip.AddrPort
+	// Metadata describes the content of the key, zero when unknown.
+	Metadata Metadata
+	// Load is the last known load of the peer, zero when unknown.
+	Load Load
+	// Overloaded is true when the last known load of the peer exceeds the load threshold, false when unknown.
+	Overloaded bool
+	// Stream is true when the peer registry has to be dialed over a router stream using the ID,
+	// either because the peer is not directly reachable or stream transport is enabled.
+	Stream bool
+}
+
+// samePeer returns true if both peers have the same address, or the same ID when the address is not set.
+func samePeer(a, b PeerInfo) bool {
+	if a.Addr.IsValid() || b.Addr.IsValid() {
+		return a.Addr == b.Addr
+	}
+	return a.ID == b.ID
+}
@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/host/autorelay"
+	"github.com/libp2p/go-libp2p/p2p/net/gostream"
+
+	"github.com/spegel-org/spegel/pkg/metrics"
+)
+
+func distributionProtocol(namespace string) protocol.ID {
+	return protocolPrefix(namespace) + "/distribution/1.0.0"
+}
+
+// Listen returns a listener for connections from peers made over router streams.
+// The registry should be served on the listener to be reachable by peers that can not connect directly,
+// or by peers using stream transport. Connections from peers that are not members are closed.
+func (r *P2PRouter) Listen() (net.Listener, error) {
+	ln, err := gostream.Listen(r.host, distributionProtocol(r.namespace))
+	if err != nil {
+		return nil, err
+	}
+	if r.membership == nil {
+		return ln, nil
+	}
+	return &memberListener{Listener: ln, membership: r.membership}, nil
+}
+
+// memberListener only accepts connections from peers that are members.
+type memberListener struct {
+	net.Listener
+	membership *Membership
+}
+
+func (l *memberListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		id, err := peer.Decode(conn.RemoteAddr().String())
+		if err == nil && l.membership.IsMember(id) {
+			return conn, nil
+		}
+		metrics.RouterRejectedPeersTotal.WithLabelValues("stream").Inc()
+		//nolint: errcheck // Ignore error as the connection is rejected either way.
+		conn.Close()
+	}
+}
+
+// DialPeer opens a connection to the registry of the peer over a router stream.
+// Relayed connections are limited, so peers which are not directly reachable are dialed through hole punching.
+func (r *P2PRouter) DialPeer(ctx context.Context, id string) (net.Conn, error) {
+	peerID, err := peer.Decode(id)
+	if err != nil {
+		return nil, err
+	}
+	return gostream.Dial(ctx, r.host, peerID, distributionProtocol(r.namespace))
+}
+
+// newRelayPeerSource returns connected peers as relay candidates.
+func newRelayPeerSource(relayHost *atomic.Pointer[host.Host]) autorelay.PeerSource {
+	return func(ctx context.Context, num int) <-chan peer.AddrInfo {
+		peerCh := make(chan peer.AddrInfo, num)
+		defer close(peerCh)
+
+		h := relayHost.Load()
+		if h == nil {
+			return peerCh
+		}
+		for _, id := range (*h).Network().Peers() {
+			if len(peerCh) == num {
+				break
+			}
+			peerCh <- (*h).Peerstore().PeerInfo(id)
+		}
+		return peerCh
+	}
+}
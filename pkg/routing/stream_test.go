@@ -0,0 +1,151 @@
+package routing
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDialPeer(t *testing.T) {
+	t.Parallel()
+
+	routers := []*P2PRouter{}
+	for range 2 {
+		r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090", WithRelay(true))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.host.Close()
+		})
+		routers = append(routers, r)
+	}
+
+	ln, err := routers[0].Listen()
+	require.NoError(t, err)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			//nolint: errcheck // Ignore error in test handler.
+			rw.Write([]byte(req.Host))
+		}),
+	}
+	go srv.Serve(ln) //nolint: errcheck // Server is closed when the test completes.
+	t.Cleanup(func() {
+		srv.Close()
+	})
+
+	err = routers[1].host.Connect(t.Context(), *host.InfoFromHost(routers[0].host))
+	require.NoError(t, err)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				id, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				return routers[1].DialPeer(ctx, id)
+			},
+		},
+	}
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "http://"+routers[0].ID()+"/", nil)
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, routers[0].ID(), string(b))
+
+	_, err = routers[1].DialPeer(t.Context(), "foo")
+	require.Error(t, err)
+}
+
+func TestRelayPeerSource(t *testing.T) {
+	t.Parallel()
+
+	relayHost := &atomic.Pointer[host.Host]{}
+	peerSource := newRelayPeerSource(relayHost)
+	peers := []peer.AddrInfo{}
+	for p := range peerSource(t.Context(), 10) {
+		peers = append(peers, p)
+	}
+	require.Empty(t, peers)
+
+	routers := []*P2PRouter{}
+	for range 3 {
+		r, err := NewP2PRouter(t.Context(), "localhost:0", NewStaticBootstrapper(nil), "9090")
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			r.host.Close()
+		})
+		routers = append(routers, r)
+	}
+	for _, r := range routers[1:] {
+		err := routers[0].host.Connect(t.Context(), *host.InfoFromHost(r.host))
+		require.NoError(t, err)
+	}
+	relayHost.Store(&routers[0].host)
+	for p := range peerSource(t.Context(), 10) {
+		peers = append(peers, p)
+	}
+	require.Len(t, peers, 2)
+	require.ElementsMatch(t, []peer.ID{routers[1].host.ID(), routers[2].host.ID()}, []peer.ID{peers[0].ID, peers[1].ID})
+
+	peers = []peer.AddrInfo{}
+	for p := range peerSource(t.Context(), 1) {
+		peers = append(peers, p)
+	}
+	require.Len(t, peers, 1)
+}
+
+func TestMemberListener(t *testing.T) {
+	t.Parallel()
+
+	member := generatePeerID(t)
+	unknown := generatePeerID(t)
+	connCh := make(chan net.Conn, 2)
+	connCh <- &peerConn{id: unknown}
+	connCh <- &peerConn{id: member}
+	close(connCh)
+	ln := &memberListener{
+		Listener:   &chanListener{connCh: connCh},
+		membership: NewMembership([]peer.ID{member}, nil),
+	}
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	require.Equal(t, member.String(), conn.RemoteAddr().String())
+	_, err = ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+type chanListener struct {
+	net.Listener
+	connCh chan net.Conn
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.connCh
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+type peerConn struct {
+	net.Conn
+	id peer.ID
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return &net.UnixAddr{Name: c.id.String()}
+}
+
+func (c *peerConn) Close() error {
+	return nil
+}
@@ -0,0 +1,791 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	mrand "math/rand/v2"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/spegel-org/spegel/internal/option"
+	"github.com/spegel-org/spegel/pkg/httpx"
+)
+
+const (
+	maxTrackerRequestSize = 32 * 1024 * 1024
+	// Header used to present the lease secret when registering, renewing or deleting a lease.
+	trackerLeaseSecretHeader = "Spegel-Lease-Secret"
+	// trackerLookupCacheTTL is how long lookup results are shared before the tracker is queried again.
+	trackerLookupCacheTTL = time.Second
+	// trackerLookupResultTTL is how long the last lookup result is served while the tracker is queried again.
+	trackerLookupResultTTL = time.Minute
+)
+
+type trackerRegisterRequest struct {
+	Keys []string `json:"keys"`
+	Port uint16   `json:"port"`
+}
+
+type trackerUpdateRequest struct {
+	Advertise []string `json:"advertise,omitempty"`
+	Withdraw  []string `json:"withdraw,omitempty"`
+}
+
+// Secret is chosen by the node when registering and has to be presented to renew, replace or delete the lease.
+type trackerLease struct {
+	Addr   netip.AddrPort `json:"addr"`
+	Secret string         `json:"secret,omitempty"`
+	TTL    time.Duration  `json:"ttl"`
+}
+
+type trackerLookupResponse struct {
+	Peers []PeerInfo `json:"peers"`
+}
+
+type trackerNode struct {
+	expires time.Time
+	keys    map[string]any
+	secret  string
+	addr    netip.AddrPort
+}
+
+type TrackerConfig struct {
+	AuthToken     string
+	LeaseDuration time.Duration
+}
+
+type TrackerOption = option.Option[TrackerConfig]
+
+// WithLeaseDuration sets how long a node is kept without a heartbeat.
+func WithLeaseDuration(leaseDuration time.Duration) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		if leaseDuration <= 0 {
+			return errors.New("lease duration has to be greater than zero")
+		}
+		cfg.LeaseDuration = leaseDuration
+		return nil
+	}
+}
+
+// WithAuthToken sets the shared token nodes have to present to use the tracker.
+// No authentication is required if not set.
+func WithAuthToken(token string) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		cfg.AuthToken = token
+		return nil
+	}
+}
+
+// Tracker is a central service which keeps track of the keys advertised by nodes.
+// Nodes hold a lease which expires if the node stops sending heartbeats.
+type Tracker struct {
+	nodes         map[string]*trackerNode
+	index         map[string]map[string]any
+	authToken     string
+	leaseDuration time.Duration
+	mx            sync.RWMutex
+}
+
+func NewTracker(opts ...TrackerOption) (*Tracker, error) {
+	cfg := TrackerConfig{
+		LeaseDuration: 30 * time.Second,
+	}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{
+		nodes:         map[string]*trackerNode{},
+		index:         map[string]map[string]any{},
+		authToken:     cfg.AuthToken,
+		leaseDuration: cfg.LeaseDuration,
+	}, nil
+}
+
+// Run removes nodes with expired leases until the context is cancelled.
+func (t *Tracker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(t.leaseDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			t.removeExpired(time.Now())
+		}
+	}
+}
+
+func (t *Tracker) Handler(log logr.Logger) *httpx.ServeMux {
+	m := httpx.NewServeMux(log)
+	m.Handle("GET /livez", t.livenessHandler)
+	m.Handle("GET /v1/nodes", t.authenticate(t.listHandler))
+	m.Handle("PUT /v1/nodes/", t.authenticate(t.registerHandler))
+	m.Handle("PATCH /v1/nodes/", t.authenticate(t.updateHandler))
+	m.Handle("DELETE /v1/nodes/", t.authenticate(t.deleteHandler))
+	m.Handle("GET /v1/lookup", t.authenticate(t.lookupHandler))
+	return m
+}
+
+// authenticate rejects requests which do not present the shared token.
+func (t *Tracker) authenticate(handler httpx.HandlerFunc) httpx.HandlerFunc {
+	return func(rw httpx.ResponseWriter, req *http.Request) {
+		if t.authToken == "" {
+			handler(rw, req)
+			return
+		}
+		token, ok := strings.CutPrefix(req.Header.Get(httpx.HeaderAuthorization), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(t.authToken)) != 1 {
+			rw.WriteError(http.StatusUnauthorized, errors.New("invalid tracker token"))
+			return
+		}
+		handler(rw, req)
+	}
+}
+
+func (t *Tracker) livenessHandler(rw httpx.ResponseWriter, req *http.Request) {
+	rw.WriteHeader(http.StatusOK)
+}
+
+func (t *Tracker) listHandler(rw httpx.ResponseWriter, req *http.Request) {
+	t.mx.RLock()
+	now := time.Now()
+	peers := []Peer{}
+	for id, node := range t.nodes {
+		if now.After(node.expires) {
+			continue
+		}
+		peers = append(peers, Peer{ID: id, Addresses: []string{node.addr.Addr().String()}})
+	}
+	t.mx.RUnlock()
+	writeJSON(rw, peers)
+}
+
+func (t *Tracker) registerHandler(rw httpx.ResponseWriter, req *http.Request) {
+	id, err := trackerNodeID(req)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	regReq := trackerRegisterRequest{}
+	err = json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxTrackerRequestSize)).Decode(&regReq)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("could not decode register request: %w", err))
+		return
+	}
+	// Forwarded headers are not trusted as they would allow registering any address.
+	remoteAddr, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("could not parse remote address: %w", err))
+		return
+	}
+	addr := netip.AddrPortFrom(remoteAddr.Addr().Unmap(), regReq.Port)
+	// Nodes present their own secret so that a registration can be retried if the response is lost.
+	secret := req.Header.Get(trackerLeaseSecretHeader)
+	if secret == "" {
+		secret = rand.Text()
+	}
+
+	t.mx.Lock()
+	// A lease which has not expired can only be replaced by its holder.
+	if existing, ok := t.nodes[id]; ok && !time.Now().After(existing.expires) && !validLeaseSecret(req, existing) {
+		t.mx.Unlock()
+		rw.WriteError(http.StatusConflict, fmt.Errorf("node %s is registered with another lease", id))
+		return
+	}
+	t.removeNode(id)
+	node := &trackerNode{
+		addr:    addr,
+		keys:    map[string]any{},
+		secret:  secret,
+		expires: time.Now().Add(t.leaseDuration),
+	}
+	t.nodes[id] = node
+	t.addKeys(id, node, regReq.Keys)
+	t.mx.Unlock()
+
+	writeJSON(rw, trackerLease{Addr: addr, Secret: secret, TTL: t.leaseDuration})
+}
+
+func (t *Tracker) updateHandler(rw httpx.ResponseWriter, req *http.Request) {
+	id, err := trackerNodeID(req)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	updateReq := trackerUpdateRequest{}
+	err = json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxTrackerRequestSize)).Decode(&updateReq)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, fmt.Errorf("could not decode update request: %w", err))
+		return
+	}
+
+	t.mx.Lock()
+	node, ok := t.nodes[id]
+	if !ok || time.Now().After(node.expires) {
+		t.removeNode(id)
+		t.mx.Unlock()
+		rw.WriteError(http.StatusNotFound, fmt.Errorf("node %s is not registered", id))
+		return
+	}
+	if !validLeaseSecret(req, node) {
+		t.mx.Unlock()
+		rw.WriteError(http.StatusForbidden, fmt.Errorf("invalid lease secret for node %s", id))
+		return
+	}
+	node.expires = time.Now().Add(t.leaseDuration)
+	t.addKeys(id, node, updateReq.Advertise)
+	t.removeKeys(id, node, updateReq.Withdraw)
+	addr := node.addr
+	t.mx.Unlock()
+
+	writeJSON(rw, trackerLease{Addr: addr, TTL: t.leaseDuration})
+}
+
+func (t *Tracker) deleteHandler(rw httpx.ResponseWriter, req *http.Request) {
+	id, err := trackerNodeID(req)
+	if err != nil {
+		rw.WriteError(http.StatusBadRequest, err)
+		return
+	}
+	t.mx.Lock()
+	node, ok := t.nodes[id]
+	if ok && !validLeaseSecret(req, node) {
+		t.mx.Unlock()
+		rw.WriteError(http.StatusForbidden, fmt.Errorf("invalid lease secret for node %s", id))
+		return
+	}
+	t.removeNode(id)
+	t.mx.Unlock()
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (t *Tracker) lookupHandler(rw httpx.ResponseWriter, req *http.Request) {
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		rw.WriteError(http.StatusBadRequest, errors.New("key query parameter is required"))
+		return
+	}
+	count := math.MaxInt
+	countStr := req.URL.Query().Get("count")
+	if countStr != "" {
+		var err error
+		count, err = strconv.Atoi(countStr)
+		if err != nil {
+			rw.WriteError(http.StatusBadRequest, fmt.Errorf("could not parse count: %w", err))
+			return
+		}
+		if count <= 0 {
+			count = math.MaxInt
+		}
+	}
+	exclude := req.URL.Query().Get("exclude")
+
+	t.mx.RLock()
+	now := time.Now()
+	resp := trackerLookupResponse{
+		Peers: []PeerInfo{},
+	}
+	for id := range t.index[key] {
+		node := t.nodes[id]
+		if id == exclude || now.After(node.expires) {
+			continue
+		}
+		resp.Peers = append(resp.Peers, PeerInfo{
+			ID:   id,
+			Addr: node.addr,
+			// The last heartbeat is when the lease was last renewed.
+			Seen: node.expires.Add(-t.leaseDuration),
+		})
+	}
+	t.mx.RUnlock()
+
+	// Shuffle peers to spread load when the count is limited.
+	mrand.Shuffle(len(resp.Peers), func(i, j int) {
+		resp.Peers[i], resp.Peers[j] = resp.Peers[j], resp.Peers[i]
+	})
+	resp.Peers = resp.Peers[:min(count, len(resp.Peers))]
+	writeJSON(rw, resp)
+}
+
+// Callers must hold the write lock.
+func (t *Tracker) addKeys(id string, node *trackerNode, keys []string) {
+	for _, key := range keys {
+		node.keys[key] = nil
+		ids, ok := t.index[key]
+		if !ok {
+			ids = map[string]any{}
+			t.index[key] = ids
+		}
+		ids[id] = nil
+	}
+}
+
+// Callers must hold the write lock.
+func (t *Tracker) removeKeys(id string, node *trackerNode, keys []string) {
+	for _, key := range keys {
+		delete(node.keys, key)
+		ids, ok := t.index[key]
+		if !ok {
+			continue
+		}
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(t.index, key)
+		}
+	}
+}
+
+// Callers must hold the write lock.
+func (t *Tracker) removeNode(id string) {
+	node, ok := t.nodes[id]
+	if !ok {
+		return
+	}
+	for key := range node.keys {
+		ids := t.index[key]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(t.index, key)
+		}
+	}
+	delete(t.nodes, id)
+}
+
+func (t *Tracker) removeExpired(now time.Time) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	for id, node := range t.nodes {
+		if now.After(node.expires) {
+			t.removeNode(id)
+		}
+	}
+}
+
+func validLeaseSecret(req *http.Request, node *trackerNode) bool {
+	secret := req.Header.Get(trackerLeaseSecretHeader)
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(node.secret)) == 1
+}
+
+func trackerNodeID(req *http.Request) (string, error) {
+	id := strings.TrimPrefix(req.URL.Path, "/v1/nodes/")
+	if id == "" || strings.Contains(id, "/") {
+		return "", fmt.Errorf("invalid node ID %q", id)
+	}
+	return id, nil
+}
+
+func writeJSON(rw httpx.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		rw.WriteError(http.StatusInternalServerError, err)
+		return
+	}
+	rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeJSON)
+	rw.WriteHeader(http.StatusOK)
+	//nolint: errcheck // Ignore error as headers are already written.
+	rw.Write(b)
+}
+
+type TrackerRouterConfig struct {
+	HTTPClient *http.Client
+	NodeID     string
+	AuthToken  string
+}
+
+type TrackerRouterOption = option.Option[TrackerRouterConfig]
+
+func WithTrackerHTTPClient(httpClient *http.Client) TrackerRouterOption {
+	return func(cfg *TrackerRouterConfig) error {
+		cfg.HTTPClient = httpClient
+		return nil
+	}
+}
+
+// WithTrackerAuthToken sets the shared token presented to the tracker.
+func WithTrackerAuthToken(token string) TrackerRouterOption {
+	return func(cfg *TrackerRouterConfig) error {
+		cfg.AuthToken = token
+		return nil
+	}
+}
+
+// WithNodeID sets the ID used to identify the node with the tracker.
+// A random ID is generated if not set, which changes every time the router is created.
+func WithNodeID(id string) TrackerRouterOption {
+	return func(cfg *TrackerRouterConfig) error {
+		cfg.NodeID = id
+		return nil
+	}
+}
+
+var _ Router = &TrackerRouter{}
+
+// TrackerRouter is a router which uses a central tracker over HTTP for discovery.
+// Keys are kept locally and synchronized with the tracker in the background, which allows
+// the router to recover from tracker restarts by registering all keys again.
+type TrackerRouter struct {
+	httpClient       *http.Client
+	trackerURL       *url.URL
+	keys             map[string]any
+	pendingAdvertise map[string]any
+	pendingWithdraw  map[string]any
+	syncCh           chan any
+	lookupGroup      *singleflight.Group
+	lookupCache      *expirable.LRU[string, *ClosableBalancer]
+	lookupResults    *expirable.LRU[string, []PeerInfo]
+	lastSync         time.Time
+	id               string
+	authToken        string
+	lease            trackerLease
+	mx               sync.RWMutex
+	registered       bool
+	registryPort     uint16
+}
+
+func NewTrackerRouter(trackerURL string, registryPortStr string, opts ...TrackerRouterOption) (*TrackerRouter, error) {
+	cfg := TrackerRouterConfig{
+		HTTPClient: httpx.BaseClient(),
+	}
+	err := option.Apply(&cfg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.NodeID == "" {
+		cfg.NodeID = rand.Text()
+	}
+
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid tracker URL scheme %s", u.Scheme)
+	}
+	registryPort, err := strconv.ParseUint(registryPortStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrackerRouter{
+		httpClient:       cfg.HTTPClient,
+		trackerURL:       u,
+		id:               cfg.NodeID,
+		authToken:        cfg.AuthToken,
+		keys:             map[string]any{},
+		pendingAdvertise: map[string]any{},
+		pendingWithdraw:  map[string]any{},
+		syncCh:           make(chan any, 1),
+		lookupGroup:      &singleflight.Group{},
+		lookupCache:      expirable.NewLRU[string, *ClosableBalancer](0, nil, trackerLookupCacheTTL),
+		lookupResults:    expirable.NewLRU[string, []PeerInfo](0, nil, trackerLookupResultTTL),
+		registryPort:     uint16(registryPort),
+		// The secret is generated up front so that it is known even if the registration response is lost.
+		lease: trackerLease{Secret: rand.Text()},
+	}, nil
+}
+
+func (r *TrackerRouter) ID() string {
+	return r.id
+}
+
+// Run keeps the key set synchronized with the tracker and sends heartbeats to keep the lease.
+func (r *TrackerRouter) Run(ctx context.Context) error {
+	log := logr.FromContextOrDiscard(ctx).WithName("tracker")
+	log.Info("starting tracker router", "id", r.id, "tracker", r.trackerURL.String())
+
+	for {
+		err := r.sync(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error(err, "could not synchronize with tracker")
+		}
+		select {
+		case <-ctx.Done():
+			deleteCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+			err := r.deregister(deleteCtx)
+			if err != nil {
+				log.Error(err, "could not deregister from tracker")
+			}
+			return nil
+		case <-r.syncCh:
+		case <-time.After(r.heartbeatInterval()):
+		}
+	}
+}
+
+func (r *TrackerRouter) Ready(ctx context.Context) (bool, error) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if !r.registered {
+		return false, nil
+	}
+	return time.Since(r.lastSync) <= r.lease.TTL, nil
+}
+
+// Lookup queries the tracker in the background, so that lookups with short timeouts are not bound by the
+// round trip. Results are shared by concurrent lookups, and the last result is served until the query completes.
+func (r *TrackerRouter) Lookup(ctx context.Context, key string, count int) (Balancer, error) {
+	log := logr.FromContextOrDiscard(ctx).WithName("tracker").WithValues("key", key)
+
+	bal, _, _ := r.lookupGroup.Do(key, func() (any, error) {
+		cb, ok := r.lookupCache.Get(key)
+		if ok {
+			return cb, nil
+		}
+		cb = NewClosableBalancer(NewRoundRobin())
+		previous, _ := r.lookupResults.Get(key)
+		for _, peer := range previous {
+			cb.Add(peer)
+		}
+		r.lookupCache.Add(key, cb)
+
+		// The query is detached from the caller so that the result can be cached for later lookups.
+		queryCtx, queryCancel := context.WithTimeout(context.WithoutCancel(ctx), lookupQueryTimeout)
+		go func() {
+			defer queryCancel()
+			defer cb.Close()
+
+			peers, err := r.lookup(queryCtx, key, count)
+			if err != nil {
+				log.Error(err, "could not lookup key in tracker")
+				// Query the tracker again on the next lookup, unless a newer query has already started.
+				if current, ok := r.lookupCache.Peek(key); ok && current == cb {
+					r.lookupCache.Remove(key)
+				}
+				return
+			}
+			for _, peer := range peers {
+				cb.Add(peer)
+			}
+			for _, peer := range previous {
+				if !slices.ContainsFunc(peers, func(p PeerInfo) bool { return samePeer(p, peer) }) {
+					cb.Remove(peer)
+				}
+			}
+			r.lookupResults.Add(key, peers)
+		}()
+		return cb, nil
+	})
+	return &contextBalancer{ClosableBalancer: bal.(*ClosableBalancer), ctx: ctx}, nil
+}
+
+func (r *TrackerRouter) lookup(ctx context.Context, key string, count int) ([]PeerInfo, error) {
+	query := url.Values{}
+	query.Set("key", key)
+	query.Set("exclude", r.id)
+	if count > 0 {
+		query.Set("count", strconv.Itoa(count))
+	}
+	resp := trackerLookupResponse{}
+	err := r.do(ctx, http.MethodGet, "/v1/lookup?"+query.Encode(), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Peers, nil
+}
+
+func (r *TrackerRouter) Advertise(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	r.mx.Lock()
+	for _, key := range keys {
+		r.keys[key] = nil
+		delete(r.pendingWithdraw, key)
+		r.pendingAdvertise[key] = nil
+	}
+	r.mx.Unlock()
+	r.triggerSync()
+	return nil
+}
+
+func (r *TrackerRouter) Withdraw(ctx context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	r.mx.Lock()
+	for _, key := range keys {
+		delete(r.keys, key)
+		delete(r.pendingAdvertise, key)
+		r.pendingWithdraw[key] = nil
+	}
+	r.mx.Unlock()
+	r.triggerSync()
+	return nil
+}
+
+// WithdrawAll stops advertising all keys, the tracker is updated on the next synchronization.
+func (r *TrackerRouter) WithdrawAll(ctx context.Context) error {
+	r.mx.Lock()
+	for key := range r.keys {
+		r.pendingWithdraw[key] = nil
+	}
+	r.keys = map[string]any{}
+	r.pendingAdvertise = map[string]any{}
+	r.mx.Unlock()
+	r.triggerSync()
+	return nil
+}
+
+func (r *TrackerRouter) ListPeers() ([]Peer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peers := []Peer{}
+	err := r.do(ctx, http.MethodGet, "/v1/nodes", nil, &peers)
+	if err != nil {
+		return nil, err
+	}
+	peers = slices.DeleteFunc(peers, func(p Peer) bool {
+		return p.ID == r.id
+	})
+	return peers, nil
+}
+
+func (r *TrackerRouter) LocalAddresses() []string {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if !r.lease.Addr.IsValid() {
+		return []string{}
+	}
+	return []string{r.lease.Addr.Addr().String()}
+}
+
+func (r *TrackerRouter) triggerSync() {
+	select {
+	case r.syncCh <- nil:
+	default:
+	}
+}
+
+// sync registers all keys with the tracker if not registered, otherwise pending changes are sent.
+// Any failure causes the next synchronization to register all keys again.
+func (r *TrackerRouter) sync(ctx context.Context) error {
+	r.mx.Lock()
+	registered := r.registered
+	var method string
+	var body any
+	if registered {
+		method = http.MethodPatch
+		body = trackerUpdateRequest{
+			Advertise: collectKeys(r.pendingAdvertise),
+			Withdraw:  collectKeys(r.pendingWithdraw),
+		}
+	} else {
+		method = http.MethodPut
+		body = trackerRegisterRequest{
+			Keys: collectKeys(r.keys),
+			Port: r.registryPort,
+		}
+	}
+	r.pendingAdvertise = map[string]any{}
+	r.pendingWithdraw = map[string]any{}
+	r.registered = false
+	r.mx.Unlock()
+
+	lease := trackerLease{}
+	err := r.do(ctx, method, "/v1/nodes/"+url.PathEscape(r.id), body, &lease)
+	if err != nil {
+		// Register again immediately if the tracker does not know about the node.
+		var statusErr *httpx.StatusError
+		if registered && errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return r.sync(ctx)
+		}
+		return err
+	}
+
+	r.mx.Lock()
+	r.registered = true
+	// The secret is kept for later registrations and renewals.
+	lease.Secret = r.lease.Secret
+	r.lease = lease
+	r.lastSync = time.Now()
+	r.mx.Unlock()
+	return nil
+}
+
+func (r *TrackerRouter) deregister(ctx context.Context) error {
+	r.mx.Lock()
+	r.registered = false
+	r.mx.Unlock()
+	return r.do(ctx, http.MethodDelete, "/v1/nodes/"+url.PathEscape(r.id), nil, nil)
+}
+
+func (r *TrackerRouter) heartbeatInterval() time.Duration {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if r.lease.TTL <= 0 {
+		return time.Second
+	}
+	return r.lease.TTL / 3
+}
+
+func (r *TrackerRouter) do(ctx context.Context, method, path string, body, v any) error {
+	u, err := r.trackerURL.Parse(path)
+	if err != nil {
+		return err
+	}
+	var b []byte
+	if body != nil {
+		b, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set(httpx.HeaderContentType, httpx.ContentTypeJSON)
+	}
+	if r.authToken != "" {
+		req.Header.Set(httpx.HeaderAuthorization, "Bearer "+r.authToken)
+	}
+	r.mx.RLock()
+	secret := r.lease.Secret
+	r.mx.RUnlock()
+	if secret != "" {
+		req.Header.Set(trackerLeaseSecretHeader, secret)
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpx.DrainAndClose(resp.Body)
+	err = httpx.CheckResponseStatus(resp, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func collectKeys(m map[string]any) []string {
+	return slices.Collect(maps.Keys(m))
+}
@@ -0,0 +1,311 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	tlog "github.com/go-logr/logr/testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestTrackerRouter(t *testing.T) {
+	t.Parallel()
+
+	log := tlog.NewTestLogger(t)
+	ctx := logr.NewContext(t.Context(), log)
+	ctx, cancel := context.WithCancel(ctx)
+	g, gCtx := errgroup.WithContext(ctx)
+
+	tracker, err := NewTracker(WithLeaseDuration(time.Second))
+	require.NoError(t, err)
+	handler := atomic.Pointer[http.Handler]{}
+	trackerHandler := http.Handler(tracker.Handler(log))
+	handler.Store(&trackerHandler)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		(*handler.Load()).ServeHTTP(rw, req)
+	}))
+	t.Cleanup(srv.Close)
+
+	_, err = NewTrackerRouter("foo://bar", "5000")
+	require.EqualError(t, err, "invalid tracker URL scheme foo")
+
+	routers := []*TrackerRouter{}
+	for _, port := range []string{"5000", "5001"} {
+		r, err := NewTrackerRouter(srv.URL, port)
+		require.NoError(t, err)
+		ready, err := r.Ready(t.Context())
+		require.NoError(t, err)
+		require.False(t, ready)
+		g.Go(func() error {
+			return r.Run(gCtx)
+		})
+		routers = append(routers, r)
+	}
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		for _, r := range routers {
+			ready, err := r.Ready(t.Context())
+			require.NoError(c, err)
+			require.True(c, ready)
+			require.Equal(c, []string{"127.0.0.1"}, r.LocalAddresses())
+		}
+	}, 5*time.Second, 50*time.Millisecond)
+	peers, err := routers[0].ListPeers()
+	require.NoError(t, err)
+	require.Equal(t, []Peer{{ID: routers[1].ID(), Addresses: []string{"127.0.0.1"}}}, peers)
+
+	// Advertised keys should be found by other routers but not self.
+	err = routers[0].Advertise(t.Context(), []string{"foo", "bar"})
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		bal, err := routers[1].Lookup(t.Context(), "foo", 3)
+		require.NoError(c, err)
+		peer, err := bal.Next()
+		require.NoError(c, err)
+		require.Equal(c, routers[0].ID(), peer.ID)
+		require.Equal(c, netip.MustParseAddrPort("127.0.0.1:5000"), peer.Addr)
+		require.WithinDuration(c, time.Now(), peer.Seen, 5*time.Second)
+	}, 5*time.Second, 50*time.Millisecond)
+	bal, err := routers[0].Lookup(t.Context(), "foo", 3)
+	require.NoError(t, err)
+	_, err = bal.Next()
+	require.ErrorIs(t, err, ErrNoNext)
+
+	// Withdrawn keys should not be found.
+	err = routers[0].Withdraw(t.Context(), []string{"foo"})
+	require.NoError(t, err)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		bal, err := routers[1].Lookup(t.Context(), "foo", 3)
+		require.NoError(c, err)
+		_, err = bal.Next()
+		require.ErrorIs(c, err, ErrNoNext)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Keys should be registered again after the tracker restarts.
+	newTracker, err := NewTracker(WithLeaseDuration(time.Second))
+	require.NoError(t, err)
+	newTrackerHandler := http.Handler(newTracker.Handler(log))
+	handler.Store(&newTrackerHandler)
+	require.EventuallyWithT(t, func(c *assert.CollectT) {
+		bal, err := routers[1].Lookup(t.Context(), "bar", 3)
+		require.NoError(c, err)
+		peer, err := bal.Next()
+		require.NoError(c, err)
+		require.Equal(c, netip.MustParseAddrPort("127.0.0.1:5000"), peer.Addr)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Nodes should be removed when shutting down.
+	cancel()
+	err = g.Wait()
+	require.NoError(t, err)
+	newTracker.mx.RLock()
+	require.Empty(t, newTracker.nodes)
+	require.Empty(t, newTracker.index)
+	newTracker.mx.RUnlock()
+}
+
+func TestTrackerLeaseExpiry(t *testing.T) {
+	t.Parallel()
+
+	tracker, err := NewTracker(WithLeaseDuration(time.Minute))
+	require.NoError(t, err)
+	srv := httptest.NewServer(tracker.Handler(logr.Discard()))
+	t.Cleanup(srv.Close)
+
+	r, err := NewTrackerRouter(srv.URL, "5000", WithNodeID("foo"))
+	require.NoError(t, err)
+	err = r.Advertise(t.Context(), []string{"key"})
+	require.NoError(t, err)
+	err = r.sync(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, r.lease.TTL)
+	require.Equal(t, 20*time.Second, r.heartbeatInterval())
+
+	tracker.mx.RLock()
+	require.Contains(t, tracker.nodes, "foo")
+	require.Equal(t, map[string]any{"foo": nil}, tracker.index["key"])
+	tracker.mx.RUnlock()
+
+	// Expired nodes should be removed along with their keys.
+	tracker.removeExpired(time.Now().Add(2 * time.Minute))
+	tracker.mx.RLock()
+	require.Empty(t, tracker.nodes)
+	require.Empty(t, tracker.index)
+	tracker.mx.RUnlock()
+
+	// Heartbeat for an unknown node should register it again.
+	err = r.sync(t.Context())
+	require.NoError(t, err)
+	tracker.mx.RLock()
+	require.Contains(t, tracker.nodes, "foo")
+	require.Equal(t, map[string]any{"foo": nil}, tracker.index["key"])
+	tracker.mx.RUnlock()
+
+	// Withdrawing all keys should keep the node registered without keys.
+	err = r.WithdrawAll(t.Context())
+	require.NoError(t, err)
+	err = r.sync(t.Context())
+	require.NoError(t, err)
+	tracker.mx.RLock()
+	require.Contains(t, tracker.nodes, "foo")
+	require.Empty(t, tracker.index)
+	tracker.mx.RUnlock()
+}
+
+func TestTrackerLookupHandler(t *testing.T) {
+	t.Parallel()
+
+	tracker, err := NewTracker()
+	require.NoError(t, err)
+	srv := httptest.NewServer(tracker.Handler(logr.Discard()))
+	t.Cleanup(srv.Close)
+
+	resp, err := srv.Client().Get(srv.URL + "/v1/lookup")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = srv.Client().Get(srv.URL + "/v1/lookup?key=foo&count=bar")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = srv.Client().Get(srv.URL + "/v1/lookup?key=foo")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTrackerAuthentication(t *testing.T) {
+	t.Parallel()
+
+	tracker, err := NewTracker(WithLeaseDuration(time.Minute), WithAuthToken("token"))
+	require.NoError(t, err)
+	srv := httptest.NewServer(tracker.Handler(logr.Discard()))
+	t.Cleanup(srv.Close)
+
+	// Requests without the shared token should be rejected.
+	unauthorized, err := NewTrackerRouter(srv.URL, "5000", WithNodeID("foo"))
+	require.NoError(t, err)
+	err = unauthorized.sync(t.Context())
+	require.Error(t, err)
+	_, err = unauthorized.ListPeers()
+	require.Error(t, err)
+	bal, err := unauthorized.Lookup(t.Context(), "key", 0)
+	require.NoError(t, err)
+	_, err = bal.Next()
+	require.ErrorIs(t, err, ErrNoNext)
+	tracker.mx.RLock()
+	require.Empty(t, tracker.nodes)
+	tracker.mx.RUnlock()
+
+	r, err := NewTrackerRouter(srv.URL, "5000", WithNodeID("foo"), WithTrackerAuthToken("token"))
+	require.NoError(t, err)
+	err = r.Advertise(t.Context(), []string{"key"})
+	require.NoError(t, err)
+	err = r.sync(t.Context())
+	require.NoError(t, err)
+	require.NotEmpty(t, r.lease.Secret)
+
+	// Forwarded headers should not be trusted when registering.
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodPut, srv.URL+"/v1/nodes/bar", strings.NewReader(`{"keys":["key"],"port":5000}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1, 10.0.0.2")
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	tracker.mx.RLock()
+	require.Equal(t, netip.MustParseAddrPort("127.0.0.1:5000"), tracker.nodes["bar"].addr)
+	tracker.mx.RUnlock()
+
+	// Leases should only be renewed, replaced or deleted by their holder.
+	for _, method := range []string{http.MethodPatch, http.MethodPut, http.MethodDelete} {
+		req, err := http.NewRequestWithContext(t.Context(), method, srv.URL+"/v1/nodes/foo", strings.NewReader(`{}`))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set(trackerLeaseSecretHeader, "wrong")
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.GreaterOrEqual(t, resp.StatusCode, http.StatusBadRequest, method)
+	}
+	tracker.mx.RLock()
+	require.Contains(t, tracker.nodes, "foo")
+	require.Equal(t, map[string]any{"foo": nil, "bar": nil}, tracker.index["key"])
+	tracker.mx.RUnlock()
+
+	// The holder should keep the secret across renewals.
+	secret := r.lease.Secret
+	err = r.sync(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, secret, r.lease.Secret)
+
+	// Registering again with the same secret should succeed, as when the response was lost.
+	r.mx.Lock()
+	r.registered = false
+	r.mx.Unlock()
+	err = r.sync(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, secret, r.lease.Secret)
+	tracker.mx.RLock()
+	require.Equal(t, secret, tracker.nodes["foo"].secret)
+	tracker.mx.RUnlock()
+	err = r.deregister(t.Context())
+	require.NoError(t, err)
+	tracker.mx.RLock()
+	require.NotContains(t, tracker.nodes, "foo")
+	tracker.mx.RUnlock()
+}
+
+func TestTrackerRouterLookupCache(t *testing.T) {
+	t.Parallel()
+
+	lookups := atomic.Int32{}
+	fail := atomic.Bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lookups.Add(1)
+		if fail.Load() {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		//nolint: errcheck // Ignore error in test server.
+		rw.Write([]byte(`{"peers":[{"id":"foo","addr":"10.0.0.1:5000"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	r, err := NewTrackerRouter(srv.URL, "5000", WithNodeID("bar"))
+	require.NoError(t, err)
+
+	// Lookups should share the result of a single query.
+	for range 3 {
+		bal, err := r.Lookup(t.Context(), "key", 0)
+		require.NoError(t, err)
+		peer, err := bal.Next()
+		require.NoError(t, err)
+		require.Equal(t, "foo", peer.ID)
+	}
+	require.Equal(t, int32(1), lookups.Load())
+
+	// The last result should be served when the tracker fails.
+	fail.Store(true)
+	r.lookupCache.Purge()
+	bal, err := r.Lookup(t.Context(), "key", 0)
+	require.NoError(t, err)
+	peer, err := bal.Next()
+	require.NoError(t, err)
+	require.Equal(t, "foo", peer.ID)
+	require.Eventually(t, func() bool {
+		return lookups.Load() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
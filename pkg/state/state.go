@@ -2,10 +2,18 @@ package state
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"time"
 
+	"github.com/containerd/containerd/v2/core/images"
+	"github.com/containerd/platforms"
 	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/spegel-org/spegel/internal/option"
 	"github.com/spegel-org/spegel/pkg/metrics"
@@ -14,11 +22,15 @@ import (
 )
 
 type TrackerConfig struct {
-	Filters []oci.Filter
+	Filters           []oci.Filter
+	Platforms         []ocispec.Platform
+	ReconcileInterval time.Duration
 }
 
 type TrackerOption = option.Option[TrackerConfig]
 
+// WithRegistryFilters sets the filters of references that are not advertised. Content is filtered by the images
+// referencing it, so when filters may match tags content is held back until an image referencing it is created.
 func WithRegistryFilters(filters []oci.Filter) TrackerOption {
 	return func(cfg *TrackerConfig) error {
 		cfg.Filters = filters
@@ -26,12 +38,60 @@ func WithRegistryFilters(filters []oci.Filter) TrackerOption {
 	}
 }
 
+// WithReconcileInterval sets the interval at which advertised content is reconciled with the store.
+// Reconciliation corrects drift caused by missed events, a zero interval disables it.
+func WithReconcileInterval(interval time.Duration) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		cfg.ReconcileInterval = interval
+		return nil
+	}
+}
+
+// WithPlatforms sets the platforms content is advertised for. Content only referenced by image manifests
+// of other platforms is not advertised, all content is advertised when no platforms are set. Content is held back
+// until an image referencing it is created when platforms are set.
+func WithPlatforms(platformSpecs ...ocispec.Platform) TrackerOption {
+	return func(cfg *TrackerConfig) error {
+		cfg.Platforms = append(cfg.Platforms, platformSpecs...)
+		return nil
+	}
+}
+
+// tracker keeps track of the content advertised for a store.
+type tracker struct {
+	ociStore oci.Store
+	router   routing.Router
+	// platformMatcher matches the platforms content is advertised for, nil when all content is advertised.
+	platformMatcher platforms.Matcher
+	advertised      map[string]digest.Digest
+	// images are the images referencing content, which are tracked when the content advertised depends on
+	// the images referencing it.
+	images map[string]trackedImage
+	// pending is the content created before an image referencing it is known, which is held back until
+	// the image is created or the content is reconciled.
+	pending map[digest.Digest]struct{}
+	filters []oci.Filter
+	// dependsOnImages is true when content is excluded by platform or filtered by filters that may match tags.
+	dependsOnImages bool
+}
+
+// trackedImage is an image together with its content, mapped to whether the content matches the platforms.
+type trackedImage struct {
+	content map[digest.Digest]bool
+	ref     oci.Reference
+}
+
 func Track(ctx context.Context, ociStore oci.Store, router routing.Router, opts ...TrackerOption) error {
-	cfg := TrackerConfig{}
+	cfg := TrackerConfig{
+		ReconcileInterval: 5 * time.Minute,
+	}
 	err := option.Apply(&cfg, opts...)
 	if err != nil {
 		return err
 	}
+	if cfg.ReconcileInterval < 0 {
+		return errors.New("reconcile interval cannot be negative")
+	}
 
 	// Start subscribing to not miss events.
 	eventCh, err := ociStore.Subscribe(ctx)
@@ -39,53 +99,57 @@ func Track(ctx context.Context, ociStore oci.Store, router routing.Router, opts
 		return err
 	}
 
-	// Initial advertisement of all content.
-	keys := []string{}
-	imgs, err := ociStore.ListImages(ctx)
-	if err != nil {
-		return err
-	}
-	for _, img := range imgs {
-		if oci.MatchesFilter(img.Reference, cfg.Filters) {
-			continue
-		}
-		tagName, ok := img.TagName()
-		if ok {
-			keys = append(keys, tagName)
-			metrics.AdvertisedImageTags.WithLabelValues(img.Registry).Inc()
-		}
-		metrics.AdvertisedImageDigests.WithLabelValues(img.Registry).Inc()
+	t := &tracker{
+		ociStore:   ociStore,
+		router:     router,
+		filters:    cfg.Filters,
+		advertised: map[string]digest.Digest{},
+		images:     map[string]trackedImage{},
+		pending:    map[digest.Digest]struct{}{},
 	}
-	contents, err := ociStore.ListContent(ctx)
-	if err != nil {
-		return err
+	if len(cfg.Platforms) > 0 {
+		t.platformMatcher = platforms.Any(cfg.Platforms...)
+		t.dependsOnImages = true
 	}
-	for _, refs := range contents {
-		// TODO(phillebaba): Apply filtering on parent image tag.
-		if allReferencesMatchFilter(refs, cfg.Filters) {
-			continue
-		}
-		for _, ref := range refs {
-			metrics.AdvertisedContentDigests.WithLabelValues(ref.Registry).Inc()
+	for _, filter := range cfg.Filters {
+		// Registry filters do not depend on the tags of the images referencing content.
+		if _, ok := filter.(oci.RegistryWhitelistFilter); !ok {
+			t.dependsOnImages = true
 		}
-		keys = append(keys, refs[0].Digest.String())
 	}
-	err = router.Advertise(ctx, keys)
+
+	// Initial advertisement of all content.
+	_, _, err = t.reconcile(ctx)
 	if err != nil {
 		return err
 	}
 
+	// A nil channel never receives when reconciliation is disabled.
+	var reconcileCh <-chan time.Time
+	if cfg.ReconcileInterval > 0 {
+		ticker := time.NewTicker(cfg.ReconcileInterval)
+		defer ticker.Stop()
+		reconcileCh = ticker.C
+	}
+
 	// Watch for OCI events.
 	logr.FromContextOrDiscard(ctx).Info("waiting for store events")
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-reconcileCh:
+			t.reconcileDrift(ctx)
 		case event, ok := <-eventCh:
 			if !ok {
 				return errors.New("event channel closed")
 			}
-			err := handleEvent(ctx, router, event, cfg.Filters)
+			if event.Type == oci.ReconcileEvent {
+				logr.FromContextOrDiscard(ctx).Info("reconciling advertised content with store")
+				t.reconcileDrift(ctx)
+				continue
+			}
+			err := t.handleEvent(ctx, event)
 			if err != nil {
 				logr.FromContextOrDiscard(ctx).Error(err, "could not handle event")
 				continue
@@ -94,8 +158,136 @@ func Track(ctx context.Context, ociStore oci.Store, router routing.Router, opts
 	}
 }
 
-func handleEvent(ctx context.Context, router routing.Router, event oci.OCIEvent, filters []oci.Filter) error {
-	if oci.MatchesFilter(event.Reference, filters) {
+// reconcileDrift reconciles the advertised keys with the store and records the drift that was corrected.
+func (t *tracker) reconcileDrift(ctx context.Context) {
+	log := logr.FromContextOrDiscard(ctx)
+
+	missing, stale, err := t.reconcile(ctx)
+	if err != nil {
+		log.Error(err, "could not reconcile advertised content")
+		return
+	}
+	metrics.ReconcileDriftTotal.WithLabelValues("missing").Add(float64(missing))
+	metrics.ReconcileDriftTotal.WithLabelValues("stale").Add(float64(stale))
+	if missing > 0 || stale > 0 {
+		log.Info("corrected drift between advertised content and store", "missing", missing, "stale", stale)
+	}
+}
+
+// reconcile advertises keys in the store that are missing and withdraws advertised keys that are no longer present.
+// The advertised keys are updated to match the content of the store, the amount of missing and stale keys is returned.
+func (t *tracker) reconcile(ctx context.Context) (int, int, error) {
+	keys := map[string]digest.Digest{}
+	imgs, err := t.ociStore.ListImages(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	contents, err := t.ociStore.ListContent(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if t.dependsOnImages {
+		images, err := t.trackImages(ctx, imgs)
+		if err != nil {
+			return 0, 0, err
+		}
+		t.images = images
+		clear(t.pending)
+	}
+
+	// Metrics are recalculated from the content of the store.
+	metrics.AdvertisedImageTags.Reset()
+	metrics.AdvertisedImageDigests.Reset()
+	metrics.AdvertisedContentDigests.Reset()
+	for _, img := range imgs {
+		if oci.MatchesFilter(img.Reference, t.filters) {
+			continue
+		}
+		tagName, ok := img.TagName()
+		if ok {
+			keys[tagName] = img.Digest
+			metrics.AdvertisedImageTags.WithLabelValues(img.Registry).Inc()
+		}
+		metrics.AdvertisedImageDigests.WithLabelValues(img.Registry).Inc()
+	}
+	for _, refs := range contents {
+		// Content referenced by images depends on the images, other content is held back until an image referencing
+		// it is created when depending on images and withheld when all references are filtered otherwise.
+		referenced, include := t.imageReferences(refs[0].Digest)
+		switch {
+		case referenced && !include:
+			continue
+		case !referenced && t.dependsOnImages:
+			t.pending[refs[0].Digest] = struct{}{}
+			continue
+		case !referenced && allReferencesMatchFilter(refs, t.filters):
+			continue
+		}
+		registries := []string{}
+		for _, ref := range refs {
+			if slices.Contains(registries, ref.Registry) {
+				continue
+			}
+			registries = append(registries, ref.Registry)
+			metrics.AdvertisedContentDigests.WithLabelValues(ref.Registry).Inc()
+		}
+		keys[refs[0].Digest.String()] = refs[0].Digest
+	}
+	missingKeys := map[string]digest.Digest{}
+	for key, dgst := range keys {
+		if _, ok := t.advertised[key]; ok {
+			continue
+		}
+		missingKeys[key] = dgst
+	}
+	if len(missingKeys) > 0 {
+		err := t.advertise(ctx, missingKeys)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	staleKeys := []string{}
+	for key := range t.advertised {
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		staleKeys = append(staleKeys, key)
+	}
+	if len(staleKeys) > 0 {
+		slices.Sort(staleKeys)
+		err := t.router.Withdraw(ctx, staleKeys)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	clear(t.advertised)
+	maps.Copy(t.advertised, keys)
+	return len(missingKeys), len(staleKeys), nil
+}
+
+func (t *tracker) handleEvent(ctx context.Context, event oci.OCIEvent) error {
+	// Content events do not know the images referencing the content, so content is held back until an image
+	// referencing it is known. The content of an image is evaluated when its tag is created or deleted.
+	if t.dependsOnImages {
+		if event.Reference.Tag != "" {
+			logr.FromContextOrDiscard(ctx).Info("OCI event", "ref", event.Reference.String(), "type", event.Type)
+			return t.updateImage(ctx, event)
+		}
+		switch event.Type {
+		case oci.CreateEvent:
+			referenced, include := t.imageReferences(event.Reference.Digest)
+			if !referenced {
+				t.pending[event.Reference.Digest] = struct{}{}
+				return nil
+			}
+			if !include {
+				return nil
+			}
+		case oci.DeleteEvent:
+			delete(t.pending, event.Reference.Digest)
+		}
+	}
+	if oci.MatchesFilter(event.Reference, t.filters) {
 		return nil
 	}
 	logr.FromContextOrDiscard(ctx).Info("OCI event", "ref", event.Reference.String(), "type", event.Type)
@@ -106,27 +298,265 @@ func handleEvent(ctx context.Context, router routing.Router, event oci.OCIEvent,
 		} else {
 			metrics.AdvertisedContentDigests.WithLabelValues(event.Reference.Registry).Inc()
 		}
-		err := router.Advertise(ctx, []string{event.Reference.Identifier()})
+		err := t.advertise(ctx, map[string]digest.Digest{event.Reference.Identifier(): event.Reference.Digest})
 		if err != nil {
 			return err
 		}
+		t.advertised[event.Reference.Identifier()] = event.Reference.Digest
 		return nil
 	case oci.DeleteEvent:
+		if _, ok := t.advertised[event.Reference.Identifier()]; !ok {
+			return nil
+		}
 		if event.Reference.Tag != "" {
 			metrics.AdvertisedImageTags.WithLabelValues(event.Reference.Registry).Dec()
 		} else {
 			metrics.AdvertisedContentDigests.WithLabelValues(event.Reference.Registry).Dec()
 		}
-		err := router.Withdraw(ctx, []string{event.Reference.Identifier()})
+		err := t.router.Withdraw(ctx, []string{event.Reference.Identifier()})
 		if err != nil {
 			return err
 		}
+		delete(t.advertised, event.Reference.Identifier())
 		return nil
 	default:
 		return fmt.Errorf("unhandled event type %s", event.Type)
 	}
 }
 
+// updateImage evaluates the content of the image when its tag is created or deleted, together with the content of the
+// image previously tagged. Content that is no longer referenced by any image is kept until it is deleted.
+func (t *tracker) updateImage(ctx context.Context, event oci.OCIEvent) error {
+	key := event.Reference.Identifier()
+	dgsts := map[digest.Digest]struct{}{}
+	if prev, ok := t.images[key]; ok {
+		for dgst := range prev.content {
+			dgsts[dgst] = struct{}{}
+		}
+		delete(t.images, key)
+	}
+	ref := event.Reference
+	if event.Type == oci.CreateEvent {
+		dgst, err := t.ociStore.Resolve(ctx, key)
+		if err != nil {
+			return err
+		}
+		content, err := t.imageContent(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		ref.Digest = dgst
+		t.images[key] = trackedImage{ref: ref, content: content}
+		for dgst := range content {
+			dgsts[dgst] = struct{}{}
+		}
+	}
+
+	advertiseKeys := map[string]digest.Digest{}
+	withdrawKeys := []string{}
+	for dgst := range dgsts {
+		referenced, include := t.imageReferences(dgst)
+		if !referenced {
+			continue
+		}
+		_, advertised := t.advertised[dgst.String()]
+		_, pending := t.pending[dgst]
+		delete(t.pending, dgst)
+		switch {
+		case include && !advertised:
+			// Content that is not pending may not have been created in the store.
+			if !pending {
+				_, err := t.ociStore.Descriptor(ctx, dgst)
+				if errors.Is(err, oci.ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			}
+			advertiseKeys[dgst.String()] = dgst
+			metrics.AdvertisedContentDigests.WithLabelValues(ref.Registry).Inc()
+		case !include && advertised:
+			withdrawKeys = append(withdrawKeys, dgst.String())
+			metrics.AdvertisedContentDigests.WithLabelValues(ref.Registry).Dec()
+		}
+	}
+	_, advertised := t.advertised[key]
+	switch {
+	case event.Type == oci.CreateEvent && !oci.MatchesFilter(ref, t.filters):
+		advertiseKeys[key] = ref.Digest
+		if !advertised {
+			metrics.AdvertisedImageTags.WithLabelValues(ref.Registry).Inc()
+		}
+	case advertised:
+		withdrawKeys = append(withdrawKeys, key)
+		metrics.AdvertisedImageTags.WithLabelValues(ref.Registry).Dec()
+	}
+
+	if len(advertiseKeys) > 0 {
+		err := t.advertise(ctx, advertiseKeys)
+		if err != nil {
+			return err
+		}
+		maps.Copy(t.advertised, advertiseKeys)
+	}
+	if len(withdrawKeys) > 0 {
+		slices.Sort(withdrawKeys)
+		err := t.router.Withdraw(ctx, withdrawKeys)
+		if err != nil {
+			return err
+		}
+		for _, key := range withdrawKeys {
+			delete(t.advertised, key)
+		}
+	}
+	return nil
+}
+
+// imageReferences returns true if the content is referenced by a tracked image, and true if the content should be
+// advertised which is when an image that is not filtered references the content for a matching platform.
+func (t *tracker) imageReferences(dgst digest.Digest) (bool, bool) {
+	referenced := false
+	for _, img := range t.images {
+		match, ok := img.content[dgst]
+		if !ok {
+			continue
+		}
+		referenced = true
+		if match && !oci.MatchesFilter(img.ref, t.filters) {
+			return true, true
+		}
+	}
+	return referenced, false
+}
+
+// advertise advertises the keys, together with the metadata of the content when supported by the router.
+// Keys are mapped to the digest of the content they describe, which for tags is the digest the tag resolves to.
+func (t *tracker) advertise(ctx context.Context, keys map[string]digest.Digest) error {
+	metadataRouter, ok := t.router.(routing.MetadataRouter)
+	if !ok {
+		return t.router.Advertise(ctx, slices.Sorted(maps.Keys(keys)))
+	}
+	metadata := map[string]routing.Metadata{}
+	for key, dgst := range keys {
+		// Keys are advertised without metadata when the descriptor is not available.
+		desc, err := t.ociStore.Descriptor(ctx, dgst)
+		if err != nil {
+			logr.FromContextOrDiscard(ctx).V(1).Info("could not get descriptor for advertised key", "key", key, "err", err.Error())
+			metadata[key] = routing.Metadata{}
+			continue
+		}
+		metadata[key] = routing.Metadata{
+			MediaType: desc.MediaType,
+			Digest:    desc.Digest,
+			Size:      desc.Size,
+		}
+	}
+	return metadataRouter.AdvertiseMetadata(ctx, metadata)
+}
+
+// trackImages returns the tracked images of the store, keyed by tag or by digest for images without a tag.
+func (t *tracker) trackImages(ctx context.Context, imgs []oci.Image) (map[string]trackedImage, error) {
+	tagged := map[digest.Digest]struct{}{}
+	for _, img := range imgs {
+		if img.Tag != "" {
+			tagged[img.Digest] = struct{}{}
+		}
+	}
+	images := map[string]trackedImage{}
+	for _, img := range imgs {
+		// Images referenced by digest are created together with the tagged images of the same target.
+		key, ok := img.TagName()
+		if !ok {
+			if _, ok := tagged[img.Digest]; ok {
+				continue
+			}
+			key = img.Digest.String()
+		}
+		content, err := t.imageContent(ctx, img.Digest)
+		if err != nil {
+			return nil, err
+		}
+		images[key] = trackedImage{ref: img.Reference, content: content}
+	}
+	return images, nil
+}
+
+// imageContent returns the content of the image, mapped to whether all parent manifests of the content match the platforms.
+func (t *tracker) imageContent(ctx context.Context, dgst digest.Digest) (map[digest.Digest]bool, error) {
+	included := map[digest.Digest]struct{}{}
+	excluded := map[digest.Digest]struct{}{}
+	err := t.walkPlatforms(ctx, dgst, true, included, excluded)
+	if err != nil {
+		return nil, err
+	}
+	content := map[digest.Digest]bool{}
+	for dgst := range excluded {
+		content[dgst] = false
+	}
+	for dgst := range included {
+		content[dgst] = true
+	}
+	return content, nil
+}
+
+// walkPlatforms walks the manifests of the content, adding the content to included when all parent manifests match
+// the platforms and to excluded otherwise. Content missing from the store is skipped.
+func (t *tracker) walkPlatforms(ctx context.Context, dgst digest.Digest, match bool, included, excluded map[digest.Digest]struct{}) error {
+	if match {
+		included[dgst] = struct{}{}
+	} else {
+		excluded[dgst] = struct{}{}
+	}
+	desc, err := t.ociStore.Descriptor(ctx, dgst)
+	if errors.Is(err, oci.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case images.IsIndexType(desc.MediaType):
+		var index ocispec.Index
+		err := t.decode(ctx, dgst, &index)
+		if err != nil {
+			return err
+		}
+		for _, manifest := range index.Manifests {
+			// Manifests without a platform, such as attestations, are kept when the index matches.
+			childMatch := match && (manifest.Platform == nil || t.platformMatcher == nil || t.platformMatcher.Match(*manifest.Platform))
+			err := t.walkPlatforms(ctx, manifest.Digest, childMatch, included, excluded)
+			if err != nil {
+				return err
+			}
+		}
+	case images.IsManifestType(desc.MediaType):
+		var manifest ocispec.Manifest
+		err := t.decode(ctx, dgst, &manifest)
+		if err != nil {
+			return err
+		}
+		// The media type of config and layers is not needed, so they are added without looking up the descriptor.
+		for _, child := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+			if match {
+				included[child.Digest] = struct{}{}
+			} else {
+				excluded[child.Digest] = struct{}{}
+			}
+		}
+	}
+	return nil
+}
+
+func (t *tracker) decode(ctx context.Context, dgst digest.Digest, v any) error {
+	rc, err := t.ociStore.Open(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(v)
+}
+
 func allReferencesMatchFilter(refs []oci.Reference, filters []oci.Filter) bool {
 	for _, ref := range refs {
 		if !oci.MatchesFilter(ref, filters) {
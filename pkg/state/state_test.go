@@ -102,11 +102,22 @@ func TestTrack(t *testing.T) {
 			})
 			time.Sleep(100 * time.Millisecond)
 
-			// Check that all images are advertised by digest (this should always happen)
+			// Check that image digests are advertised unless the image is filtered
 			for _, img := range imgs {
 				peers, ok := router.Get(img.Digest.String())
+				if oci.MatchesFilter(img.Reference, tt.registryFilters) {
+					require.False(t, ok, "Image digest %s should NOT be advertised", img.Digest.String())
+					continue
+				}
 				require.True(t, ok, "Image digest %s should be advertised", img.Digest.String())
 				require.Len(t, peers, 1)
+				bal, err := router.Lookup(t.Context(), img.Digest.String(), 1)
+				require.NoError(t, err)
+				peer, err := bal.Next()
+				require.NoError(t, err)
+				require.Equal(t, img.Digest, peer.Metadata.Digest)
+				require.Equal(t, "dummy", peer.Metadata.MediaType)
+				require.Positive(t, peer.Metadata.Size)
 			}
 
 			// Check that images have been filtered
@@ -131,3 +142,372 @@ func TestTrack(t *testing.T) {
 		})
 	}
 }
+
+func TestTrackEvents(t *testing.T) {
+	t.Parallel()
+
+	log := tlog.NewTestLogger(t)
+	ctx := logr.NewContext(t.Context(), log)
+	ctx, cancel := context.WithCancel(ctx)
+
+	ociStore := oci.NewMemory()
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return Track(gCtx, ociStore, router)
+	})
+
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	configDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))}
+	layer := []byte("layer")
+	layerDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{
+			SchemaVersion: 2,
+		},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	}
+	b, err := json.Marshal(&manifest)
+	require.NoError(t, err)
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	img, err := oci.ParseImage("ghcr.io/spegel-org/spegel:v0.0.9", oci.WithDigest(manifestDesc.Digest))
+	require.NoError(t, err)
+	tagName, ok := img.TagName()
+	require.True(t, ok)
+
+	// Content added after tracking has started is advertised from events.
+	time.Sleep(100 * time.Millisecond)
+	for _, w := range []struct {
+		desc ocispec.Descriptor
+		b    []byte
+	}{{configDesc, config}, {layerDesc, layer}, {manifestDesc, b}} {
+		err := ociStore.Write(w.desc, w.b)
+		require.NoError(t, err)
+	}
+	ociStore.AddImage(img)
+	keys := []string{tagName, manifestDesc.Digest.String(), configDesc.Digest.String(), layerDesc.Digest.String()}
+	require.Eventually(t, func() bool {
+		for _, key := range keys {
+			if _, ok := router.Get(key); !ok {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Deleted content is withdrawn.
+	ociStore.DeleteImage(img)
+	for _, dgst := range []digest.Digest{manifestDesc.Digest, configDesc.Digest, layerDesc.Digest} {
+		err := ociStore.Delete(dgst)
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		for _, key := range keys {
+			if peers, _ := router.Get(key); len(peers) > 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	err = g.Wait()
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+type reconcileStore struct {
+	*oci.Memory
+	eventCh chan oci.OCIEvent
+}
+
+func (s *reconcileStore) Subscribe(ctx context.Context) (<-chan oci.OCIEvent, error) {
+	return s.eventCh, nil
+}
+
+func TestTrackReconcile(t *testing.T) {
+	t.Parallel()
+
+	log := tlog.NewTestLogger(t)
+	ctx := logr.NewContext(t.Context(), log)
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Events of the memory store are not received, similar to events missed while resubscribing.
+	ociStore := &reconcileStore{Memory: oci.NewMemory(), eventCh: make(chan oci.OCIEvent)}
+	blobs := [][]byte{[]byte("foo"), []byte("bar")}
+	dgsts := []digest.Digest{}
+	for _, b := range blobs {
+		desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		err := ociStore.Write(desc, b)
+		require.NoError(t, err)
+		dgsts = append(dgsts, desc.Digest)
+	}
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return Track(gCtx, ociStore, router)
+	})
+	require.Eventually(t, func() bool {
+		_, ok := router.Get(dgsts[0].String())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err := ociStore.Delete(dgsts[0])
+	require.NoError(t, err)
+	b := []byte("baz")
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	err = ociStore.Write(desc, b)
+	require.NoError(t, err)
+	ociStore.eventCh <- oci.OCIEvent{Type: oci.ReconcileEvent}
+	require.Eventually(t, func() bool {
+		removed, _ := router.Get(dgsts[0].String())
+		kept, _ := router.Get(dgsts[1].String())
+		added, _ := router.Get(desc.Digest.String())
+		return len(removed) == 0 && len(kept) == 1 && len(added) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	err = g.Wait()
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTrackParentImageFilter(t *testing.T) {
+	t.Parallel()
+
+	log := tlog.NewTestLogger(t)
+	ctx := logr.NewContext(t.Context(), log)
+	ctx, cancel := context.WithCancel(ctx)
+
+	ociStore := &reconcileStore{Memory: oci.NewMemory(), eventCh: make(chan oci.OCIEvent)}
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	filters := []oci.Filter{oci.RegexFilter{Regex: regexp.MustCompile(`:latest$`)}}
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return Track(gCtx, ociStore, router, WithRegistryFilters(filters))
+	})
+	advertised := func(key string) bool {
+		peers, _ := router.Get(key)
+		return len(peers) == 1
+	}
+
+	// Content is created during a pull before the image, so the tags referencing the content are not known yet.
+	descs := []ocispec.Descriptor{}
+	for _, b := range [][]byte{[]byte(`{"architecture":"amd64","os":"linux"}`), []byte("layer")} {
+		mt := ocispec.MediaTypeImageLayer
+		if len(descs) == 0 {
+			mt = ocispec.MediaTypeImageConfig
+		}
+		descs = append(descs, ocispec.Descriptor{MediaType: mt, Digest: digest.FromBytes(b), Size: int64(len(b))})
+		err := ociStore.Write(descs[len(descs)-1], b)
+		require.NoError(t, err)
+	}
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    descs[0],
+		Layers:    descs[1:],
+	}
+	b, err := json.Marshal(&manifest)
+	require.NoError(t, err)
+	manifestDesc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	err = ociStore.Write(manifestDesc, b)
+	require.NoError(t, err)
+	descs = append(descs, manifestDesc)
+	for _, desc := range descs {
+		ociStore.eventCh <- oci.OCIEvent{Type: oci.CreateEvent, Reference: oci.Reference{Registry: "docker.io", Repository: "library/alpine", Digest: desc.Digest}}
+	}
+	require.Never(t, func() bool {
+		return slices.ContainsFunc(descs, func(desc ocispec.Descriptor) bool {
+			return advertised(desc.Digest.String())
+		})
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	// Content is never advertised when the image is created and all parent images are filtered.
+	latest, err := oci.ParseImage("docker.io/library/alpine:latest", oci.WithDigest(manifestDesc.Digest))
+	require.NoError(t, err)
+	ociStore.AddImage(latest)
+	ociStore.eventCh <- oci.OCIEvent{Type: oci.CreateEvent, Reference: oci.Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "latest"}}
+	require.Never(t, func() bool {
+		return advertised("docker.io/library/alpine:latest") || slices.ContainsFunc(descs, func(desc ocispec.Descriptor) bool {
+			return advertised(desc.Digest.String())
+		})
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	// Content is advertised once referenced by an image that is not filtered.
+	tagged, err := oci.ParseImage("docker.io/library/alpine:3.18", oci.WithDigest(manifestDesc.Digest))
+	require.NoError(t, err)
+	ociStore.AddImage(tagged)
+	ociStore.eventCh <- oci.OCIEvent{Type: oci.CreateEvent, Reference: oci.Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18"}}
+	require.Eventually(t, func() bool {
+		return advertised("docker.io/library/alpine:3.18") && !slices.ContainsFunc(descs, func(desc ocispec.Descriptor) bool {
+			return !advertised(desc.Digest.String())
+		})
+	}, 5*time.Second, 10*time.Millisecond)
+	bal, err := router.Lookup(t.Context(), "docker.io/library/alpine:3.18", 1)
+	require.NoError(t, err)
+	peer, err := bal.Next()
+	require.NoError(t, err)
+	require.Equal(t, manifestDesc.Digest, peer.Metadata.Digest)
+
+	// Content is withdrawn when the last image that is not filtered is deleted.
+	ociStore.DeleteImage(tagged)
+	ociStore.eventCh <- oci.OCIEvent{Type: oci.DeleteEvent, Reference: oci.Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.18"}}
+	require.Eventually(t, func() bool {
+		return !advertised("docker.io/library/alpine:3.18") && !slices.ContainsFunc(descs, func(desc ocispec.Descriptor) bool {
+			return advertised(desc.Digest.String())
+		})
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Reconciling agrees with the content evaluated from events.
+	ociStore.eventCh <- oci.OCIEvent{Type: oci.ReconcileEvent}
+	require.Never(t, func() bool {
+		return slices.ContainsFunc(descs, func(desc ocispec.Descriptor) bool {
+			return advertised(desc.Digest.String())
+		})
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	cancel()
+	err = g.Wait()
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTrackPeriodicReconcile(t *testing.T) {
+	t.Parallel()
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	err := Track(t.Context(), oci.NewMemory(), router, WithReconcileInterval(-1))
+	require.EqualError(t, err, "reconcile interval cannot be negative")
+
+	log := tlog.NewTestLogger(t)
+	ctx := logr.NewContext(t.Context(), log)
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Events of the memory store are never received, so content is only advertised by reconciliation.
+	ociStore := &reconcileStore{Memory: oci.NewMemory(), eventCh: make(chan oci.OCIEvent)}
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return Track(gCtx, ociStore, router, WithReconcileInterval(50*time.Millisecond))
+	})
+
+	b := []byte("foo")
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: digest.FromBytes(b), Size: int64(len(b))}
+	err = ociStore.Write(desc, b)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		peers, _ := router.Get(desc.Digest.String())
+		return len(peers) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	err = ociStore.Delete(desc.Digest)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		peers, _ := router.Get(desc.Digest.String())
+		return len(peers) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	err = g.Wait()
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTrackPlatforms(t *testing.T) {
+	t.Parallel()
+
+	log := tlog.NewTestLogger(t)
+	ctx := logr.NewContext(t.Context(), log)
+	ctx, cancel := context.WithCancel(ctx)
+
+	ociStore := oci.NewMemory()
+	write := func(mt string, v any) ocispec.Descriptor {
+		t.Helper()
+
+		b, ok := v.([]byte)
+		if !ok {
+			var err error
+			b, err = json.Marshal(v)
+			require.NoError(t, err)
+		}
+		desc := ocispec.Descriptor{MediaType: mt, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		err := ociStore.Write(desc, b)
+		require.NoError(t, err)
+		return desc
+	}
+	// writeImage writes a multi platform image without adding it to the store.
+	writeImage := func(tag string) (oci.Image, map[string][]ocispec.Descriptor) {
+		t.Helper()
+
+		platformDescs := map[string][]ocispec.Descriptor{}
+		manifestDescs := []ocispec.Descriptor{}
+		for _, platform := range []ocispec.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}} {
+			configDesc := write(ocispec.MediaTypeImageConfig, ocispec.Image{Platform: platform, Config: ocispec.ImageConfig{Labels: map[string]string{"tag": tag}}})
+			layerDesc := write(ocispec.MediaTypeImageLayer, []byte(platform.Architecture+tag))
+			manifest := ocispec.Manifest{
+				Versioned: specs.Versioned{SchemaVersion: 2},
+				MediaType: ocispec.MediaTypeImageManifest,
+				Config:    configDesc,
+				Layers:    []ocispec.Descriptor{layerDesc},
+			}
+			manifestDesc := write(ocispec.MediaTypeImageManifest, manifest)
+			manifestDesc.Platform = &platform
+			manifestDescs = append(manifestDescs, manifestDesc)
+			platformDescs[platform.Architecture] = []ocispec.Descriptor{manifestDesc, configDesc, layerDesc}
+		}
+		index := ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: manifestDescs,
+		}
+		indexDesc := write(ocispec.MediaTypeImageIndex, index)
+		img, err := oci.ParseImage("docker.io/library/alpine:"+tag, oci.WithDigest(indexDesc.Digest))
+		require.NoError(t, err)
+		return img, platformDescs
+	}
+	advertised := func(router *routing.MemoryRouter, dgst digest.Digest) bool {
+		peers, _ := router.Get(dgst.String())
+		return len(peers) == 1
+	}
+
+	img, platformDescs := writeImage("3.18")
+	ociStore.AddImage(img)
+
+	router := routing.NewMemoryRouter(map[string][]netip.AddrPort{}, netip.MustParseAddrPort("127.0.0.1:5000"))
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return Track(gCtx, ociStore, router, WithPlatforms(ocispec.Platform{OS: "linux", Architecture: "arm64"}))
+	})
+	require.Eventually(t, func() bool {
+		return advertised(router, img.Digest)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Only content of the matching platform is advertised.
+	for _, desc := range platformDescs["arm64"] {
+		require.True(t, advertised(router, desc.Digest), "Content %s should be advertised", desc.Digest.String())
+	}
+	for _, desc := range platformDescs["amd64"] {
+		_, ok := router.Get(desc.Digest.String())
+		require.False(t, ok, "Content %s should NOT be advertised", desc.Digest.String())
+	}
+
+	// Content written before the image is created is held back until the image is created.
+	img, platformDescs = writeImage("3.19")
+	require.Never(t, func() bool {
+		return advertised(router, platformDescs["amd64"][2].Digest) || advertised(router, platformDescs["arm64"][2].Digest)
+	}, 100*time.Millisecond, 10*time.Millisecond)
+	ociStore.AddImage(img)
+	require.Eventually(t, func() bool {
+		for _, desc := range platformDescs["arm64"] {
+			if !advertised(router, desc.Digest) {
+				return false
+			}
+		}
+		return advertised(router, img.Digest)
+	}, 5*time.Second, 10*time.Millisecond)
+	for _, desc := range platformDescs["amd64"] {
+		_, ok := router.Get(desc.Digest.String())
+		require.False(t, ok, "Content %s should NOT be advertised", desc.Digest.String())
+	}
+
+	cancel()
+	err := g.Wait()
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -7,7 +7,6 @@ import (
 	"errors"
 	"html/template"
 	"net/http"
-	"net/netip"
 	"net/url"
 	"strings"
 	"time"
@@ -24,6 +23,14 @@ import (
 //go:embed templates/*
 var templatesFS embed.FS
 
+// Router is a router which exposes information about the host and its peers.
+type Router interface {
+	routing.Router
+	ID() string
+	ListPeers() ([]routing.Peer, error)
+	LocalAddresses() []string
+}
+
 type WebConfig struct {
 	OCIClient *oci.Client
 	Filters   []oci.Filter
@@ -47,7 +54,7 @@ func WithRegistryFilters(filters []oci.Filter) WebOption {
 
 type Web struct {
 	mirror    *url.URL
-	router    *routing.P2PRouter
+	router    Router
 	ociClient *oci.Client
 	ociStore  oci.Store
 	tmpls     *template.Template
@@ -55,7 +62,7 @@ type Web struct {
 	filters   []oci.Filter
 }
 
-func NewWeb(router *routing.P2PRouter, ociStore oci.Store, reg *registry.Registry, mirror *url.URL, opts ...WebOption) (*Web, error) {
+func NewWeb(router Router, ociStore oci.Store, reg *registry.Registry, mirror *url.URL, opts ...WebOption) (*Web, error) {
 	cfg := WebConfig{}
 	err := option.Apply(&cfg, opts...)
 	if err != nil {
@@ -117,7 +124,7 @@ type Metadata struct {
 func (w *Web) metaDataHandler(rw httpx.ResponseWriter, req *http.Request) {
 	data := Metadata{
 		LibP2P{
-			ID: w.router.Host().ID().String(),
+			ID: w.router.ID(),
 		},
 	}
 	rw.Header().Set(httpx.HeaderContentType, httpx.ContentTypeJSON)
@@ -170,6 +177,7 @@ func (w *Web) statsHandler(rw httpx.ResponseWriter, req *http.Request) {
 }
 
 type measureResult struct {
+	Metadata      routing.Metadata
 	LookupResults []lookupResult
 	PullResults   []pullResult
 	PeerDuration  time.Duration
@@ -178,7 +186,7 @@ type measureResult struct {
 }
 
 type lookupResult struct {
-	Peer     netip.AddrPort
+	Peer     routing.PeerInfo
 	Duration time.Duration
 }
 
@@ -222,6 +230,9 @@ func (w *Web) measureHandler(rw httpx.ResponseWriter, req *http.Request) {
 		// TODO(phillebaba): This isnt a great solution as removing the peers will affect caching.
 		rr.Remove(peer)
 
+		if !res.Metadata.IsValid() {
+			res.Metadata = peer.Metadata
+		}
 		d := time.Since(lookupStart)
 		res.PeerDuration += d
 		res.LookupResults = append(res.LookupResults, lookupResult{